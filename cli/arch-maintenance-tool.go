@@ -2,23 +2,40 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/olekukonko/tablewriter"
 	"github.com/schollz/progressbar/v3"
+
+	"archmaint/internal/vercmp"
 )
 
 // ArchMaintenance represents the main application
 type ArchMaintenance struct {
-	version string
-	config  *Config
+	version    string
+	config     *Config
+	layers     *configLoader
+	runner     CommandRunner
+	dryRun     *DryRunRunner
+	httpClient *http.Client
+	menuMode   bool
+	status     runStatus
+	// euid decides whether pacman needs fakeroot for the private sync
+	// database copy
+	euid int
+	// syncDBPath is the private sync database copy once tempSyncDB has
+	// refreshed it, or "" when it fell back to the system databases
+	syncDBPath  string
+	syncDBReady bool
 }
 
 // Config holds application configuration
@@ -27,12 +44,33 @@ type Config struct {
 	AutoConfirm          bool
 	BackupEnabled        bool
 	BackupPath           string
+	StatePath            string
+	PacmanRoot           string
+	PacmanDBPath         string
 	CacheRetentionDays   int
+	CacheKeepVersions    int
 	LogRetentionDays     int
 	NotificationsEnabled bool
 	VerboseMode          bool
 	SafeMode             bool
+	NonInteractive       bool
+	AllowDangerous       bool
+	OrphansIgnore        []string
+	NewsURL              string
+	ArchiveURL           string
+	AURHelper            string
+	AURURL               string
+	MirrorMaxAgeHours    int
 	CustomCommands       map[string]CustomCommand
+
+	// Health check thresholds; reaching one raises the check to warn or
+	// critical
+	DiskWarnPercent       int
+	DiskCriticalPercent   int
+	MemoryWarnPercent     int
+	MemoryCriticalPercent int
+	JournalErrorsWarn     int
+	JournalErrorsCritical int
 }
 
 // CustomCommand represents a user-defined command
@@ -41,6 +79,7 @@ type CustomCommand struct {
 	Description string
 	Command     []string
 	Dangerous   bool
+	Maintenance bool
 }
 
 // Task represents a maintenance task
@@ -50,16 +89,18 @@ type Task struct {
 	Command     []string
 	Dangerous   bool
 	Frequency   string
+	// Run, when set, is a built-in implementation used instead of Command
+	Run func()
 }
 
 // SystemInfo holds system information
 type SystemInfo struct {
-	Kernel      string
-	Uptime      string
-	LoadAvg     string
-	MemoryUsage string
-	DiskUsage   string
-	CPUTemp     string
+	Kernel      string `json:"kernel" yaml:"kernel"`
+	Uptime      string `json:"uptime" yaml:"uptime"`
+	LoadAvg     string `json:"load_avg" yaml:"load_avg"`
+	MemoryUsage string `json:"memory_usage" yaml:"memory_usage"`
+	DiskUsage   string `json:"disk_usage" yaml:"disk_usage"`
+	CPUTemp     string `json:"cpu_temp" yaml:"cpu_temp"`
 }
 
 // Colors for beautiful output
@@ -74,72 +115,52 @@ var (
 )
 
 func main() {
+	inv, err := parseArgs(os.Args[1:])
+	if err != nil {
+		printUsageError(err)
+		os.Exit(usageExitCode(os.Args[1:]))
+	}
+
+	app := newArchMaintenance(ExecRunner{})
+	os.Exit(app.execute(inv))
+}
+
+func newArchMaintenance(runner CommandRunner) *ArchMaintenance {
 	app := &ArchMaintenance{
 		version: "1.1.0",
 		config:  loadDefaultConfig(),
+		runner:  runner,
+		dryRun:  &DryRunRunner{Next: runner, Out: os.Stdout},
+
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+		euid:       os.Geteuid(),
 	}
+	app.layers = newConfigLoader(app.config)
+	return app
+}
 
-	// Load user config if exists
-	if err := app.loadConfig(); err == nil {
-		infoColor.Println("Loaded custom configuration")
-	}
-
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
-		case "status", "s":
-			app.showSystemStatus()
-		case "update", "u":
-			app.systemUpdate()
-		case "clean", "c":
-			app.systemClean()
-		case "orphans", "o":
-			app.removeOrphans()
-		case "services", "sv":
-			app.showServices()
-		case "logs", "l":
-			app.showLogs()
-		case "health", "h":
-			app.systemHealthCheck()
-		case "maintenance", "m":
-			app.fullMaintenance()
-		case "backup", "b":
-			app.createBackup()
-		case "restore", "r":
-			app.restoreBackup()
-		case "snapshot", "sn":
-			app.createSnapshot()
-		case "config", "cfg":
-			app.configManager()
-		case "search", "se":
-			if len(os.Args) > 2 {
-				app.searchPackages(os.Args[2])
-			} else {
-				errorColor.Println("Please provide a search term")
-			}
-		case "help", "--help", "-h":
-			app.showHelp()
-		case "version", "--version", "-v":
-			app.showVersion()
-		case "--dry-run":
-			app.config.DryRun = true
-			infoColor.Println("DRY RUN MODE: No changes will be made")
-			if len(os.Args) > 2 {
-				os.Args = append(os.Args[:1], os.Args[2:]...)
-				main()
-			}
-		case "--safe":
-			app.config.SafeMode = true
-			successColor.Println("SAFE MODE: Extra confirmations enabled")
-			if len(os.Args) > 2 {
-				os.Args = append(os.Args[:1], os.Args[2:]...)
-				main()
-			}
-		default:
-			app.showHelp()
+// useFixtures switches the runner to record into or replay from dir
+func (a *ArchMaintenance) useFixtures(mode, dir string) error {
+	var runner CommandRunner
+	if mode == "record" {
+		recorder, err := NewRecordingRunner(a.runner, dir)
+		if err != nil {
+			return err
 		}
+		runner = recorder
+		infoColor.Printf("Recording commands to %s\n", dir)
 	} else {
-		app.showMainMenu()
+		replay, err := ReplayRunnerFromDir(dir)
+		if err != nil {
+			return err
+		}
+		runner = replay
+		infoColor.Printf("Replaying commands from %s\n", dir)
 	}
+
+	a.runner = runner
+	a.dryRun.Next = runner
+	return nil
 }
 
 func loadDefaultConfig() *Config {
@@ -149,27 +170,47 @@ func loadDefaultConfig() *Config {
 		AutoConfirm:          false,
 		BackupEnabled:        true,
 		BackupPath:           filepath.Join(homeDir, ".archmaint/backups"),
+		StatePath:            defaultStatePath(homeDir),
+		PacmanRoot:           "/",
+		PacmanDBPath:         "",
 		CacheRetentionDays:   30,
+		CacheKeepVersions:    3,
 		LogRetentionDays:     7,
 		NotificationsEnabled: true,
 		VerboseMode:          false,
 		SafeMode:             false,
+		NonInteractive:       false,
+		AllowDangerous:       false,
+		NewsURL:              defaultNewsURL,
+		ArchiveURL:           defaultArchiveURL,
+		AURHelper:            "auto",
+		AURURL:               defaultAURURL,
+		MirrorMaxAgeHours:    24,
 		CustomCommands:       make(map[string]CustomCommand),
-	}
-}
 
-func (a *ArchMaintenance) loadConfig() error {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return err
+		DiskWarnPercent:       80,
+		DiskCriticalPercent:   90,
+		MemoryWarnPercent:     80,
+		MemoryCriticalPercent: 90,
+		JournalErrorsWarn:     1,
+		JournalErrorsCritical: 5,
 	}
+}
 
-	configPath := filepath.Join(homeDir, ".config/archmaint/config.conf")
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return err
+// loadConfig applies /etc/archmaint/config.conf, /etc/archmaint/conf.d/*.conf,
+// the user file and ARCHMAINT_* variables on top of the defaults, in that
+// order. An empty userPath selects ~/.config/archmaint/config.conf. It
+// returns the files that were read.
+func (a *ArchMaintenance) loadConfig(userPath string) ([]string, error) {
+	if userPath == "" {
+		userPath, _ = userConfigPath()
 	}
 
-	return nil
+	loaded, errs := a.layers.loadFiles(userPath)
+	errs = append(errs, a.layers.loadEnv()...)
+	errs = append(errs, a.layers.loadCustomEnv()...)
+	errs = append(errs, a.layers.validateCustomCommands()...)
+	return loaded, errors.Join(errs...)
 }
 
 func (a *ArchMaintenance) showBanner() {
@@ -208,10 +249,22 @@ func (a *ArchMaintenance) showMainMenu() {
 		{"10", "Create Backup", "Backup package list and important files"},
 		{"11", "Create Snapshot", "Create system snapshot (btrfs)"},
 		{"12", "Configuration", "Manage settings and preferences"},
-		{"h", "Help", "Show help information"},
-		{"0", "Exit", "Exit the application"},
 	}
 
+	customNames := a.config.customCommandNames()
+	for i, name := range customNames {
+		desc := a.config.CustomCommands[name].Description
+		if desc == "" {
+			desc = "Custom command"
+		}
+		options = append(options, []string{fmt.Sprint(13 + i), name, desc})
+	}
+
+	options = append(options,
+		[]string{"h", "Help", "Show help information"},
+		[]string{"0", "Exit", "Exit the application"},
+	)
+
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"Option", "Command", "Description"})
 	table.SetBorder(false)
@@ -254,7 +307,7 @@ func (a *ArchMaintenance) showMainMenu() {
 	case "9":
 		fmt.Print("Enter search term: ")
 		term, _ := reader.ReadString('\n')
-		a.searchPackages(strings.TrimSpace(term))
+		a.searchPackages(strings.TrimSpace(term), false)
 	case "10":
 		a.createBackup()
 	case "11":
@@ -267,6 +320,11 @@ func (a *ArchMaintenance) showMainMenu() {
 		successColor.Println("Goodbye! Keep your Arch system running smoothly!")
 		os.Exit(0)
 	default:
+		if n := parseInt(choice); n >= 13 && n < 13+len(customNames) {
+			a.runCustomCommand(customNames[n-13])
+			a.waitForContinue()
+			return
+		}
 		errorColor.Println("Invalid choice. Please try again.")
 		time.Sleep(2 * time.Second)
 		a.showMainMenu()
@@ -311,22 +369,22 @@ func (a *ArchMaintenance) showSystemStatus() {
 func (a *ArchMaintenance) getSystemInfo() SystemInfo {
 	info := SystemInfo{}
 
-	if output, err := exec.Command("uname", "-r").Output(); err == nil {
+	if output, err := a.query("uname", "-r"); err == nil {
 		info.Kernel = strings.TrimSpace(string(output))
 	}
 
-	if output, err := exec.Command("uptime", "-p").Output(); err == nil {
+	if output, err := a.query("uptime", "-p"); err == nil {
 		info.Uptime = strings.TrimSpace(string(output))
 	}
 
-	if output, err := exec.Command("cat", "/proc/loadavg").Output(); err == nil {
+	if output, err := a.query("cat", "/proc/loadavg"); err == nil {
 		fields := strings.Fields(string(output))
 		if len(fields) >= 3 {
 			info.LoadAvg = fmt.Sprintf("%s %s %s", fields[0], fields[1], fields[2])
 		}
 	}
 
-	if output, err := exec.Command("free", "-h").Output(); err == nil {
+	if output, err := a.query("free", "-h"); err == nil {
 		lines := strings.Split(string(output), "\n")
 		if len(lines) > 1 {
 			fields := strings.Fields(lines[1])
@@ -336,7 +394,7 @@ func (a *ArchMaintenance) getSystemInfo() SystemInfo {
 		}
 	}
 
-	if output, err := exec.Command("df", "-h", "/").Output(); err == nil {
+	if output, err := a.query("df", "-h", "/"); err == nil {
 		lines := strings.Split(string(output), "\n")
 		if len(lines) > 1 {
 			fields := strings.Fields(lines[1])
@@ -346,14 +404,15 @@ func (a *ArchMaintenance) getSystemInfo() SystemInfo {
 		}
 	}
 
-	if output, err := exec.Command("bash", "-c", "sensors 2>/dev/null | grep -i 'Package id 0' | awk '{print $4}' || echo 'N/A'").Output(); err == nil {
-		temp := strings.TrimSpace(string(output))
-		if temp == "" {
-			temp = "N/A"
+	info.CPUTemp = "N/A"
+	if output, err := a.query("sensors"); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if strings.Contains(strings.ToLower(line), "package id 0") && len(fields) >= 4 {
+				info.CPUTemp = fields[3]
+				break
+			}
 		}
-		info.CPUTemp = temp
-	} else {
-		info.CPUTemp = "N/A"
 	}
 
 	return info
@@ -362,57 +421,40 @@ func (a *ArchMaintenance) getSystemInfo() SystemInfo {
 func (a *ArchMaintenance) showPackageInfo() {
 	infoColor.Println("Package Information:")
 
-	if output, err := exec.Command("pacman", "-Q").Output(); err == nil {
-		count := len(strings.Split(strings.TrimSpace(string(output)), "\n"))
-		fmt.Printf("  Installed packages: %d\n", count)
+	counts := a.packageCounts()
+
+	if counts.Installed >= 0 {
+		fmt.Printf("  Installed packages: %d\n", counts.Installed)
 	}
 
-	if output, err := exec.Command("pacman", "-Qe").Output(); err == nil {
-		count := len(strings.Split(strings.TrimSpace(string(output)), "\n"))
-		fmt.Printf("  Explicitly installed: %d\n", count)
+	if counts.Explicit >= 0 {
+		fmt.Printf("  Explicitly installed: %d\n", counts.Explicit)
 	}
 
-	if output, err := exec.Command("pacman", "-Qtdq").Output(); err == nil {
-		orphans := strings.TrimSpace(string(output))
-		if orphans != "" {
-			count := len(strings.Split(orphans, "\n"))
-			warningColor.Printf("  Orphaned packages: %d\n", count)
-		} else {
-			fmt.Printf("  Orphaned packages: 0\n")
-		}
+	if counts.Orphans > 0 {
+		warningColor.Printf("  Orphaned packages: %d\n", counts.Orphans)
+	} else if counts.Orphans == 0 {
+		fmt.Printf("  Orphaned packages: 0\n")
 	}
 
-	if output, err := exec.Command("pacman", "-Qu").Output(); err == nil {
-		updates := strings.TrimSpace(string(output))
-		if updates != "" {
-			count := len(strings.Split(updates, "\n"))
-			warningColor.Printf("  Packages to update: %d\n", count)
-		} else {
-			successColor.Printf("  Packages to update: 0\n")
-		}
+	if counts.Updates > 0 {
+		warningColor.Printf("  Packages to update: %d\n", counts.Updates)
+	} else if counts.Updates == 0 {
+		successColor.Printf("  Packages to update: 0\n")
 	}
 }
 
 func (a *ArchMaintenance) showDiskHealth() {
 	infoColor.Println("Disk Health:")
 
-	if output, err := exec.Command("df", "-h", "-x", "tmpfs", "-x", "devtmpfs").Output(); err == nil {
-		lines := strings.Split(string(output), "\n")
-		for i, line := range lines {
-			if i == 0 || strings.TrimSpace(line) == "" {
-				continue
-			}
-			fields := strings.Fields(line)
-			if len(fields) >= 5 {
-				usage := strings.TrimSuffix(fields[4], "%")
-				if val := parseInt(usage); val > 90 {
-					errorColor.Printf("  WARNING %s: %s used (Critical!)\n", fields[5], fields[4])
-				} else if val > 80 {
-					warningColor.Printf("  WARNING %s: %s used\n", fields[5], fields[4])
-				} else {
-					fmt.Printf("  OK %s: %s used\n", fields[5], fields[4])
-				}
-			}
+	for _, disk := range a.diskUsage() {
+		switch disk.Status {
+		case "critical":
+			errorColor.Printf("  WARNING %s: %d%% used (Critical!)\n", disk.Mount, disk.UsedPercent)
+		case "warning":
+			warningColor.Printf("  WARNING %s: %d%% used\n", disk.Mount, disk.UsedPercent)
+		default:
+			fmt.Printf("  OK %s: %d%% used\n", disk.Mount, disk.UsedPercent)
 		}
 	}
 }
@@ -430,56 +472,79 @@ func (a *ArchMaintenance) systemUpdate() {
 		warningColor.Println("DRY RUN: Showing what would be updated")
 	}
 
-	if a.config.BackupEnabled && !a.config.DryRun {
-		if a.confirmAction("Create backup before updating?", false) {
-			a.createBackup()
-		}
+	if !a.checkNews() {
+		return
 	}
 
-	if !a.confirmAction("This will update your system. Continue?", false) {
+	// Updates are listed from a private copy of the sync databases; the
+	// real ones are only refreshed by the -Syu that installs them
+	infoColor.Println("Checking for updates...")
+	dbPath, err := a.tempSyncDB()
+	if err != nil {
+		errorColor.Printf("Failed to check for updates: %v\n", err)
+		a.status.failures++
 		return
 	}
-
-	infoColor.Println("Syncing package databases...")
-	if !a.config.DryRun {
-		a.runCommandWithProgress("sudo", "pacman", "-Sy")
-	} else {
-		fmt.Println("  Would run: sudo pacman -Sy")
+	updates, err := a.pendingUpdates(dbPath)
+	if err != nil {
+		errorColor.Printf("Failed to check for updates: %v\n", err)
+		a.status.failures++
+		return
+	}
+	aur, notInAUR, err := a.aurUpdates()
+	if err != nil {
+		warningColor.Printf("Could not check the AUR for updates: %v\n", err)
+	}
+	if len(notInAUR) > 0 {
+		infoColor.Printf("Not in the AUR, not checked: %s\n", strings.Join(notInAUR, ", "))
 	}
 
-	infoColor.Println("\nChecking for updates...")
-	cmd := exec.Command("pacman", "-Qu")
-	output, err := cmd.Output()
-
-	if err != nil || strings.TrimSpace(string(output)) == "" {
+	if len(updates) == 0 && len(aur) == 0 {
 		successColor.Println("System is up to date!")
 		a.waitForContinue()
 		return
 	}
 
-	updates := strings.Split(strings.TrimSpace(string(output)), "\n")
-	fmt.Printf("\nAvailable updates (%d packages):\n", len(updates))
+	a.completeUpdates(updates, dbPath)
+	if len(updates) > 0 {
+		printUpdatePreview(updates, 20)
+	}
+	if len(aur) > 0 {
+		fmt.Printf("\nAUR updates (%d packages):\n", len(aur))
+		for _, update := range aur {
+			fmt.Printf("  • %s %s -> %s\n", update.Name, update.OldVersion, update.NewVersion)
+		}
+	}
 
-	displayCount := 20
-	for i, update := range updates {
-		if i >= displayCount {
-			infoColor.Printf("... and %d more packages\n", len(updates)-displayCount)
-			break
+	if len(updates) == 0 {
+		a.updateAUR(aur)
+		a.waitForContinue()
+		return
+	}
+
+	if a.config.BackupEnabled && !a.config.DryRun {
+		if a.confirmAction("Create backup before updating?", false) {
+			a.createBackup()
 		}
-		fmt.Printf("  • %s\n", update)
 	}
 
-	if a.confirmAction(fmt.Sprintf("Proceed with updating %d packages?", len(updates)), false) {
+	if a.proceed(fmt.Sprintf("Proceed with updating %d packages?", len(updates)), false) {
 		infoColor.Println("Updating system...")
 		if !a.config.DryRun {
-			a.runCommandWithProgress("sudo", "pacman", "-Su", "--noconfirm")
-			successColor.Println("System update completed!")
+			failures := a.status.failures
+			a.runCommandWithProgress("sudo", "pacman", "-Syu", "--noconfirm")
+			if a.status.failures == failures {
+				a.recordUpgrade()
+				successColor.Println("System update completed!")
+				a.updateAUR(aur)
+			}
 
 			if a.needsReboot() {
 				warningColor.Println("\nSystem reboot recommended to apply updates")
 			}
 		} else {
-			fmt.Println("  Would run: sudo pacman -Su")
+			fmt.Println("  Would run: sudo pacman -Syu")
+			a.updateAUR(aur)
 		}
 	}
 
@@ -487,34 +552,65 @@ func (a *ArchMaintenance) systemUpdate() {
 }
 
 func (a *ArchMaintenance) needsReboot() bool {
-	cmd := exec.Command("bash", "-c", "uname -r | cut -d'-' -f1")
-	currentKernel, _ := cmd.Output()
+	needed, _ := a.rebootStatus()
+	return needed
+}
 
-	cmd = exec.Command("bash", "-c", "pacman -Q linux 2>/dev/null | awk '{print $2}' | cut -d'-' -f1")
-	installedKernel, _ := cmd.Output()
+// rebootStatus compares the running kernel with the installed one and
+// looks for upgrades of rebootPackages since boot. known is false when
+// neither could be determined.
+func (a *ArchMaintenance) rebootStatus() (needed, known bool) {
+	if pkgs, ok := a.upgradedSinceBoot(); ok {
+		needed, known = len(pkgs) > 0, true
+	}
 
-	return strings.TrimSpace(string(currentKernel)) != strings.TrimSpace(string(installedKernel))
-}
+	currentKernel, err := a.query("uname", "-r")
+	if err != nil {
+		return needed, known
+	}
 
-func (a *ArchMaintenance) systemClean() {
-	headerColor.Println("\n=== SYSTEM CLEAN ===")
+	var installedKernel string
+	if output, err := a.query("pacman", "-Q", "linux"); err == nil {
+		if fields := strings.Fields(string(output)); len(fields) >= 2 {
+			installedKernel = fields[1]
+		}
+	}
+	if installedKernel == "" {
+		return needed, known
+	}
 
-	if a.config.DryRun {
-		warningColor.Println("DRY RUN: Showing what would be cleaned")
+	mismatch := vercmp.Compare(strings.TrimSpace(string(currentKernel)), kernelRelease(installedKernel)) != 0
+	return needed || mismatch, true
+}
+
+// kernelRelease turns a linux package version such as 6.2.arch1-1 into the
+// uname -r form 6.2.0-arch1-1
+func kernelRelease(pkgVersion string) string {
+	_, pkgver, pkgrel := vercmp.Parse(pkgVersion)
+	base, flavour, ok := strings.Cut(pkgver, ".arch")
+	if !ok {
+		return pkgVersion
 	}
+	if strings.Count(base, ".") == 1 {
+		base += ".0"
+	}
+	return base + "-arch" + flavour + "-" + pkgrel
+}
 
-	tasks := []Task{
+// cleanTasks are the steps of systemClean
+func (a *ArchMaintenance) cleanTasks() []Task {
+	return []Task{
 		{
 			Name:        "Package Cache",
-			Description: fmt.Sprintf("Clean pacman cache (keep %d days)", a.config.CacheRetentionDays),
-			Command:     []string{"sudo", "paccache", "-rk3"},
+			Description: fmt.Sprintf("Clean pacman cache (keep %d versions or %d days, and installed versions)", a.config.CacheKeepVersions, a.config.CacheRetentionDays),
+			Run:         func() { a.pruneCache(a.cacheRetentionPlan) },
 			Dangerous:   false,
 			Frequency:   "Weekly",
 		},
 		{
 			Name:        "Uninstalled Package Cache",
 			Description: "Remove cache for uninstalled packages",
-			Command:     []string{"sudo", "paccache", "-ruk0"},
+			Run:         func() { a.pruneCache(a.uninstalledCachePlan) },
 			Dangerous:   false,
 			Frequency:   "Weekly",
 		},
@@ -540,8 +636,16 @@ func (a *ArchMaintenance) systemClean() {
 			Frequency:   "Monthly",
 		},
 	}
+}
+
+func (a *ArchMaintenance) systemClean() {
+	headerColor.Println("\n=== SYSTEM CLEAN ===")
+
+	if a.config.DryRun {
+		warningColor.Println("DRY RUN: Showing what would be cleaned")
+	}
 
-	for _, task := range tasks {
+	for _, task := range a.cleanTasks() {
 		fmt.Printf("\n%s (%s)\n", task.Name, task.Frequency)
 		fmt.Printf("Description: %s\n", task.Description)
 
@@ -550,7 +654,9 @@ func (a *ArchMaintenance) systemClean() {
 		}
 
 		if a.confirmAction(fmt.Sprintf("Run %s cleanup?", task.Name), task.Dangerous) {
-			if !a.config.DryRun {
+			if task.Run != nil {
+				task.Run()
+			} else if !a.config.DryRun {
 				a.runCommandWithProgress(task.Command[0], task.Command[1:]...)
 			} else {
 				fmt.Printf("  Would run: %s\n", strings.Join(task.Command, " "))
@@ -562,51 +668,16 @@ func (a *ArchMaintenance) systemClean() {
 	a.waitForContinue()
 }
 
-func (a *ArchMaintenance) removeOrphans() {
-	headerColor.Println("\n=== REMOVE ORPHANED PACKAGES ===")
-
-	cmd := exec.Command("pacman", "-Qtdq")
-	output, err := cmd.Output()
-
-	if err != nil || strings.TrimSpace(string(output)) == "" {
-		successColor.Println("No orphaned packages found!")
-		return
-	}
-
-	orphans := strings.TrimSpace(string(output))
-	orphanList := strings.Split(orphans, "\n")
-
-	fmt.Printf("Found %d orphaned packages:\n", len(orphanList))
-	for i, pkg := range orphanList {
-		if i >= 20 {
-			infoColor.Printf("... and %d more packages\n", len(orphanList)-20)
-			break
-		}
-		fmt.Printf("  • %s\n", pkg)
-	}
-
-	if a.confirmAction(fmt.Sprintf("Remove these %d orphaned packages?", len(orphanList)), true) {
-		if !a.config.DryRun {
-			args := append([]string{"pacman", "-Rns", "--noconfirm"}, orphanList...)
-			a.runCommandWithProgress("sudo", args...)
-			successColor.Println("Orphaned packages removed!")
-		} else {
-			fmt.Println("  Would run: sudo pacman -Rns " + strings.Join(orphanList, " "))
-		}
-	}
-}
-
 func (a *ArchMaintenance) showServices() {
 	headerColor.Println("\n=== SYSTEM SERVICES ===")
 
 	infoColor.Println("Failed services:")
-	a.runCommand("systemctl", "--failed")
+	a.viewCommand("systemctl", "--failed")
 
 	fmt.Println()
 	infoColor.Println("Service status summary:")
 
-	cmd := exec.Command("systemctl", "list-units", "--type=service", "--all", "--no-pager")
-	output, _ := cmd.Output()
+	output, _ := a.query("systemctl", "list-units", "--type=service", "--all", "--no-pager")
 
 	active := 0
 	failed := 0
@@ -638,132 +709,15 @@ func (a *ArchMaintenance) showLogs() {
 	headerColor.Println("\n=== SYSTEM LOGS ===")
 
 	infoColor.Println("Recent critical and error logs:")
-	a.runCommand("journalctl", "-p", "3", "-x", "--no-pager", "--since", "today", "-n", "50")
+	a.viewCommand("journalctl", "-p", "3", "-x", "--no-pager", "--since", "today", "-n", "50")
 
 	fmt.Println()
 	infoColor.Println("Boot messages:")
-	a.runCommand("journalctl", "-b", "--no-pager", "-n", "20")
-
-	a.waitForContinue()
-}
-
-func (a *ArchMaintenance) systemHealthCheck() {
-	headerColor.Println("\n=== SYSTEM HEALTH CHECK ===")
-
-	checks := []struct {
-		name string
-		fn   func() bool
-		desc string
-	}{
-		{"Disk Space", a.checkDiskSpace, "Checking available disk space"},
-		{"Memory Usage", a.checkMemory, "Checking memory usage"},
-		{"Failed Services", a.checkServices, "Checking for failed services"},
-		{"Package Database", a.checkPackageDB, "Verifying package database integrity"},
-		{"System Errors", a.checkSystemErrors, "Checking for recent system errors"},
-		{"Security Updates", a.checkSecurityUpdates, "Checking for security updates"},
-	}
-
-	passedChecks := 0
-	totalChecks := len(checks)
-
-	for i, check := range checks {
-		fmt.Printf("\n[%d/%d] %s\n", i+1, totalChecks, check.name)
-		infoColor.Printf("     %s...\n", check.desc)
-
-		if check.fn() {
-			successColor.Println("     PASSED")
-			passedChecks++
-		} else {
-			errorColor.Println("     FAILED")
-		}
-	}
-
-	fmt.Println()
-	fmt.Println(strings.Repeat("=", 50))
-
-	percentage := (passedChecks * 100) / totalChecks
-	if percentage == 100 {
-		successColor.Printf("Health Score: %d%% (%d/%d checks passed)\n", percentage, passedChecks, totalChecks)
-	} else if percentage >= 80 {
-		warningColor.Printf("Health Score: %d%% (%d/%d checks passed)\n", percentage, passedChecks, totalChecks)
-	} else {
-		errorColor.Printf("Health Score: %d%% (%d/%d checks passed)\n", percentage, passedChecks, totalChecks)
-	}
+	a.viewCommand("journalctl", "-b", "--no-pager", "-n", "20")
 
 	a.waitForContinue()
 }
 
-func (a *ArchMaintenance) checkDiskSpace() bool {
-	cmd := exec.Command("df", "-h", "/")
-	output, _ := cmd.Output()
-	lines := strings.Split(string(output), "\n")
-	if len(lines) > 1 {
-		fields := strings.Fields(lines[1])
-		if len(fields) >= 5 {
-			usage := strings.TrimSuffix(fields[4], "%")
-			if parseInt(usage) < 90 {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func (a *ArchMaintenance) checkMemory() bool {
-	cmd := exec.Command("free")
-	output, _ := cmd.Output()
-	lines := strings.Split(string(output), "\n")
-	if len(lines) > 1 {
-		fields := strings.Fields(lines[1])
-		if len(fields) >= 3 {
-			total := parseInt(fields[1])
-			used := parseInt(fields[2])
-			if total > 0 && (used*100/total) < 90 {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func (a *ArchMaintenance) checkServices() bool {
-	cmd := exec.Command("systemctl", "--failed", "--no-legend")
-	output, _ := cmd.Output()
-	return strings.TrimSpace(string(output)) == ""
-}
-
-func (a *ArchMaintenance) checkPackageDB() bool {
-	cmd := exec.Command("pacman", "-Dk")
-	err := cmd.Run()
-	return err == nil
-}
-
-func (a *ArchMaintenance) checkSystemErrors() bool {
-	cmd := exec.Command("journalctl", "-p", "3", "--since", "today", "--no-pager")
-	output, _ := cmd.Output()
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	return len(lines) < 5 || (len(lines) == 1 && lines[0] == "")
-}
-
-func (a *ArchMaintenance) checkSecurityUpdates() bool {
-	cmd := exec.Command("pacman", "-Qu")
-	output, _ := cmd.Output()
-	updates := strings.TrimSpace(string(output))
-
-	if updates == "" {
-		return true
-	}
-
-	criticalPackages := []string{"linux", "systemd", "glibc", "openssl"}
-	for _, pkg := range criticalPackages {
-		if strings.Contains(updates, pkg) {
-			return false
-		}
-	}
-
-	return true
-}
-
 func (a *ArchMaintenance) fullMaintenance() {
 	headerColor.Println("\n=== FULL SYSTEM MAINTENANCE ===")
 
@@ -777,7 +731,15 @@ func (a *ArchMaintenance) fullMaintenance() {
 	fmt.Println("  6. Temporary file cleanup")
 	fmt.Println("  7. System health check")
 
-	if !a.confirmAction("Are you sure you want to continue with full maintenance?", true) {
+	var customSteps []string
+	for _, name := range a.config.customCommandNames() {
+		if a.config.CustomCommands[name].Maintenance {
+			customSteps = append(customSteps, name)
+			fmt.Printf("  %d. Custom command: %s\n", 7+len(customSteps), name)
+		}
+	}
+
+	if !a.proceed("Are you sure you want to continue with full maintenance?", true) {
 		return
 	}
 
@@ -788,9 +750,19 @@ func (a *ArchMaintenance) fullMaintenance() {
 		{"Creating Backup", a.createBackup},
 		{"Updating System", a.systemUpdate},
 		{"Cleaning System", a.systemClean},
-		{"Removing Orphans", a.removeOrphans},
-		{"Running Health Check", a.systemHealthCheck},
+		{"Removing Orphans", func() { a.removeOrphans() }},
+	}
+	for _, name := range customSteps {
+		name := name
+		steps = append(steps, struct {
+			name string
+			fn   func()
+		}{"Running " + name, func() { a.runCustomCommand(name) }})
 	}
+	steps = append(steps, struct {
+		name string
+		fn   func()
+	}{"Running Health Check", a.systemHealthCheck})
 
 	for i, step := range steps {
 		headerColor.Printf("\n[Step %d/%d] %s\n", i+1, len(steps), step.name)
@@ -823,6 +795,7 @@ func (a *ArchMaintenance) createBackup() {
 
 	if err := os.MkdirAll(a.config.BackupPath, 0755); err != nil {
 		errorColor.Printf("Failed to create backup directory: %v\n", err)
+		a.status.failures++
 		return
 	}
 
@@ -832,6 +805,7 @@ func (a *ArchMaintenance) createBackup() {
 	if !a.config.DryRun {
 		if err := os.MkdirAll(backupDir, 0755); err != nil {
 			errorColor.Printf("Failed to create backup directory: %v\n", err)
+			a.status.failures++
 			return
 		}
 	}
@@ -876,15 +850,16 @@ func (a *ArchMaintenance) createBackup() {
 		if a.config.DryRun {
 			fmt.Printf("  Would backup: %s\n", item.name)
 		} else {
-			cmd := exec.Command(item.cmd[0], item.cmd[1:]...)
-			output, err := cmd.Output()
+			packages, err := a.queryList(item.cmd[0], item.cmd[1:]...)
 			if err == nil {
 				outputFile := filepath.Join(backupDir, item.file)
-				if err := os.WriteFile(outputFile, output, 0644); err == nil {
-					if a.config.VerboseMode {
-						successColor.Printf("  Backed up: %s\n", item.name)
-					}
-				}
+				err = os.WriteFile(outputFile, []byte(strings.Join(packages, "\n")+"\n"), 0644)
+			}
+			if err != nil {
+				errorColor.Printf("  Failed to back up %s: %v\n", item.name, err)
+				a.status.failures++
+			} else if a.config.VerboseMode {
+				successColor.Printf("  Backed up: %s\n", item.name)
 			}
 		}
 		bar.Add(1)
@@ -895,85 +870,152 @@ func (a *ArchMaintenance) createBackup() {
 	if !a.config.DryRun {
 		successColor.Printf("Backup created: %s\n", backupDir)
 
-		cmd := exec.Command("du", "-sh", backupDir)
-		if output, err := cmd.Output(); err == nil {
+		if output, err := a.query("du", "-sh", backupDir); err == nil {
 			size := strings.Fields(string(output))[0]
 			infoColor.Printf("  Backup size: %s\n", size)
 		}
 
-		a.listBackups()
+		a.listBackups(5)
 	}
 }
 
-func (a *ArchMaintenance) listBackups() {
-	files, err := os.ReadDir(a.config.BackupPath)
-	if err != nil {
+// listBackups prints the newest backups, all of them when limit is 0
+func (a *ArchMaintenance) listBackups(limit int) {
+	report, err := a.backups()
+	if err != nil || len(report.Backups) == 0 {
 		return
 	}
 
-	if len(files) > 0 {
-		fmt.Println("\nRecent backups:")
-		count := 0
-		for i := len(files) - 1; i >= 0 && count < 5; i-- {
-			if files[i].IsDir() {
-				info, _ := files[i].Info()
-				fmt.Printf("  - %s (%s)\n", files[i].Name(),
-					info.ModTime().Format("2006-01-02 15:04:05"))
-				count++
-			}
+	fmt.Println("\nRecent backups:")
+	for i, backup := range report.Backups {
+		if limit > 0 && i >= limit {
+			break
 		}
+		fmt.Printf("  - %s (%s)\n", backup.Name, backup.Created.Format("2006-01-02 15:04:05"))
 	}
 }
 
-func (a *ArchMaintenance) restoreBackup() {
-	headerColor.Println("\n=== RESTORE BACKUP ===")
+func (a *ArchMaintenance) showBackups() {
+	headerColor.Println("\n=== BACKUPS ===")
 
-	files, err := os.ReadDir(a.config.BackupPath)
-	if err != nil || len(files) == 0 {
-		errorColor.Println("No backups found!")
+	report, err := a.backups()
+	if err != nil {
+		errorColor.Printf("Failed to read backups: %v\n", err)
+		a.status.failures++
 		return
 	}
+	if len(report.Backups) == 0 {
+		infoColor.Printf("No backups in %s\n", report.Path)
+		return
+	}
+
+	infoColor.Printf("Backup directory: %s\n", report.Path)
+	a.listBackups(0)
+}
+
+// restoreBackup restores the named backup ("latest" for the newest one), or
+// asks which one to restore when name is empty
+func (a *ArchMaintenance) restoreBackup(name string) {
+	headerColor.Println("\n=== RESTORE BACKUP ===")
 
-	fmt.Println("Available backups:")
+	files, _ := os.ReadDir(a.config.BackupPath)
+
+	// Directories without a package list only hold backed up files
 	backups := []os.DirEntry{}
 	for i := len(files) - 1; i >= 0; i-- {
-		if files[i].IsDir() {
+		pkgList := filepath.Join(a.config.BackupPath, files[i].Name(), "packages_explicit.txt")
+		if _, err := os.Stat(pkgList); err == nil && files[i].IsDir() {
 			backups = append(backups, files[i])
-			fmt.Printf("  %d. %s\n", len(backups), files[i].Name())
 		}
 	}
+	if len(backups) == 0 {
+		errorColor.Println("No backups found!")
+		a.status.failures++
+		return
+	}
 
-	fmt.Print("\nSelect backup to restore (0 to cancel): ")
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	choice := parseInt(strings.TrimSpace(input))
-
-	if choice <= 0 || choice > len(backups) {
-		infoColor.Println("Restore cancelled.")
+	var selectedBackup os.DirEntry
+	switch {
+	case name == "latest" && len(backups) > 0:
+		selectedBackup = backups[0]
+	case name != "":
+		for _, backup := range backups {
+			if backup.Name() == name {
+				selectedBackup = backup
+			}
+		}
+		if selectedBackup == nil {
+			errorColor.Printf("Backup not found: %s\n", name)
+			a.status.failures++
+			return
+		}
+	case a.config.NonInteractive:
+		errorColor.Println("Non-interactive restore needs a backup name or 'latest'")
+		a.status.failures++
 		return
+	default:
+		fmt.Println("Available backups:")
+		for i, backup := range backups {
+			fmt.Printf("  %d. %s\n", i+1, backup.Name())
+		}
+
+		fmt.Print("\nSelect backup to restore (0 to cancel): ")
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		choice := parseInt(strings.TrimSpace(input))
+
+		if choice <= 0 || choice > len(backups) {
+			infoColor.Println("Restore cancelled.")
+			a.status.aborted = true
+			return
+		}
+		selectedBackup = backups[choice-1]
 	}
 
-	selectedBackup := backups[choice-1]
+	infoColor.Printf("Selected backup: %s\n", selectedBackup.Name())
+	if info, err := selectedBackup.Info(); err == nil {
+		if changes, err := a.changesSince(backupTime(selectedBackup.Name(), info.ModTime())); err == nil {
+			infoColor.Printf("Changes since this backup: %s\n", summarizeChanges(changes))
+		}
+	}
 	backupPath := filepath.Join(a.config.BackupPath, selectedBackup.Name())
 
+	if a.refusePartialUpgrade() {
+		return
+	}
+
 	dangerColor.Println("\nWARNING: This will install packages from the backup!")
-	if !a.confirmAction("Continue with restore?", true) {
+	if !a.proceed("Continue with restore?", true) {
 		return
 	}
 
-	pkgFile := filepath.Join(backupPath, "packages_explicit.txt")
-	if data, err := os.ReadFile(pkgFile); err == nil {
-		packages := strings.Split(strings.TrimSpace(string(data)), "\n")
-		infoColor.Printf("Restoring %d packages...\n", len(packages))
+	packages, err := readPackageList(backupPath, "packages_explicit.txt")
+	if err != nil {
+		errorColor.Printf("Failed to read package list: %v\n", err)
+		a.status.failures++
+		a.waitForContinue()
+		return
+	}
 
+	// pacman -S fails outright on a name no repository has, so foreign
+	// packages go to the AUR helper instead
+	foreignList, _ := readPackageList(backupPath, "packages_foreign.txt")
+	repo, foreign := a.splitForeign(packages, foreignList)
+
+	if len(repo) > 0 {
+		infoColor.Printf("Restoring %d packages...\n", len(repo))
 		if !a.config.DryRun {
-			args := append([]string{"pacman", "-S", "--needed", "--noconfirm"}, packages...)
+			failures := a.status.failures
+			args := append([]string{"pacman", "-S", "--needed", "--noconfirm"}, repo...)
 			a.runCommandWithProgress("sudo", args...)
-			successColor.Println("Packages restored!")
+			if a.status.failures == failures {
+				successColor.Println("Packages restored!")
+			}
 		} else {
-			fmt.Println("  Would install:", len(packages), "packages")
+			fmt.Println("  Would install:", len(repo), "packages")
 		}
 	}
+	a.restoreForeign(foreign)
 
 	a.waitForContinue()
 }
@@ -981,8 +1023,7 @@ func (a *ArchMaintenance) restoreBackup() {
 func (a *ArchMaintenance) createSnapshot() {
 	headerColor.Println("\n=== CREATE SYSTEM SNAPSHOT ===")
 
-	cmd := exec.Command("findmnt", "-n", "-o", "FSTYPE", "/")
-	output, err := cmd.Output()
+	output, err := a.query("findmnt", "-n", "-o", "FSTYPE", "/")
 
 	if err != nil || !strings.Contains(string(output), "btrfs") {
 		warningColor.Println("Root filesystem is not btrfs")
@@ -1003,14 +1044,12 @@ func (a *ArchMaintenance) createSnapshot() {
 
 	infoColor.Println("Creating btrfs snapshot...")
 
-	exec.Command("sudo", "mkdir", "-p", "/.snapshots").Run()
+	a.commands().Run(&Cmd{Name: "sudo", Args: []string{"mkdir", "-p", "/.snapshots"}})
 
-	cmd = exec.Command("sudo", "btrfs", "subvolume", "snapshot", "/", snapshotPath)
-	if err := cmd.Run(); err == nil {
+	if _, err := a.commands().Run(&Cmd{Name: "sudo", Args: []string{"btrfs", "subvolume", "snapshot", "/", snapshotPath}}); err == nil {
 		successColor.Printf("Snapshot created: %s\n", snapshotPath)
 
-		cmd = exec.Command("sudo", "btrfs", "subvolume", "list", "/")
-		if output, err := cmd.Output(); err == nil {
+		if output, err := a.query("sudo", "btrfs", "subvolume", "list", "/"); err == nil {
 			lines := strings.Split(string(output), "\n")
 			count := 0
 			fmt.Println("\nRecent snapshots:")
@@ -1023,17 +1062,23 @@ func (a *ArchMaintenance) createSnapshot() {
 		}
 	} else {
 		errorColor.Printf("Failed to create snapshot: %v\n", err)
+		a.status.failures++
 	}
 
 	a.waitForContinue()
 }
 
-func (a *ArchMaintenance) searchPackages(query string) {
+func (a *ArchMaintenance) searchPackages(query string, installedOnly bool) {
 	headerColor.Printf("\n=== SEARCH PACKAGES: %s ===\n", query)
 
-	infoColor.Println("Searching in official repositories...")
-	cmd := exec.Command("pacman", "-Ss", query)
-	output, _ := cmd.Output()
+	var output []byte
+	if installedOnly {
+		infoColor.Println("Searching installed packages...")
+		output, _ = a.query("pacman", "-Qs", query)
+	} else {
+		infoColor.Println("Searching in official repositories...")
+		output, _ = a.query("pacman", "-Ss", query)
+	}
 
 	if strings.TrimSpace(string(output)) != "" {
 		lines := strings.Split(string(output), "\n")
@@ -1060,17 +1105,15 @@ func (a *ArchMaintenance) searchPackages(query string) {
 		if len(lines) > 40 {
 			infoColor.Printf("\n... and more results (showing first 20)\n")
 		}
+	} else if installedOnly {
+		warningColor.Println("No matching installed packages.")
 	} else {
 		warningColor.Println("No packages found in official repositories.")
 	}
 
-	cmd = exec.Command("pacman", "-Qi", query)
-	if err := cmd.Run(); err == nil {
+	if output, err := a.query("pacman", "-Qi", query); err == nil {
 		fmt.Println()
 		successColor.Printf("Package '%s' is installed\n", query)
-
-		cmd = exec.Command("pacman", "-Qi", query)
-		output, _ := cmd.Output()
 		fmt.Println(string(output))
 	}
 
@@ -1085,7 +1128,7 @@ func (a *ArchMaintenance) configManager() {
 	fmt.Printf("  Safe Mode: %v\n", a.config.SafeMode)
 	fmt.Printf("  Backup Enabled: %v\n", a.config.BackupEnabled)
 	fmt.Printf("  Backup Path: %s\n", a.config.BackupPath)
-	fmt.Printf("  Cache Retention: %d days\n", a.config.CacheRetentionDays)
+	fmt.Printf("  Cache Retention: %d days, %d versions\n", a.config.CacheRetentionDays, a.config.CacheKeepVersions)
 	fmt.Printf("  Log Retention: %d days\n", a.config.LogRetentionDays)
 	fmt.Printf("  Verbose Mode: %v\n", a.config.VerboseMode)
 
@@ -1106,15 +1149,27 @@ func (a *ArchMaintenance) configManager() {
 
 	switch choice {
 	case "1":
+		if !a.touchSetting("DRY_RUN") {
+			break
+		}
 		a.config.DryRun = !a.config.DryRun
 		successColor.Printf("Dry Run Mode: %v\n", a.config.DryRun)
 	case "2":
+		if !a.touchSetting("SAFE_MODE") {
+			break
+		}
 		a.config.SafeMode = !a.config.SafeMode
 		successColor.Printf("Safe Mode: %v\n", a.config.SafeMode)
 	case "3":
+		if !a.touchSetting("BACKUP_ENABLED") {
+			break
+		}
 		a.config.BackupEnabled = !a.config.BackupEnabled
 		successColor.Printf("Backup Enabled: %v\n", a.config.BackupEnabled)
 	case "4":
+		if !a.touchSetting("CACHE_RETENTION_DAYS") {
+			break
+		}
 		fmt.Print("Enter cache retention days (default 30): ")
 		input, _ := reader.ReadString('\n')
 		if days := parseInt(strings.TrimSpace(input)); days > 0 {
@@ -1122,6 +1177,9 @@ func (a *ArchMaintenance) configManager() {
 			successColor.Printf("Cache retention set to %d days\n", days)
 		}
 	case "5":
+		if !a.touchSetting("LOG_RETENTION_DAYS") {
+			break
+		}
 		fmt.Print("Enter log retention days (default 7): ")
 		input, _ := reader.ReadString('\n')
 		if days := parseInt(strings.TrimSpace(input)); days > 0 {
@@ -1129,6 +1187,9 @@ func (a *ArchMaintenance) configManager() {
 			successColor.Printf("Log retention set to %d days\n", days)
 		}
 	case "6":
+		if !a.touchSetting("VERBOSE_MODE") {
+			break
+		}
 		a.config.VerboseMode = !a.config.VerboseMode
 		successColor.Printf("Verbose Mode: %v\n", a.config.VerboseMode)
 	case "7":
@@ -1141,34 +1202,77 @@ func (a *ArchMaintenance) configManager() {
 	a.configManager()
 }
 
+// touchSetting reports whether name may be changed interactively and, if
+// so, records the current session as its origin
+func (a *ArchMaintenance) touchSetting(name string) bool {
+	if a.layers.locked(name) {
+		errorColor.Printf("%s is locked by %s\n", name, a.layers.origin(name).Source)
+		return false
+	}
+	a.layers.origins[name] = configOrigin{Layer: layerSession}
+	return true
+}
+
+func (a *ArchMaintenance) showConfig(withOrigin bool) {
+	headerColor.Println("\n=== CONFIGURATION ===")
+
+	header := []string{"Key", "Value"}
+	if withOrigin {
+		header = append(header, "Origin")
+	}
+	table := plainTable(header...)
+
+	for _, key := range configKeys {
+		row := []string{key.name, key.format(a.config)}
+		if withOrigin {
+			row = append(row, a.layers.origin(key.name).String())
+		}
+		table.Append(row)
+	}
+
+	var customKeys []string
+	for name := range a.layers.origins {
+		if strings.HasPrefix(name, customPrefix) {
+			customKeys = append(customKeys, name)
+		}
+	}
+	sort.Strings(customKeys)
+	for _, name := range customKeys {
+		row := []string{name, customCommandKey(name).format(a.config)}
+		if withOrigin {
+			row = append(row, a.layers.origin(name).String())
+		}
+		table.Append(row)
+	}
+	table.Render()
+
+	if withOrigin {
+		fmt.Println()
+		infoColor.Println("Precedence (lowest first): default, system, conf.d, user, env, flag")
+	}
+}
+
 func (a *ArchMaintenance) exportConfig() {
-	homeDir, _ := os.UserHomeDir()
-	configDir := filepath.Join(homeDir, ".config/archmaint")
-	os.MkdirAll(configDir, 0755)
-
-	configFile := filepath.Join(configDir, "config.conf")
-	content := fmt.Sprintf(`# ArchMaint Configuration
-# Generated: %s
-
-DRY_RUN=%v
-SAFE_MODE=%v
-BACKUP_ENABLED=%v
-BACKUP_PATH=%s
-CACHE_RETENTION_DAYS=%d
-LOG_RETENTION_DAYS=%d
-VERBOSE_MODE=%v
-`,
-		time.Now().Format("2006-01-02 15:04:05"),
-		a.config.DryRun,
-		a.config.SafeMode,
-		a.config.BackupEnabled,
-		a.config.BackupPath,
-		a.config.CacheRetentionDays,
-		a.config.LogRetentionDays,
-		a.config.VerboseMode,
-	)
+	configFile := a.layers.userPath
+	if configFile == "" {
+		var err error
+		if configFile, err = userConfigPath(); err != nil {
+			errorColor.Printf("Failed to export configuration: %v\n", err)
+			return
+		}
+	}
+	os.MkdirAll(filepath.Dir(configFile), 0755)
 
-	if err := os.WriteFile(configFile, []byte(content), 0644); err == nil {
+	// Rewrite an existing file in place so hand edits and comments survive
+	cf, err := readConfigFile(configFile)
+	if os.IsNotExist(err) {
+		cf = newConfigFile(configFile)
+	} else if err != nil {
+		errorColor.Printf("Failed to read configuration: %v\n", err)
+		return
+	}
+
+	if err := writeFileAtomic(configFile, []byte(cf.render(a.config, a.layers.origins)), 0644); err == nil {
 		successColor.Printf("Configuration exported to: %s\n", configFile)
 	} else {
 		errorColor.Printf("Failed to export configuration: %v\n", err)
@@ -1180,41 +1284,32 @@ VERBOSE_MODE=%v
 func (a *ArchMaintenance) showHelp() {
 	a.showBanner()
 	fmt.Println("USAGE:")
-	fmt.Println("  archmaint [OPTIONS] [COMMAND]")
+	fmt.Println("  archmaint [OPTIONS] [COMMAND] [ARGS] [COMMAND OPTIONS]")
 	fmt.Println()
 	fmt.Println("OPTIONS:")
-	fmt.Println("  --dry-run          Show what would be done without making changes")
-	fmt.Println("  --safe             Enable safe mode with extra confirmations")
+	for _, flag := range globalFlags {
+		fmt.Printf("  %-20s %s\n", flag, flag.usage)
+	}
 	fmt.Println()
 	fmt.Println("COMMANDS:")
 
-	commands := [][]string{
-		{"status, s", "Show system status and information"},
-		{"update, u", "Update system packages (with backup)"},
-		{"clean, c", "Clean system (cache, logs, temp files)"},
-		{"orphans, o", "Remove orphaned packages"},
-		{"services, sv", "Show system services status"},
-		{"logs, l", "Show recent system logs"},
-		{"health, h", "Run comprehensive health check"},
-		{"maintenance, m", "Run full maintenance routine"},
-		{"search, se", "Search for packages"},
-		{"backup, b", "Create system backup"},
-		{"restore, r", "Restore from backup"},
-		{"snapshot, sn", "Create btrfs snapshot"},
-		{"config, cfg", "Manage configuration"},
-		{"help, --help, -h", "Show this help message"},
-		{"version, --version, -v", "Show version information"},
-	}
-
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetBorder(false)
 	table.SetCenterSeparator("")
 	table.SetColumnSeparator("   ")
 	table.SetRowSeparator("")
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
 
 	for _, cmd := range commands {
-		table.Append(cmd)
+		name := strings.Join(append([]string{cmd.name}, cmd.aliases...), ", ")
+		if cmd.args != "" {
+			name += " " + cmd.args
+		}
+		table.Append([]string{name, cmd.summary})
+		for _, flag := range cmd.flags {
+			table.Append([]string{"    " + flag.String(), flag.usage})
+		}
 	}
 	table.Render()
 
@@ -1222,10 +1317,26 @@ func (a *ArchMaintenance) showHelp() {
 	fmt.Println("  archmaint status              # Show system status")
 	fmt.Println("  archmaint --dry-run update    # Preview system updates")
 	fmt.Println("  archmaint --safe clean        # Clean with extra safety")
+	fmt.Println("  archmaint clean --verbose -y  # Clean without prompts, showing output")
 	fmt.Println("  archmaint search firefox      # Search for firefox package")
 	fmt.Println("  archmaint backup              # Create system backup")
 	fmt.Println("  archmaint                     # Interactive mode")
 
+	if names := a.config.customCommandNames(); len(names) > 0 {
+		fmt.Println("\nCUSTOM COMMANDS:")
+		for _, name := range names {
+			cmd := a.config.CustomCommands[name]
+			desc := cmd.Description
+			if desc == "" {
+				desc = joinCommandLine(cmd.Command)
+			}
+			if cmd.Dangerous {
+				desc += " (dangerous)"
+			}
+			fmt.Printf("  archmaint run %-16s# %s\n", name, desc)
+		}
+	}
+
 	fmt.Println("\nFEATURES (v1.1):")
 	fmt.Println("  - Dry-run mode to preview changes")
 	fmt.Println("  - Safe mode with extra confirmations")
@@ -1258,55 +1369,67 @@ func (a *ArchMaintenance) showVersion() {
 	fmt.Println("https://github.com/yourusername/archmaint")
 }
 
-func (a *ArchMaintenance) runCommand(name string, args ...string) {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Run(); err != nil {
-		if !a.config.DryRun {
-			errorColor.Printf("Error running command: %v\n", err)
-		}
+// commands returns the runner for this invocation, wrapped in the dry-run
+// recorder whenever DryRun is on
+func (a *ArchMaintenance) commands() CommandRunner {
+	if a.config.DryRun {
+		return a.dryRun
 	}
+	return a.runner
 }
 
-func (a *ArchMaintenance) runCommandWithProgress(name string, args ...string) {
-	if a.config.VerboseMode {
-		infoColor.Printf("Running: %s %s\n", name, strings.Join(args, " "))
+// query runs a read-only command and returns its stdout
+func (a *ArchMaintenance) query(name string, args ...string) ([]byte, error) {
+	result, err := a.commands().Run(&Cmd{Name: name, Args: args, ReadOnly: true})
+	if result == nil {
+		return nil, err
 	}
+	return result.Stdout, err
+}
 
-	cmd := exec.Command(name, args...)
+// viewCommand runs a read-only command attached to the terminal
+func (a *ArchMaintenance) viewCommand(name string, args ...string) {
+	a.commands().Run(&Cmd{
+		Name:     name,
+		Args:     args,
+		ReadOnly: true,
+		Stdin:    a.stdin(),
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+	})
+}
 
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	cmd.Stdin = os.Stdin
+func (a *ArchMaintenance) runCommand(name string, args ...string) {
+	_, err := a.commands().Run(&Cmd{
+		Name:   name,
+		Args:   args,
+		Stdin:  a.stdin(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		errorColor.Printf("Error running command: %v\n", err)
+		a.status.failures++
+	}
+}
 
-	if err := cmd.Start(); err != nil {
-		errorColor.Printf("Error starting command: %v\n", err)
-		return
+func (a *ArchMaintenance) runCommandWithProgress(name string, args ...string) {
+	if a.config.VerboseMode {
+		infoColor.Printf("Running: %s %s\n", name, strings.Join(args, " "))
 	}
 
-	done := make(chan bool)
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			if a.config.VerboseMode {
-				fmt.Println(scanner.Text())
-			}
+	stdout := &lineWriter{fn: func(line string) {
+		if a.config.VerboseMode {
+			fmt.Println(line)
 		}
-		done <- true
-	}()
-
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			if a.config.VerboseMode {
-				errorColor.Println(scanner.Text())
-			}
+	}}
+	stderr := &lineWriter{fn: func(line string) {
+		if a.config.VerboseMode {
+			errorColor.Println(line)
 		}
-	}()
+	}}
 
+	done := make(chan bool)
 	if !a.config.VerboseMode {
 		go func() {
 			for {
@@ -1320,15 +1443,50 @@ func (a *ArchMaintenance) runCommandWithProgress(name string, args ...string) {
 		}()
 	}
 
-	<-done
-	if err := cmd.Wait(); err != nil {
+	_, err := a.commands().Run(&Cmd{
+		Name:   name,
+		Args:   args,
+		Stdin:  a.stdin(),
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	close(done)
+	stdout.Flush()
+	stderr.Flush()
+
+	if err != nil {
 		errorColor.Printf("\nCommand failed: %v\n", err)
+		a.status.failures++
 	} else if !a.config.VerboseMode {
 		fmt.Println()
 	}
 }
 
+// stdin is the input handed to child processes; nil (/dev/null) when
+// running non-interactively so nothing can block on a prompt
+func (a *ArchMaintenance) stdin() io.Reader {
+	if a.config.NonInteractive {
+		return nil
+	}
+	return os.Stdin
+}
+
 func (a *ArchMaintenance) confirmAction(message string, dangerous bool) bool {
+	if a.config.NonInteractive {
+		switch {
+		case !dangerous:
+			fmt.Printf("? %s [auto: yes]\n", message)
+			return true
+		case a.config.AllowDangerous:
+			dangerColor.Printf("WARNING %s [auto: yes, dangerous operations allowed]\n", message)
+			return true
+		default:
+			warningColor.Printf("WARNING %s [auto: no, requires --allow-dangerous]\n", message)
+			a.status.aborted = true
+			return false
+		}
+	}
+
 	if a.config.AutoConfirm && !dangerous {
 		return true
 	}
@@ -1354,11 +1512,25 @@ func (a *ArchMaintenance) confirmAction(message string, dangerous bool) bool {
 	return response == "y" || response == "yes"
 }
 
+// proceed asks for confirmation of the main action of an operation and
+// records an abort when it is declined
+func (a *ArchMaintenance) proceed(message string, dangerous bool) bool {
+	if a.confirmAction(message, dangerous) {
+		return true
+	}
+	a.status.aborted = true
+	return false
+}
+
 func (a *ArchMaintenance) waitForContinue() {
+	if a.config.NonInteractive {
+		return
+	}
+
 	fmt.Print("\nPress Enter to continue...")
 	bufio.NewReader(os.Stdin).ReadBytes('\n')
 
-	if len(os.Args) == 1 || (len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "--")) {
+	if a.menuMode {
 		a.showMainMenu()
 	}
 }
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fileAtime returns the last access time of info
+func fileAtime(info fs.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Sec, st.Atimespec.Nsec)
+	}
+	return info.ModTime()
+}
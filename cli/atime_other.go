@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// fileAtime falls back to the modification time where the platform does
+// not expose the access time
+func fileAtime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
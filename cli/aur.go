@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"archmaint/internal/vercmp"
+)
+
+// defaultAURURL is the info endpoint of the AUR RPC interface
+const defaultAURURL = "https://aur.archlinux.org/rpc/v5/info"
+
+// aurHelpers are the supported AUR helpers in order of preference
+var aurHelpers = []string{"paru", "yay"}
+
+// aurBatch bounds the packages asked for in one RPC request
+const aurBatch = 100
+
+// AURPackage is the part of an AUR RPC info result archmaint uses
+type AURPackage struct {
+	Name    string `json:"Name"`
+	Version string `json:"Version"`
+}
+
+// aurHelper returns the AUR helper to use, or "" when there is none
+func (a *ArchMaintenance) aurHelper() string {
+	switch a.config.AURHelper {
+	case "none":
+		return ""
+	case "auto", "":
+		for _, helper := range aurHelpers {
+			if _, err := a.commands().LookPath(helper); err == nil {
+				return helper
+			}
+		}
+		return ""
+	}
+	if _, err := a.commands().LookPath(a.config.AURHelper); err != nil {
+		return ""
+	}
+	return a.config.AURHelper
+}
+
+// foreignPackages maps the installed packages no sync repository has, as
+// pacman -Qm lists them, to their versions
+func (a *ArchMaintenance) foreignPackages() (map[string]string, error) {
+	db := a.packageDB()
+	if local, err := db.Local(); err == nil {
+		if sync, err := db.AllSync(); err == nil && len(sync) > 0 {
+			inSync := make(map[string]bool, len(sync))
+			for _, pkg := range sync {
+				inSync[pkg.Name] = true
+			}
+			foreign := make(map[string]string)
+			for _, pkg := range local {
+				if !inSync[pkg.Name] {
+					foreign[pkg.Name] = pkg.Version
+				}
+			}
+			return foreign, nil
+		}
+	}
+
+	lines, err := a.queryList("pacman", "-Qm")
+	if err != nil {
+		return nil, err
+	}
+	foreign := make(map[string]string)
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			foreign[fields[0]] = fields[1]
+		}
+	}
+	return foreign, nil
+}
+
+// aurInfo looks packages up in the AUR. Packages the AUR does not know are
+// missing from the result. A file:// URL or path serves one fixed response.
+func (a *ArchMaintenance) aurInfo(names []string) (map[string]AURPackage, error) {
+	found := make(map[string]AURPackage)
+	remote := strings.HasPrefix(a.config.AURURL, "http://") || strings.HasPrefix(a.config.AURURL, "https://")
+
+	for start := 0; start < len(names); start += aurBatch {
+		end := start + aurBatch
+		if end > len(names) {
+			end = len(names)
+		}
+
+		endpoint := a.config.AURURL
+		if remote {
+			query := url.Values{"arg[]": names[start:end]}
+			endpoint += "?" + query.Encode()
+		}
+		data, err := a.fetchURL(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var response struct {
+			Type    string       `json:"type"`
+			Error   string       `json:"error"`
+			Results []AURPackage `json:"results"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, fmt.Errorf("%s: %v", a.config.AURURL, err)
+		}
+		if response.Type == "error" {
+			return nil, fmt.Errorf("%s: %s", a.config.AURURL, response.Error)
+		}
+		for _, pkg := range response.Results {
+			if contains(names[start:end], pkg.Name) {
+				found[pkg.Name] = pkg
+			}
+		}
+	}
+	return found, nil
+}
+
+// aurUpdates lists the foreign packages with a newer version in the AUR.
+// unknown holds the foreign packages the AUR does not have, such as local
+// builds.
+func (a *ArchMaintenance) aurUpdates() (updates []PendingUpdate, unknown []string, err error) {
+	updates = []PendingUpdate{}
+	if a.config.AURURL == "" {
+		return updates, nil, nil
+	}
+
+	foreign, err := a.foreignPackages()
+	if err != nil || len(foreign) == 0 {
+		return updates, nil, err
+	}
+	names := make([]string, 0, len(foreign))
+	for name := range foreign {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	info, err := a.aurInfo(names)
+	if err != nil {
+		return updates, nil, err
+	}
+	for _, name := range names {
+		pkg, ok := info[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if vercmp.Compare(pkg.Version, foreign[name]) > 0 {
+			updates = append(updates, PendingUpdate{
+				Name:          name,
+				OldVersion:    foreign[name],
+				NewVersion:    pkg.Version,
+				Repo:          "aur",
+				DownloadSize:  -1,
+				InstalledSize: -1,
+				Bump:          classifyBump(foreign[name], pkg.Version),
+			})
+		}
+	}
+	return updates, unknown, nil
+}
+
+// helperConfirmArgs keeps the AUR helper from prompting again once archmaint
+// has confirmed, whether by policy or by --yes
+func (a *ArchMaintenance) helperConfirmArgs() []string {
+	if a.config.NonInteractive || a.config.AutoConfirm {
+		return []string{"--noconfirm"}
+	}
+	return nil
+}
+
+// printManualAUR lists foreign packages that need to be handled by hand
+func printManualAUR(names []string) {
+	for _, name := range names {
+		fmt.Printf("  • %s  https://aur.archlinux.org/packages/%s\n", name, name)
+	}
+}
+
+// updateAUR upgrades the foreign packages with the AUR helper, or lists them
+// as manual steps without one. Helpers build as the calling user and ask
+// for sudo themselves.
+func (a *ArchMaintenance) updateAUR(updates []PendingUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+
+	helper := a.aurHelper()
+	if helper == "" {
+		warningColor.Println("\nNo AUR helper found (paru or yay); update these AUR packages manually:")
+		names := make([]string, len(updates))
+		for i, update := range updates {
+			names[i] = update.Name
+		}
+		printManualAUR(names)
+		return
+	}
+
+	if !a.proceed(fmt.Sprintf("Update %d AUR packages with %s?", len(updates), helper), false) {
+		return
+	}
+	args := append([]string{"-Sua"}, a.helperConfirmArgs()...)
+	a.runCommand(helper, args...)
+}
+
+// splitForeign divides a package list into the packages the sync databases
+// have and the foreign ones. Names in foreignList, the packages_foreign.txt
+// of a backup, count as foreign too, which is all there is to go by when
+// the sync databases cannot be read.
+func (a *ArchMaintenance) splitForeign(packages, foreignList []string) (repo, foreign []string) {
+	inSync := make(map[string]bool)
+	if sync, err := a.packageDB().AllSync(); err == nil && len(sync) > 0 {
+		for _, pkg := range sync {
+			inSync[pkg.Name] = true
+		}
+	}
+
+	for _, name := range packages {
+		if contains(foreignList, name) || (len(inSync) > 0 && !inSync[name]) {
+			foreign = append(foreign, name)
+		} else {
+			repo = append(repo, name)
+		}
+	}
+	return repo, foreign
+}
+
+// restoreForeign installs foreign packages from a backup with the AUR
+// helper. Packages the AUR does not have, and all of them without a helper,
+// are reported as manual steps.
+func (a *ArchMaintenance) restoreForeign(foreign []string) {
+	if len(foreign) == 0 {
+		return
+	}
+
+	var notInAUR []string
+	if a.config.AURURL != "" {
+		if info, err := a.aurInfo(foreign); err == nil {
+			var inAUR []string
+			for _, name := range foreign {
+				if _, ok := info[name]; ok {
+					inAUR = append(inAUR, name)
+				} else {
+					notInAUR = append(notInAUR, name)
+				}
+			}
+			foreign = inAUR
+		} else {
+			warningColor.Printf("Could not query the AUR: %v\n", err)
+		}
+	}
+
+	if helper := a.aurHelper(); helper == "" && len(foreign) > 0 {
+		warningColor.Println("\nNo AUR helper found (paru or yay); install these AUR packages manually:")
+		printManualAUR(foreign)
+	} else if len(foreign) > 0 {
+		infoColor.Printf("Restoring %d AUR packages with %s...\n", len(foreign), helper)
+		args := append([]string{"-S", "--needed"}, a.helperConfirmArgs()...)
+		a.runCommand(helper, append(args, foreign...)...)
+	}
+
+	if len(notInAUR) > 0 {
+		warningColor.Printf("\n%d foreign packages are not in the AUR and need to be installed manually:\n", len(notInAUR))
+		for _, name := range notInAUR {
+			fmt.Printf("  • %s\n", name)
+		}
+	}
+}
+
+// readPackageList reads a package list file of a backup, one name per line
+func readPackageList(dir, file string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// aurServer answers AUR RPC info requests for every package whose name does
+// not start with "local-", and counts the requests and names asked for
+func aurServer(t *testing.T) (url string, batches *[]int) {
+	t.Helper()
+	batches = new([]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["arg[]"]
+		*batches = append(*batches, len(names))
+		results := []AURPackage{}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "local-") {
+				results = append(results, AURPackage{Name: name, Version: "1.0-1"})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"type": "multiinfo", "results": results})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, batches
+}
+
+func TestAURInfoBatches(t *testing.T) {
+	a := newTestApp(t, NewFakeRunner())
+	url, batches := aurServer(t)
+	a.config.AURURL = url
+
+	names := make([]string, 2*aurBatch+50)
+	for i := range names {
+		names[i] = fmt.Sprintf("pkg%03d", i)
+	}
+	names[7] = "local-build"
+
+	info, err := a.aurInfo(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{aurBatch, aurBatch, 50}; !reflect.DeepEqual(*batches, want) {
+		t.Errorf("requested %v names per batch, want %v", *batches, want)
+	}
+	if len(info) != len(names)-1 {
+		t.Errorf("found %d packages, want %d", len(info), len(names)-1)
+	}
+	if _, ok := info["local-build"]; ok {
+		t.Error("a package the AUR does not have was found")
+	}
+}
+
+func TestAURInfoError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"type":"error","error":"Too many package results.","results":[]}`)
+	}))
+	defer server.Close()
+	a := newTestApp(t, NewFakeRunner())
+	a.config.AURURL = server.URL
+
+	_, err := a.aurInfo([]string{"paru"})
+	if err == nil || !strings.Contains(err.Error(), "Too many package results.") {
+		t.Errorf("aurInfo() error = %v, want the RPC error", err)
+	}
+}
+
+func TestRestoreForeign(t *testing.T) {
+	tests := []struct {
+		name           string
+		helper         string
+		nonInteractive bool
+		autoConfirm    bool
+		dryRun         bool
+		want           []string
+	}{
+		{name: "no helper"},
+		{name: "non-interactive", helper: "paru", nonInteractive: true, want: []string{"paru -S --needed --noconfirm paru yay-bin"}},
+		{name: "yes", helper: "paru", autoConfirm: true, want: []string{"paru -S --needed --noconfirm paru yay-bin"}},
+		{name: "interactive", helper: "yay", want: []string{"yay -S --needed paru yay-bin"}},
+		{name: "dry run", helper: "paru", nonInteractive: true, dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFakeRunner()
+			a := newTestApp(t, fake)
+			a.dryRun.Next = fake
+			a.config.AURURL, _ = aurServer(t)
+			a.config.AURHelper = "auto"
+			a.config.NonInteractive = tt.nonInteractive
+			a.config.AutoConfirm = tt.autoConfirm
+			a.config.DryRun = tt.dryRun
+			if tt.helper != "" {
+				fake.OnLookPath(tt.helper, "/usr/bin/"+tt.helper)
+			}
+			for _, line := range tt.want {
+				fake.On(line, FakeResponse{})
+			}
+
+			output := captureOutput(t, func() {
+				a.restoreForeign([]string{"paru", "local-build", "yay-bin"})
+			})
+
+			assertCommands(t, fake, tt.want...)
+			if !strings.Contains(output, "local-build") {
+				t.Errorf("the package missing from the AUR is not reported:\n%s", output)
+			}
+			if tt.helper == "" && !strings.Contains(output, "https://aur.archlinux.org/packages/yay-bin") {
+				t.Errorf("no manual steps without a helper:\n%s", output)
+			}
+			if tt.dryRun {
+				if len(a.dryRun.Recorded) != 1 || a.dryRun.Recorded[0].String() != "paru -S --needed --noconfirm paru yay-bin" {
+					t.Errorf("dry run recorded %v", a.dryRun.Recorded)
+				}
+			}
+			if code := a.status.exitCode(); code != exitOK {
+				t.Errorf("exit code = %d, want %d", code, exitOK)
+			}
+		})
+	}
+}
+
+func TestSplitForeign(t *testing.T) {
+	packages := []string{"bash", "local-build", "paru", "vim"}
+	tests := []struct {
+		name        string
+		sync        bool
+		foreignList []string
+		repo        []string
+		foreign     []string
+	}{
+		{"sync databases", true, nil, []string{"bash", "vim"}, []string{"local-build", "paru"}},
+		{"sync databases and foreign list", true, []string{"vim"}, []string{"bash"}, []string{"local-build", "paru", "vim"}},
+		{"foreign list only", false, []string{"paru"}, []string{"bash", "local-build", "vim"}, []string{"paru"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, NewFakeRunner())
+			if tt.sync {
+				syncFixture(t, a)
+			}
+			repo, foreign := a.splitForeign(packages, tt.foreignList)
+			if !reflect.DeepEqual(repo, tt.repo) || !reflect.DeepEqual(foreign, tt.foreign) {
+				t.Errorf("splitForeign() = %v, %v, want %v, %v", repo, foreign, tt.repo, tt.foreign)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of the check command, following the Nagios plugin API
+const (
+	pluginOK       = 0
+	pluginWarning  = 1
+	pluginCritical = 2
+	pluginUnknown  = 3
+)
+
+var pluginStates = map[int]string{
+	pluginOK:       "OK",
+	pluginWarning:  "WARNING",
+	pluginCritical: "CRITICAL",
+	pluginUnknown:  "UNKNOWN",
+}
+
+// pluginState maps a health status onto a plugin exit code
+func pluginState(status HealthStatus) int {
+	switch status {
+	case HealthOK:
+		return pluginOK
+	case HealthWarn:
+		return pluginWarning
+	case HealthCritical:
+		return pluginCritical
+	}
+	return pluginUnknown
+}
+
+// pluginSeverity orders plugin states for aggregation: critical beats
+// warning beats unknown beats ok
+func pluginSeverity(state int) int {
+	switch state {
+	case pluginCritical:
+		return 3
+	case pluginWarning:
+		return 2
+	case pluginUnknown:
+		return 1
+	}
+	return 0
+}
+
+// checkNames lists the names accepted by archmaint check
+func checkNames() []string {
+	names := make([]string, 0, len(healthRegistry)+1)
+	for _, check := range healthRegistry {
+		names = append(names, metricName(check.Name()))
+	}
+	return append(names, "all")
+}
+
+func lookupHealthCheck(name string) HealthCheck {
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "_")
+	for _, check := range healthRegistry {
+		if metricName(check.Name()) == name {
+			return check
+		}
+	}
+	return nil
+}
+
+// perfdata renders a metric as label=value[UOM];warn;crit[;min;max]
+func perfdata(m *HealthMetric) string {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	if m.Unit == "%" {
+		return fmt.Sprintf("%s=%s%%;%s;%s;0;100", m.Label, format(m.Value), format(m.Warn), format(m.Critical))
+	}
+	return fmt.Sprintf("%s=%s;%s;%s;0", m.Label, format(m.Value), format(m.Warn), format(m.Critical))
+}
+
+// parseThreshold reads a --warning or --critical value such as 85 or 85%
+func parseThreshold(inv *invocation, flag string) (float64, bool, error) {
+	value := inv.value(flag)
+	if value == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || n < 0 {
+		return 0, false, usagef("--%s expects a number, got %q", flag, value)
+	}
+	return n, true, nil
+}
+
+// pluginUsage reports a usage error of the check command. Monitoring
+// reads exit code 2 as CRITICAL, so plugins report bad arguments as
+// UNKNOWN instead.
+func pluginUsage(inv *invocation, err error) {
+	fmt.Printf("ARCHMAINT %s - %v\n", pluginStates[pluginUnknown], err)
+	printUsageError(err)
+	inv.exitCode = pluginUnknown
+}
+
+// runPluginCheck runs "check <name|all>" and prints one plugin status line.
+// It never prompts and records nothing in the health history.
+func (a *ArchMaintenance) runPluginCheck(inv *invocation) {
+	name := inv.args[0]
+	warn, hasWarn, err := parseThreshold(inv, "warning")
+	if err != nil {
+		pluginUsage(inv, err)
+		return
+	}
+	critical, hasCritical, err := parseThreshold(inv, "critical")
+	if err != nil {
+		pluginUsage(inv, err)
+		return
+	}
+
+	var checks []HealthCheck
+	if name == "all" {
+		if hasWarn || hasCritical {
+			pluginUsage(inv, usagef("--warning and --critical apply to a single check, not all"))
+			return
+		}
+		checks = healthRegistry
+	} else if check := lookupHealthCheck(name); check != nil {
+		checks = []HealthCheck{check}
+	} else {
+		pluginUsage(inv, usagef("unknown check %q (want %s)", name, strings.Join(checkNames(), ", ")))
+		return
+	}
+
+	var results []HealthCheckResult
+	for _, check := range checks {
+		result := a.runHealthCheck(check)
+		if (hasWarn || hasCritical) && result.Status != HealthUnknown {
+			if result.Metric == nil {
+				pluginUsage(inv, usagef("check %s has no thresholds to override", name))
+				return
+			}
+			m := result.Metric
+			if hasWarn {
+				m.Warn = warn
+			}
+			if hasCritical {
+				m.Critical = critical
+			}
+			gradeMetric(&result, m.Label, m.Value, m.Warn, m.Critical, m.Unit)
+		}
+		results = append(results, result)
+	}
+
+	state := pluginOK
+	var problems, perf []string
+	for _, result := range results {
+		s := pluginState(result.Status)
+		if pluginSeverity(s) > pluginSeverity(state) {
+			state = s
+		}
+		if s != pluginOK {
+			detail := result.Value
+			if result.Status == HealthUnknown && result.Message != "" {
+				detail = result.Message
+			}
+			problems = append(problems, fmt.Sprintf("%s %s (%s)", result.Name, pluginStates[s], detail))
+		}
+		if result.Metric != nil && result.Status != HealthUnknown {
+			perf = append(perf, perfdata(result.Metric))
+		}
+	}
+
+	service := "ARCHMAINT"
+	var text string
+	if len(results) == 1 {
+		service += " " + strings.ToUpper(metricName(results[0].Name))
+		text = results[0].Value
+		if results[0].Status == HealthUnknown && results[0].Message != "" {
+			text = results[0].Message
+		}
+	} else if len(problems) == 0 {
+		text = fmt.Sprintf("%d checks ok, score %d%%", len(results), newHealthReport(results).Score)
+	} else {
+		text = strings.Join(problems, ", ")
+	}
+
+	// A pipe in the text would be taken as the start of the perfdata
+	text = strings.ReplaceAll(text, "|", "/")
+	line := fmt.Sprintf("%s %s - %s", service, pluginStates[state], text)
+	if len(perf) > 0 {
+		line += " | " + strings.Join(perf, " ")
+	}
+	fmt.Println(line)
+	inv.exitCode = state
+}
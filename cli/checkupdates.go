@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"archmaint/internal/pacmandb"
+)
+
+// syncDBDir is the per-user directory of the private sync database copy
+func syncDBDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("archmaint-db-%d", os.Getuid()))
+}
+
+// tempSyncDB refreshes a private copy of the sync databases, the way
+// checkupdates does, so pending updates can be listed without pacman -Sy.
+// Refreshing the real databases without upgrading right away is what
+// leaves a system in a partial upgrade. The copy lives in a fixed per-user
+// directory and is reused by the next run; within one run it is refreshed
+// only once. Without fakeroot a regular user cannot refresh it, and ""
+// is returned to fall back to the system databases.
+func (a *ArchMaintenance) tempSyncDB() (string, error) {
+	if a.syncDBReady {
+		return a.syncDBPath, nil
+	}
+
+	system := a.packageDB().Path()
+	dir := syncDBDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "sync"), 0700); err != nil {
+		return "", err
+	}
+	// The directory sits in a shared location, so make sure it is ours
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() || !ownedByCurrentUser(info) {
+		return "", fmt.Errorf("%s is not a directory owned by the current user", dir)
+	}
+
+	local := filepath.Join(dir, "local")
+	if target, err := os.Readlink(local); err != nil || target != filepath.Join(system, "local") {
+		os.Remove(local)
+		if err := os.Symlink(filepath.Join(system, "local"), local); err != nil {
+			return "", err
+		}
+	}
+
+	// Start from the system databases when they are newer than the copy,
+	// so unchanged repositories are not downloaded again
+	current, _ := filepath.Glob(filepath.Join(system, "sync", "*.db"))
+	for _, db := range current {
+		cached := filepath.Join(dir, "sync", filepath.Base(db))
+		src, err := os.Stat(db)
+		if err != nil {
+			continue
+		}
+		if dst, err := os.Stat(cached); err != nil || dst.ModTime().Before(src.ModTime()) {
+			copyFile(db, cached)
+		}
+	}
+
+	// pacman only syncs as root; fakeroot satisfies it for a private copy
+	name, args := "pacman", []string{"-Sy", "--dbpath", dir, "--logfile", "/dev/null"}
+	if a.euid != 0 {
+		if _, err := a.commands().LookPath("fakeroot"); err != nil {
+			warningColor.Println("fakeroot is not installed (pacman -S fakeroot); checking for updates against the system package databases, which may be out of date")
+			a.syncDBReady = true
+			return "", nil
+		}
+		name, args = "fakeroot", append([]string{"--", "pacman"}, args...)
+	}
+	if _, err := a.commands().Run(&Cmd{Name: name, Args: args, ReadOnly: true, Stderr: io.Discard}); err != nil {
+		return "", fmt.Errorf("refreshing a copy of the sync databases: %v", err)
+	}
+	a.syncDBPath, a.syncDBReady = dir, true
+	return dir, nil
+}
+
+// pendingUpdateCount counts pending updates against the private copy of the
+// sync databases, or -1 when they could not be listed
+func (a *ArchMaintenance) pendingUpdateCount() int {
+	dbPath, err := a.tempSyncDB()
+	if err != nil {
+		return -1
+	}
+	updates, err := a.pendingUpdates(dbPath)
+	if err != nil {
+		return -1
+	}
+	return len(updates)
+}
+
+// outdatedPackages lists installed packages that the current sync
+// databases already have newer versions of. Packages held back by
+// IgnorePkg or IgnoreGroup are left out, since -Syu would not upgrade them
+// either.
+func (a *ArchMaintenance) outdatedPackages() ([]string, error) {
+	db := a.packageDB()
+	if local, err := db.Local(); err == nil {
+		if sync, err := db.AllSync(); err == nil && len(sync) > 0 {
+			conf, _ := db.Conf()
+			var names []string
+			for _, update := range pacmandb.Upgrades(local, sync) {
+				if !conf.Ignores(update.Sync) {
+					names = append(names, update.Local.Name)
+				}
+			}
+			return names, nil
+		}
+	}
+
+	updates, err := a.pendingUpdates("")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, update := range updates {
+		if !update.Ignored {
+			names = append(names, update.Name)
+		}
+	}
+	return names, nil
+}
+
+// refusePartialUpgrade reports whether installing from the sync databases
+// now would mix their newer packages into an older system. Installs must
+// check it first.
+func (a *ArchMaintenance) refusePartialUpgrade() bool {
+	outdated, err := a.outdatedPackages()
+	if err != nil {
+		warningColor.Printf("Could not compare the package databases with the system: %v\n", err)
+		return false
+	}
+	if len(outdated) == 0 {
+		return false
+	}
+
+	errorColor.Printf("The package databases are newer than the installed system (%d packages out of date).\n", len(outdated))
+	errorColor.Println("Installing now would be a partial upgrade; run 'archmaint update' first.")
+	a.status.failures++
+	return true
+}
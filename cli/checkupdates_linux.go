@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// ownedByCurrentUser reports whether info belongs to the calling user
+func ownedByCurrentUser(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || int(st.Uid) == os.Getuid()
+}
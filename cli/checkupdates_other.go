@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "io/fs"
+
+// ownedByCurrentUser cannot check ownership off Linux and accepts every
+// file
+func ownedByCurrentUser(info fs.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// syncFixture points a at testdata/root with the sync trees in
+// testdata/sync packed into a database directory of their own, gzip
+// compressed like the real ones
+func syncFixture(t *testing.T, a *ArchMaintenance) {
+	t.Helper()
+	root, err := filepath.Abs(filepath.Join("testdata", "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := t.TempDir()
+	if err := os.Symlink(filepath.Join(root, "var/lib/pacman/local"), filepath.Join(dbPath, "local")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dbPath, "sync"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"core", "extra"} {
+		packSyncDB(t, filepath.Join("testdata", "sync", repo), filepath.Join(dbPath, "sync", repo+".db"))
+	}
+	a.config.PacmanRoot = root
+	a.config.PacmanDBPath = dbPath
+}
+
+func packSyncDB(t *testing.T, src, dst string) {
+	t.Helper()
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == src {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if d.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: rel + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: rel, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutdatedPackages(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	syncFixture(t, a)
+
+	outdated, err := a.outdatedPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// python is in IgnorePkg and libfoo in the IgnoreGroup foo-libs
+	if want := []string{"glibc", "vim"}; !reflect.DeepEqual(outdated, want) {
+		t.Errorf("outdatedPackages() = %v, want %v", outdated, want)
+	}
+	if commands := fake.Commands(); len(commands) > 0 {
+		t.Errorf("ran %q, want the databases read directly", commands)
+	}
+}
+
+func TestOutdatedPackagesFallback(t *testing.T) {
+	fake := NewFakeRunner().On("pacman -Qu", FakeResponse{
+		Stdout: "python 3.12.3-1 -> 3.12.4-1 [ignored]\nvim 9.1.0-1 -> 9.1.0-2\n",
+	})
+	a := newTestApp(t, fake)
+
+	outdated, err := a.outdatedPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"vim"}; !reflect.DeepEqual(outdated, want) {
+		t.Errorf("outdatedPackages() = %v, want %v", outdated, want)
+	}
+}
+
+func TestRefusePartialUpgradeIgnored(t *testing.T) {
+	// Once an ignored package has a newer version, -Syu cannot clear it,
+	// so it must not block installs
+	fake := NewFakeRunner().On("pacman -Qu", FakeResponse{
+		Stdout: "python 3.12.3-1 -> 3.12.4-1 [ignored]\n",
+	})
+	a := newTestApp(t, fake)
+
+	if a.refusePartialUpgrade() {
+		t.Error("refused because of an ignored package")
+	}
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestRefusePartialUpgrade(t *testing.T) {
+	a := newTestApp(t, NewFakeRunner())
+	syncFixture(t, a)
+
+	if !a.refusePartialUpgrade() {
+		t.Error("installing over outdated glibc and vim was allowed")
+	}
+	if code := a.status.exitCode(); code != exitFailure {
+		t.Errorf("exit code = %d, want %d", code, exitFailure)
+	}
+}
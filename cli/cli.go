@@ -0,0 +1,653 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Process exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1 // an operation or one of its steps failed
+	exitUsage   = 2
+	exitHealth  = 3 // the health check found problems
+	exitAborted = 4 // a confirmation was declined, by the user or by policy
+)
+
+// runStatus accumulates the outcomes that decide the exit code
+type runStatus struct {
+	failures     int
+	healthFailed bool
+	aborted      bool
+}
+
+func (s runStatus) exitCode() int {
+	switch {
+	case s.failures > 0:
+		return exitFailure
+	case s.healthFailed:
+		return exitHealth
+	case s.aborted:
+		return exitAborted
+	}
+	return exitOK
+}
+
+// usageError is a problem with the command line itself
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+// flagSpec describes a --flag. Flags with an arg placeholder take a value,
+// either as --flag=value or as the next argument.
+type flagSpec struct {
+	name  string
+	short string
+	arg   string
+	usage string
+}
+
+func (f flagSpec) String() string {
+	s := "--" + f.name
+	if f.short != "" {
+		s = "-" + f.short + ", " + s
+	}
+	if f.arg != "" {
+		s += " " + f.arg
+	}
+	return s
+}
+
+// globalFlags are accepted anywhere on the command line
+var globalFlags = []flagSpec{
+	{name: "dry-run", usage: "Show what would be done without making changes"},
+	{name: "safe", usage: "Enable safe mode with extra confirmations"},
+	{name: "yes", short: "y", usage: "Run non-interactively, answering yes to safe confirmations"},
+	{name: "non-interactive", usage: "Never read stdin; confirmations follow policy"},
+	{name: "allow-dangerous", usage: "Let non-interactive runs confirm dangerous operations"},
+	{name: "verbose", usage: "Show command output while it runs"},
+	{name: "config", arg: "PATH", usage: "Read user configuration from PATH"},
+	{name: "output", arg: "FORMAT", usage: "Output format: " + strings.Join(outputFormats, ", ")},
+	{name: "record", arg: "DIR", usage: "Save every external command and its output to DIR"},
+	{name: "replay", arg: "DIR", usage: "Serve external commands from fixtures in DIR"},
+	{name: "help", short: "h", usage: "Show this help message"},
+	{name: "version", short: "v", usage: "Show version information"},
+}
+
+// flagSettings maps boolean global flags onto the config key they set
+var flagSettings = []struct {
+	flag string
+	key  string
+}{
+	{"dry-run", "DRY_RUN"},
+	{"safe", "SAFE_MODE"},
+	{"yes", "AUTO_CONFIRM"},
+	{"yes", "NON_INTERACTIVE"},
+	{"non-interactive", "NON_INTERACTIVE"},
+	{"allow-dangerous", "ALLOW_DANGEROUS"},
+	{"verbose", "VERBOSE_MODE"},
+}
+
+var outputFormats = []string{"text", "json", "yaml"}
+
+// commandSpec describes one subcommand
+type commandSpec struct {
+	name    string
+	aliases []string
+	args    string
+	summary string
+	flags   []flagSpec
+	minArgs int
+	maxArgs int
+	run     func(a *ArchMaintenance, inv *invocation)
+	// report gathers the command's result for --output json|yaml; nil
+	// means the command only has text output
+	report func(a *ArchMaintenance, inv *invocation) (kind string, data interface{}, err error)
+	// dataOutput commands print data on stdout, so messages go to stderr
+	dataOutput bool
+}
+
+var commands []commandSpec
+
+func init() {
+	commands = []commandSpec{
+		{name: "status", aliases: []string{"s"}, summary: "Show system status and information",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showSystemStatus() },
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				return "status", a.statusReport(), nil
+			}},
+		{name: "update", aliases: []string{"u"}, summary: "Update system packages (with backup)",
+			run: func(a *ArchMaintenance, inv *invocation) { a.systemUpdate() },
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				dbPath, err := a.tempSyncDB()
+				if err != nil {
+					return "", nil, err
+				}
+				updates, err := a.pendingUpdates(dbPath)
+				if err != nil {
+					return "", nil, err
+				}
+				a.completeUpdates(updates, dbPath)
+				aur, _, err := a.aurUpdates()
+				return "updates", UpdatesReport{Updates: updates, AUR: aur}, err
+			}},
+		{name: "clean", aliases: []string{"c"}, summary: "Clean system (cache, logs, temp files)",
+			run: func(a *ArchMaintenance, inv *invocation) { a.systemClean() }},
+		{name: "disk", args: "analyze", summary: "Show where disk space goes and what cleaning would free",
+			minArgs: 1, maxArgs: 1,
+			flags: []flagSpec{
+				{name: "top", arg: "N", usage: "List the N largest entries per section (default 10)"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if inv.args[0] != "analyze" {
+					inv.fail(usagef("unknown disk action %q", inv.args[0]))
+					return
+				}
+				top := 10
+				if value := inv.value("top"); value != "" {
+					n, err := strconv.Atoi(value)
+					if err != nil || n < 1 {
+						inv.fail(usagef("--top expects a positive number, got %q", value))
+						return
+					}
+					top = n
+				}
+				a.diskAnalyze(top)
+			}},
+		{name: "orphans", aliases: []string{"o"}, summary: "Remove orphaned packages",
+			flags: []flagSpec{
+				{name: "exclude", arg: "PKG[,PKG...]", usage: "Keep these packages (repeatable)"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) { a.removeOrphans(inv.list("exclude")...) },
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				report, err := a.findOrphans(inv.list("exclude"))
+				return "orphans", report, err
+			}},
+		{name: "news", summary: "Show and acknowledge Arch Linux news since the last upgrade",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showNews() }},
+		{name: "history", summary: "Show package transactions from pacman.log",
+			flags: []flagSpec{
+				{name: "package", arg: "PKG", usage: "Only changes to PKG"},
+				{name: "action", arg: "ACTION", usage: "Only " + joinActions() + " changes"},
+				{name: "since", arg: "DATE|boot|backup", usage: "Transactions since DATE, the last boot or the last backup"},
+				{name: "until", arg: "DATE", usage: "Transactions up to DATE"},
+				{name: "limit", arg: "N", usage: "Show only the last N transactions (default 20, 0 for all)"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if filter, limit, err := a.historyArgs(inv); err != nil {
+					inv.fail(err)
+				} else {
+					a.showHistory(filter, limit)
+				}
+			},
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				filter, limit, err := a.historyArgs(inv)
+				if err != nil {
+					return "", nil, err
+				}
+				report, err := a.historyReport(filter, limit)
+				return "history", report, err
+			}},
+		{name: "downgrade", args: "<pkg> [version]", summary: "Install another version of a package from the cache or the archive",
+			minArgs: 1, maxArgs: 2,
+			flags: []flagSpec{
+				{name: "ignore", usage: "Add the package to IgnorePkg afterwards"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				a.downgradePackage(inv.arg(0), inv.arg(1), inv.has("ignore"))
+			}},
+		{name: "rollback", args: "<transaction>", summary: "Undo a pacman transaction from 'history' with cached packages",
+			minArgs: 1, maxArgs: 1,
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if id, err := rollbackArgs(inv); err != nil {
+					inv.fail(err)
+				} else {
+					a.rollbackTransaction(id)
+				}
+			}},
+		{name: "pacnew", summary: "Review and resolve .pacnew and .pacsave files",
+			run: func(a *ArchMaintenance, inv *invocation) { a.managePacnew() }},
+		{name: "mirrors", summary: "Check mirrorlist freshness and response times",
+			flags: []flagSpec{
+				{name: "rank", usage: "Rewrite the mirrorlist, up to date and fastest mirrors first"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) { a.showMirrors(inv.has("rank")) },
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				report, err := a.mirrorsReport()
+				return "mirrors", report, err
+			}},
+		{name: "services", aliases: []string{"sv"}, summary: "Show system services status",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showServices() }},
+		{name: "logs", aliases: []string{"l"}, summary: "Show recent system logs",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showLogs() }},
+		{name: "health", aliases: []string{"h"}, args: "[history]", summary: "Run comprehensive health check, or show past scores",
+			maxArgs: 1,
+			flags: []flagSpec{
+				{name: "limit", arg: "N", usage: "With history, show only the last N runs"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if len(inv.args) == 0 {
+					a.systemHealthCheck()
+					return
+				}
+				if limit, err := healthHistoryArgs(inv); err != nil {
+					inv.fail(err)
+				} else {
+					a.showHealthHistory(limit)
+				}
+			},
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				if len(inv.args) == 0 {
+					return "health", a.healthReport(), nil
+				}
+				limit, err := healthHistoryArgs(inv)
+				if err != nil {
+					return "", nil, err
+				}
+				report, err := a.healthHistoryReport(limit)
+				return "health_history", report, err
+			}},
+		{name: "maintenance", aliases: []string{"m"}, summary: "Run full maintenance routine",
+			run: func(a *ArchMaintenance, inv *invocation) { a.fullMaintenance() }},
+		{name: "search", aliases: []string{"se"}, args: "<term>", summary: "Search for packages",
+			minArgs: 1, maxArgs: 1,
+			flags: []flagSpec{
+				{name: "installed", usage: "Only search installed packages"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) { a.searchPackages(inv.args[0], inv.has("installed")) }},
+		{name: "backup", aliases: []string{"b"}, summary: "Create system backup",
+			run: func(a *ArchMaintenance, inv *invocation) { a.createBackup() }},
+		{name: "backups", aliases: []string{"bl"}, summary: "List existing backups",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showBackups() },
+			report: func(a *ArchMaintenance, inv *invocation) (string, interface{}, error) {
+				report, err := a.backups()
+				return "backups", report, err
+			}},
+		{name: "restore", aliases: []string{"r"}, args: "[backup|latest]", summary: "Restore from backup",
+			maxArgs: 1,
+			run:     func(a *ArchMaintenance, inv *invocation) { a.restoreBackup(inv.arg(0)) }},
+		{name: "snapshot", aliases: []string{"sn"}, summary: "Create btrfs snapshot",
+			run: func(a *ArchMaintenance, inv *invocation) { a.createSnapshot() }},
+		{name: "config", aliases: []string{"cfg"}, args: "[show]", summary: "Manage configuration, or show it with its origins",
+			maxArgs: 1,
+			flags: []flagSpec{
+				{name: "origin", usage: "With show, print which layer set each value"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if len(inv.args) == 0 {
+					if a.config.NonInteractive {
+						inv.fail(usagef("the configuration manager is interactive; use 'config show'"))
+						return
+					}
+					a.configManager()
+					return
+				}
+				if inv.args[0] != "show" {
+					inv.fail(usagef("unknown config action %q", inv.args[0]))
+					return
+				}
+				a.showConfig(inv.has("origin"))
+			}},
+		{name: "run", args: "[name]", summary: "Run a custom command (lists them without a name)",
+			maxArgs: 1,
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if len(inv.args) == 0 {
+					a.listCustomCommands()
+				} else {
+					a.runCustomCommand(inv.args[0])
+				}
+			}},
+		{name: "check", args: "<name|all>", summary: "Run health checks as a Nagios/Icinga plugin",
+			minArgs: 1, maxArgs: 1, dataOutput: true,
+			flags: []flagSpec{
+				{name: "warning", short: "w", arg: "N", usage: "Override the warning threshold of a single check"},
+				{name: "critical", short: "c", arg: "N", usage: "Override the critical threshold of a single check"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) { a.runPluginCheck(inv) }},
+		{name: "export", args: "<format>", summary: "Export metrics (" + strings.Join(exportFormats, ", ") + ")",
+			minArgs: 1, maxArgs: 1, dataOutput: true,
+			flags: []flagSpec{
+				{name: "textfile", arg: "DIR", usage: "Write " + promFileName + " into a node_exporter textfile directory"},
+			},
+			run: func(a *ArchMaintenance, inv *invocation) {
+				if inv.args[0] != "prometheus" {
+					inv.fail(usagef("unknown export format %q (want %s)", inv.args[0], strings.Join(exportFormats, ", ")))
+					return
+				}
+				if err := a.exportPrometheus(inv.value("textfile")); err != nil {
+					inv.fail(err)
+				}
+			}},
+		{name: "help", summary: "Show this help message",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showHelp() }},
+		{name: "version", summary: "Show version information",
+			run: func(a *ArchMaintenance, inv *invocation) { a.showVersion() }},
+	}
+}
+
+// healthHistoryArgs validates "health history [--limit N]"
+func healthHistoryArgs(inv *invocation) (int, error) {
+	if inv.args[0] != "history" {
+		return 0, usagef("unknown health action %q", inv.args[0])
+	}
+	limit := 20
+	if value := inv.value("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, usagef("--limit expects a number, got %q", value)
+		}
+		limit = n
+	}
+	return limit, nil
+}
+
+func lookupCommand(name string) *commandSpec {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+		for _, alias := range commands[i].aliases {
+			if alias == name {
+				return &commands[i]
+			}
+		}
+	}
+	return nil
+}
+
+func lookupFlag(specs []flagSpec, name string) *flagSpec {
+	for i := range specs {
+		if specs[i].name == name || (specs[i].short != "" && specs[i].short == name) {
+			return &specs[i]
+		}
+	}
+	return nil
+}
+
+// invocation is a parsed command line
+type invocation struct {
+	command  *commandSpec
+	args     []string
+	flags    map[string][]string
+	exitCode int
+}
+
+func (inv *invocation) has(name string) bool {
+	return len(inv.flags[name]) > 0
+}
+
+// arg returns the i-th positional argument or ""
+func (inv *invocation) arg(i int) string {
+	if i < len(inv.args) {
+		return inv.args[i]
+	}
+	return ""
+}
+
+func (inv *invocation) value(name string) string {
+	if values := inv.flags[name]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+// list returns every value of a repeatable flag, splitting on commas
+func (inv *invocation) list(name string) []string {
+	var items []string
+	for _, value := range inv.flags[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// fail reports err and records the matching exit code
+func (inv *invocation) fail(err error) {
+	if _, ok := err.(*usageError); ok {
+		printUsageError(err)
+		inv.exitCode = exitUsage
+		return
+	}
+	errorColor.Fprintf(os.Stderr, "archmaint: %v\n", err)
+	inv.exitCode = 1
+}
+
+// usageExitCode is the exit code for a command line parseArgs rejected.
+// The check command exits UNKNOWN, as monitoring plugins must.
+func usageExitCode(argv []string) int {
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			if spec := lookupFlag(globalFlags, name); spec != nil && spec.arg != "" && !hasValue {
+				i++
+			}
+			continue
+		}
+		if cmd := lookupCommand(arg); cmd != nil && cmd.name == "check" {
+			return pluginUnknown
+		}
+		break
+	}
+	return exitUsage
+}
+
+func printUsageError(err error) {
+	errorColor.Fprintf(os.Stderr, "archmaint: %v\n", err)
+	fmt.Fprintln(os.Stderr, "Run 'archmaint help' for usage.")
+}
+
+// parseArgs splits argv into a command, its arguments and flags. Global
+// flags may appear anywhere; command flags must follow the command name.
+// A lone "--" ends flag parsing.
+func parseArgs(argv []string) (*invocation, error) {
+	inv := &invocation{flags: make(map[string][]string)}
+
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+
+		if arg == "--" {
+			for _, rest := range argv[i+1:] {
+				if err := inv.addPositional(rest); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if err := inv.addPositional(arg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		name, value, hasValue := strings.Cut(name, "=")
+
+		spec := lookupFlag(globalFlags, name)
+		if spec == nil && inv.command != nil {
+			spec = lookupFlag(inv.command.flags, name)
+		}
+		if spec == nil {
+			if inv.command != nil {
+				return nil, usagef("unknown flag %s for %s", arg, inv.command.name)
+			}
+			return nil, usagef("unknown flag %s", arg)
+		}
+
+		if spec.arg != "" {
+			if !hasValue {
+				if i+1 >= len(argv) {
+					return nil, usagef("flag --%s requires %s", spec.name, spec.arg)
+				}
+				i++
+				value = argv[i]
+			}
+		} else if hasValue {
+			return nil, usagef("flag --%s does not take a value", spec.name)
+		} else {
+			value = "true"
+		}
+		inv.flags[spec.name] = append(inv.flags[spec.name], value)
+	}
+
+	if output := inv.value("output"); output != "" && !contains(outputFormats, output) {
+		return nil, usagef("unknown output format %q (want %s)", output, strings.Join(outputFormats, ", "))
+	}
+	if output := inv.value("output"); structuredOutput(output) {
+		if inv.command == nil {
+			return nil, usagef("--output %s requires a command", output)
+		}
+		if inv.command.report == nil {
+			return nil, usagef("--output %s is not supported for %s", output, inv.command.name)
+		}
+	}
+
+	if inv.value("record") != "" && inv.value("replay") != "" {
+		return nil, usagef("--record and --replay cannot be combined")
+	}
+
+	if inv.command != nil {
+		if len(inv.args) < inv.command.minArgs {
+			return nil, usagef("%s requires %s", inv.command.name, inv.command.args)
+		}
+		if len(inv.args) > inv.command.maxArgs {
+			return nil, usagef("too many arguments for %s", inv.command.name)
+		}
+	}
+
+	return inv, nil
+}
+
+func (inv *invocation) addPositional(arg string) error {
+	if inv.command != nil {
+		inv.args = append(inv.args, arg)
+		return nil
+	}
+	inv.command = lookupCommand(arg)
+	if inv.command == nil {
+		return usagef("unknown command %q", arg)
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// execute configures the application from inv and runs the selected
+// command, returning the process exit code
+func (a *ArchMaintenance) execute(inv *invocation) int {
+	format := inv.value("output")
+	if structuredOutput(format) || (inv.command != nil && inv.command.dataOutput) {
+		// Keep stdout for the data alone
+		color.Output = os.Stderr
+	}
+
+	userPath := inv.value("config")
+	if userPath != "" {
+		if _, err := os.Stat(userPath); err != nil {
+			errorColor.Fprintf(os.Stderr, "archmaint: --config: %v\n", err)
+			return 1
+		}
+	}
+
+	// Load system, user and environment config if present
+	loaded, err := a.loadConfig(userPath)
+	if len(loaded) > 0 {
+		infoColor.Println("Loaded custom configuration")
+	}
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			warningColor.Printf("Config: %s\n", line)
+		}
+	}
+
+	// Flags form the last configuration layer
+	for _, fs := range flagSettings {
+		if !inv.has(fs.flag) {
+			continue
+		}
+		if err := a.layers.set(fs.key, "true", configOrigin{Layer: layerFlag, Source: "--" + fs.flag}); err != nil {
+			warningColor.Printf("Ignoring --%s: %v\n", fs.flag, err)
+			continue
+		}
+		switch fs.flag {
+		case "dry-run":
+			infoColor.Println("DRY RUN MODE: No changes will be made")
+		case "safe":
+			successColor.Println("SAFE MODE: Extra confirmations enabled")
+		}
+	}
+
+	for _, mode := range []string{"record", "replay"} {
+		if dir := inv.value(mode); dir != "" {
+			if err := a.useFixtures(mode, dir); err != nil {
+				errorColor.Fprintf(os.Stderr, "archmaint: --%s: %v\n", mode, err)
+				return 1
+			}
+		}
+	}
+
+	if inv.has("help") {
+		a.showHelp()
+		return exitOK
+	}
+	if inv.has("version") {
+		a.showVersion()
+		return exitOK
+	}
+
+	if inv.command == nil {
+		if a.config.NonInteractive {
+			printUsageError(usagef("non-interactive mode requires a command"))
+			return exitUsage
+		}
+		a.menuMode = true
+		a.showMainMenu()
+		return exitOK
+	}
+
+	if structuredOutput(format) {
+		kind, data, err := inv.command.report(a, inv)
+		if err != nil {
+			inv.fail(err)
+			return inv.exitCode
+		}
+		if err := writeReport(os.Stdout, format, kind, data); err != nil {
+			inv.fail(err)
+			return inv.exitCode
+		}
+		return a.status.exitCode()
+	}
+
+	inv.command.run(a, inv)
+	if inv.exitCode != exitOK {
+		return inv.exitCode
+	}
+	return a.status.exitCode()
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError describes a problem found on a single line of a config file
+type ConfigError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+}
+
+// configKey maps a KEY in config.conf onto a Config field
+type configKey struct {
+	name   string
+	format func(c *Config) string
+	parse  func(c *Config, value string) error
+}
+
+var configKeys = []configKey{
+	boolKey("DRY_RUN", func(c *Config) *bool { return &c.DryRun }),
+	boolKey("SAFE_MODE", func(c *Config) *bool { return &c.SafeMode }),
+	boolKey("AUTO_CONFIRM", func(c *Config) *bool { return &c.AutoConfirm }),
+	boolKey("BACKUP_ENABLED", func(c *Config) *bool { return &c.BackupEnabled }),
+	{
+		name:   "BACKUP_PATH",
+		format: func(c *Config) string { return c.BackupPath },
+		parse: func(c *Config, value string) error {
+			if value == "" {
+				return errors.New("path must not be empty")
+			}
+			c.BackupPath = expandHome(value)
+			return nil
+		},
+	},
+	{
+		name:   "STATE_PATH",
+		format: func(c *Config) string { return c.StatePath },
+		parse: func(c *Config, value string) error {
+			if value == "" {
+				return errors.New("path must not be empty")
+			}
+			c.StatePath = expandHome(value)
+			return nil
+		},
+	},
+	{
+		name:   "PACMAN_ROOT",
+		format: func(c *Config) string { return c.PacmanRoot },
+		parse: func(c *Config, value string) error {
+			if value == "" {
+				return errors.New("path must not be empty")
+			}
+			c.PacmanRoot = expandHome(value)
+			return nil
+		},
+	},
+	{
+		// Empty means <PACMAN_ROOT>/var/lib/pacman
+		name:   "PACMAN_DBPATH",
+		format: func(c *Config) string { return c.PacmanDBPath },
+		parse: func(c *Config, value string) error {
+			c.PacmanDBPath = expandHome(value)
+			return nil
+		},
+	},
+	daysKey("CACHE_RETENTION_DAYS", func(c *Config) *int { return &c.CacheRetentionDays }),
+	countKey("CACHE_KEEP_VERSIONS", func(c *Config) *int { return &c.CacheKeepVersions }),
+	daysKey("LOG_RETENTION_DAYS", func(c *Config) *int { return &c.LogRetentionDays }),
+	boolKey("NOTIFICATIONS_ENABLED", func(c *Config) *bool { return &c.NotificationsEnabled }),
+	boolKey("VERBOSE_MODE", func(c *Config) *bool { return &c.VerboseMode }),
+	boolKey("NON_INTERACTIVE", func(c *Config) *bool { return &c.NonInteractive }),
+	boolKey("ALLOW_DANGEROUS", func(c *Config) *bool { return &c.AllowDangerous }),
+	{
+		// Orphans that 'archmaint orphans' never removes
+		name:   "ORPHANS_IGNORE",
+		format: func(c *Config) string { return strings.Join(c.OrphansIgnore, ",") },
+		parse: func(c *Config, value string) error {
+			c.OrphansIgnore = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+			return nil
+		},
+	},
+	{
+		// An http(s) or file URL, or a path; empty disables the news check
+		name:   "NEWS_URL",
+		format: func(c *Config) string { return c.NewsURL },
+		parse: func(c *Config, value string) error {
+			c.NewsURL = expandHome(value)
+			return nil
+		},
+	},
+	{
+		// The Arch Linux Archive, or a mirror of it, for downgrades
+		name:   "ARCHIVE_URL",
+		format: func(c *Config) string { return c.ArchiveURL },
+		parse: func(c *Config, value string) error {
+			c.ArchiveURL = strings.TrimRight(expandHome(value), "/")
+			return nil
+		},
+	},
+	{
+		// auto picks paru, then yay; none never uses a helper
+		name:   "AUR_HELPER",
+		format: func(c *Config) string { return c.AURHelper },
+		parse: func(c *Config, value string) error {
+			if !contains(aurHelpers, value) && value != "auto" && value != "none" {
+				return fmt.Errorf("expected auto, none or one of %s", strings.Join(aurHelpers, ", "))
+			}
+			c.AURHelper = value
+			return nil
+		},
+	},
+	{
+		// The AUR RPC info endpoint; empty disables AUR update checks
+		name:   "AUR_URL",
+		format: func(c *Config) string { return c.AURURL },
+		parse: func(c *Config, value string) error {
+			c.AURURL = expandHome(value)
+			return nil
+		},
+	},
+	countKey("MIRROR_MAX_AGE_HOURS", func(c *Config) *int { return &c.MirrorMaxAgeHours }),
+	percentKey("HEALTH_DISK_WARN", func(c *Config) *int { return &c.DiskWarnPercent }),
+	percentKey("HEALTH_DISK_CRITICAL", func(c *Config) *int { return &c.DiskCriticalPercent }),
+	percentKey("HEALTH_MEMORY_WARN", func(c *Config) *int { return &c.MemoryWarnPercent }),
+	percentKey("HEALTH_MEMORY_CRITICAL", func(c *Config) *int { return &c.MemoryCriticalPercent }),
+	countKey("HEALTH_JOURNAL_ERRORS_WARN", func(c *Config) *int { return &c.JournalErrorsWarn }),
+	countKey("HEALTH_JOURNAL_ERRORS_CRITICAL", func(c *Config) *int { return &c.JournalErrorsCritical }),
+}
+
+func boolKey(name string, field func(c *Config) *bool) configKey {
+	return configKey{
+		name:   name,
+		format: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		parse: func(c *Config, value string) error {
+			b, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+func daysKey(name string, field func(c *Config) *int) configKey {
+	return configKey{
+		name:   name,
+		format: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		parse: func(c *Config, value string) error {
+			days, err := strconv.Atoi(value)
+			if err != nil || days <= 0 {
+				return fmt.Errorf("expected a positive number of days, got %q", value)
+			}
+			*field(c) = days
+			return nil
+		},
+	}
+}
+
+func percentKey(name string, field func(c *Config) *int) configKey {
+	return configKey{
+		name:   name,
+		format: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		parse: func(c *Config, value string) error {
+			percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || percent < 1 || percent > 100 {
+				return fmt.Errorf("expected a percentage between 1 and 100, got %q", value)
+			}
+			*field(c) = percent
+			return nil
+		},
+	}
+}
+
+func countKey(name string, field func(c *Config) *int) configKey {
+	return configKey{
+		name:   name,
+		format: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		parse: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("expected a positive number, got %q", value)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func lookupConfigKey(name string) *configKey {
+	for i := range configKeys {
+		if configKeys[i].name == name {
+			return &configKeys[i]
+		}
+	}
+	return nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected true or false, got %q", value)
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, path[1:])
+		}
+	}
+	return path
+}
+
+// configLine is one line of a config file. Comments and blank lines only
+// carry raw so that rewriting the file keeps them untouched.
+type configLine struct {
+	raw       string
+	num       int
+	key       string
+	value     string
+	locked    bool
+	malformed bool
+}
+
+// configFile is a parsed KEY=VALUE file that can be written back losslessly
+type configFile struct {
+	path  string
+	lines []configLine
+}
+
+// Configuration layers, lowest precedence first. Each layer overrides the
+// ones before it unless a system layer marked the key as locked.
+const (
+	layerDefault = "default"
+	layerSystem  = "system"
+	layerDropIn  = "conf.d"
+	layerUser    = "user"
+	layerEnv     = "env"
+	layerFlag    = "flag"
+	layerSession = "session"
+)
+
+// systemConfigDir holds the admin-managed config.conf and conf.d/*.conf
+var systemConfigDir = "/etc/archmaint"
+
+// envPrefix is prepended to a config key to form its environment variable
+const envPrefix = "ARCHMAINT_"
+
+// configOrigin records which layer last set a config key
+type configOrigin struct {
+	Layer  string
+	Source string
+	Locked bool
+}
+
+func (o configOrigin) String() string {
+	s := o.Layer
+	if o.Source != "" {
+		s += " (" + o.Source + ")"
+	}
+	if o.Locked {
+		s += " [locked]"
+	}
+	return s
+}
+
+// configLoader applies layers onto a Config while tracking origins and locks
+type configLoader struct {
+	config  *Config
+	origins map[string]configOrigin
+	// userPath is the file loaded as the user layer, where export writes
+	userPath string
+}
+
+func newConfigLoader(config *Config) *configLoader {
+	return &configLoader{
+		config:  config,
+		origins: make(map[string]configOrigin),
+	}
+}
+
+func (l *configLoader) set(name, value string, origin configOrigin) error {
+	key := lookupConfigKey(name)
+	if key == nil {
+		key = customCommandKey(name)
+	}
+	if key == nil {
+		return fmt.Errorf("unknown key %s", name)
+	}
+	if prev, ok := l.origins[name]; ok && prev.Locked {
+		return fmt.Errorf("%s is locked by %s", name, prev.Source)
+	}
+	if origin.Locked && origin.Layer != layerSystem && origin.Layer != layerDropIn {
+		return fmt.Errorf("%s: locked is only allowed under %s", name, systemConfigDir)
+	}
+	if err := key.parse(l.config, value); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	l.origins[name] = origin
+	return nil
+}
+
+func (l *configLoader) origin(name string) configOrigin {
+	if origin, ok := l.origins[name]; ok {
+		return origin
+	}
+	return configOrigin{Layer: layerDefault}
+}
+
+func (l *configLoader) locked(name string) bool {
+	return l.origins[name].Locked
+}
+
+// loadFile applies path as layer. A missing file is not an error.
+func (l *configLoader) loadFile(path, layer string) (bool, []error) {
+	cf, err := readConfigFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, []error{err}
+	}
+	return true, cf.apply(l, layer)
+}
+
+// loadFiles applies the file-based layers in precedence order and returns
+// the paths that were found.
+func (l *configLoader) loadFiles(userPath string) ([]string, []error) {
+	var loaded []string
+	var errs []error
+
+	load := func(path, layer string) {
+		found, fileErrs := l.loadFile(path, layer)
+		if found {
+			loaded = append(loaded, path)
+		}
+		errs = append(errs, fileErrs...)
+	}
+
+	load(filepath.Join(systemConfigDir, "config.conf"), layerSystem)
+
+	dropIns, _ := filepath.Glob(filepath.Join(systemConfigDir, "conf.d", "*.conf"))
+	sort.Strings(dropIns)
+	for _, path := range dropIns {
+		load(path, layerDropIn)
+	}
+
+	if userPath != "" {
+		l.userPath = userPath
+		load(userPath, layerUser)
+	}
+
+	return loaded, errs
+}
+
+// loadEnv applies ARCHMAINT_<KEY> variables for every known key
+func (l *configLoader) loadEnv() []error {
+	var errs []error
+	for _, key := range configKeys {
+		name := envPrefix + key.name
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := l.set(key.name, value, configOrigin{Layer: layerEnv, Source: "$" + name}); err != nil {
+			errs = append(errs, fmt.Errorf("$%s: %v", name, err))
+		}
+	}
+	return errs
+}
+
+func userConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".config/archmaint/config.conf"), nil
+}
+
+// readConfigFile splits a config file into lines. Malformed lines are
+// kept so that a later rewrite does not drop them; apply reports them.
+func readConfigFile(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf := &configFile{path: path}
+
+	scanner := bufio.NewScanner(f)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := configLine{raw: scanner.Text(), num: num}
+		trimmed := strings.TrimSpace(line.raw)
+
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if rest, ok := strings.CutPrefix(trimmed, "locked "); ok {
+				line.locked = true
+				trimmed = strings.TrimSpace(rest)
+			}
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				line.malformed = true
+			} else {
+				line.key = strings.TrimSpace(key)
+				line.value = unquote(strings.TrimSpace(value))
+			}
+		}
+		cf.lines = append(cf.lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 {
+		if (value[0] == '"' && value[len(value)-1] == '"') ||
+			(value[0] == '\'' && value[len(value)-1] == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+// apply feeds every KEY=VALUE line into the loader as part of layer,
+// collecting an error for each malformed line, unknown key or bad value.
+// Valid lines are applied even if others fail.
+func (cf *configFile) apply(l *configLoader, layer string) []error {
+	var errs []error
+	for _, line := range cf.lines {
+		if line.malformed {
+			errs = append(errs, &ConfigError{cf.path, line.num, fmt.Sprintf("expected KEY=VALUE, got %q", strings.TrimSpace(line.raw))})
+			continue
+		}
+		if line.key == "" {
+			continue
+		}
+		origin := configOrigin{
+			Layer:  layer,
+			Source: fmt.Sprintf("%s:%d", cf.path, line.num),
+			Locked: line.locked,
+		}
+		if err := l.set(line.key, line.value, origin); err != nil {
+			errs = append(errs, &ConfigError{cf.path, line.num, err.Error()})
+		}
+	}
+	return errs
+}
+
+// render produces the file contents for config. Only keys whose origin is
+// the user file or the interactive session are written: changed lines are
+// rewritten in place and session keys missing from the file are appended.
+// Everything else, including values from other layers and per-run flags,
+// is left exactly as the file has it.
+func (cf *configFile) render(config *Config, origins map[string]configOrigin) string {
+	var b strings.Builder
+	written := make(map[string]bool)
+
+	owned := func(name string) bool {
+		layer := origins[name].Layer
+		return layer == layerUser || layer == layerSession
+	}
+
+	for _, line := range cf.lines {
+		key := lookupConfigKey(line.key)
+		if key == nil || !owned(key.name) {
+			b.WriteString(line.raw + "\n")
+			continue
+		}
+
+		current := key.format(config)
+		scratch := *config
+		if err := key.parse(&scratch, line.value); err == nil && key.format(&scratch) == current {
+			b.WriteString(line.raw + "\n")
+		} else {
+			fmt.Fprintf(&b, "%s=%s\n", key.name, current)
+		}
+		written[key.name] = true
+	}
+
+	for _, key := range configKeys {
+		if !written[key.name] && origins[key.name].Layer == layerSession {
+			fmt.Fprintf(&b, "%s=%s\n", key.name, key.format(config))
+		}
+	}
+
+	return b.String()
+}
+
+func newConfigFile(path string) *configFile {
+	return &configFile{
+		path: path,
+		lines: []configLine{
+			{raw: "# ArchMaint Configuration"},
+			{raw: "# Generated: " + time.Now().Format("2006-01-02 15:04:05")},
+			{raw: ""},
+		},
+	}
+}
+
+// writeFileAtomic replaces path by renaming a fully written temp file over it
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
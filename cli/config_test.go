@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configFixture writes the system config, drop-ins and user file and points
+// systemConfigDir at them. It returns the user file's path.
+func configFixture(t *testing.T, system string, dropIns map[string]string, user string) string {
+	t.Helper()
+	dir := t.TempDir()
+	etc := filepath.Join(dir, "etc")
+	if err := os.MkdirAll(filepath.Join(etc, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(etc, "config.conf"), system)
+	for name, data := range dropIns {
+		write(filepath.Join(etc, "conf.d", name), data)
+	}
+	userPath := filepath.Join(dir, "user.conf")
+	write(userPath, user)
+
+	saved := systemConfigDir
+	systemConfigDir = etc
+	t.Cleanup(func() { systemConfigDir = saved })
+	return userPath
+}
+
+func TestConfigLayers(t *testing.T) {
+	userPath := configFixture(t,
+		"CACHE_RETENTION_DAYS=60\nLOG_RETENTION_DAYS=30\nHEALTH_DISK_WARN=70\n",
+		map[string]string{
+			"10-cache.conf": "CACHE_RETENTION_DAYS=45\n",
+			"20-cache.conf": "CACHE_RETENTION_DAYS=40\n",
+		},
+		"LOG_RETENTION_DAYS=14\nHEALTH_DISK_WARN=75\n",
+	)
+	t.Setenv("ARCHMAINT_HEALTH_DISK_WARN", "85")
+
+	a := newArchMaintenance(NewFakeRunner())
+	loaded, err := a.loadConfig(userPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 4 {
+		t.Errorf("loaded %v, want the system file, two drop-ins and the user file", loaded)
+	}
+	if err := a.layers.set("DRY_RUN", "true", configOrigin{Layer: layerFlag, Source: "--dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, value, layer string
+	}{
+		{"CACHE_RETENTION_DAYS", "40", layerDropIn},
+		{"LOG_RETENTION_DAYS", "14", layerUser},
+		{"HEALTH_DISK_WARN", "85", layerEnv},
+		{"DRY_RUN", "true", layerFlag},
+		{"CACHE_KEEP_VERSIONS", "3", layerDefault},
+	}
+	for _, tt := range tests {
+		if got := lookupConfigKey(tt.key).format(a.config); got != tt.value {
+			t.Errorf("%s = %s, want %s", tt.key, got, tt.value)
+		}
+		if got := a.layers.origin(tt.key).Layer; got != tt.layer {
+			t.Errorf("%s origin = %s, want %s", tt.key, got, tt.layer)
+		}
+	}
+}
+
+func TestConfigLocked(t *testing.T) {
+	userPath := configFixture(t,
+		"locked CACHE_RETENTION_DAYS=60\n",
+		map[string]string{"10-log.conf": "locked LOG_RETENTION_DAYS=30\n"},
+		"CACHE_RETENTION_DAYS=7\nLOG_RETENTION_DAYS=7\nlocked CACHE_KEEP_VERSIONS=1\n",
+	)
+	t.Setenv("ARCHMAINT_CACHE_RETENTION_DAYS", "1")
+
+	a := newArchMaintenance(NewFakeRunner())
+	_, err := a.loadConfig(userPath)
+	if err == nil {
+		t.Fatal("overriding locked keys succeeded")
+	}
+	for _, want := range []string{
+		userPath + ":1: CACHE_RETENTION_DAYS is locked",
+		userPath + ":2: LOG_RETENTION_DAYS is locked",
+		userPath + ":3: CACHE_KEEP_VERSIONS: locked is only allowed under",
+		"$ARCHMAINT_CACHE_RETENTION_DAYS: CACHE_RETENTION_DAYS is locked",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	if a.config.CacheRetentionDays != 60 || a.config.LogRetentionDays != 30 {
+		t.Errorf("retention = %d/%d days, want the locked 60/30", a.config.CacheRetentionDays, a.config.LogRetentionDays)
+	}
+	if a.touchSetting("CACHE_RETENTION_DAYS") {
+		t.Error("a locked key can be changed interactively")
+	}
+	if !a.touchSetting("CACHE_KEEP_VERSIONS") {
+		t.Error("an unlocked key cannot be changed interactively")
+	}
+}
+
+func TestConfigExport(t *testing.T) {
+	user := "# my settings\nLOG_RETENTION_DAYS=14\n\nHEALTH_DISK_WARN = \"75\"\n"
+	userPath := configFixture(t,
+		"locked CACHE_RETENTION_DAYS=60\nHEALTH_MEMORY_WARN=70\n",
+		nil,
+		user,
+	)
+	t.Setenv("ARCHMAINT_BACKUP_ENABLED", "false")
+
+	a := newArchMaintenance(NewFakeRunner())
+	if _, err := a.loadConfig(userPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"DRY_RUN", "AUTO_CONFIRM", "NON_INTERACTIVE", "ALLOW_DANGEROUS"} {
+		if err := a.layers.set(key, "true", configOrigin{Layer: layerFlag}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing changed: the file is written back as it is
+	cf, err := readConfigFile(userPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cf.render(a.config, a.layers.origins); got != user {
+		t.Errorf("unchanged export:\n%s\nwant\n%s", got, user)
+	}
+
+	// A user key and a new key changed in the menu
+	if !a.touchSetting("LOG_RETENTION_DAYS") || !a.touchSetting("CACHE_KEEP_VERSIONS") {
+		t.Fatal("settings are locked")
+	}
+	a.config.LogRetentionDays = 21
+	a.config.CacheKeepVersions = 5
+	got := cf.render(a.config, a.layers.origins)
+	want := "# my settings\nLOG_RETENTION_DAYS=21\n\nHEALTH_DISK_WARN = \"75\"\nCACHE_KEEP_VERSIONS=5\n"
+	if got != want {
+		t.Errorf("export:\n%s\nwant\n%s", got, want)
+	}
+
+	// Reading the export back gives the same settings, with the other
+	// layers still in charge of their keys
+	if err := os.WriteFile(userPath, []byte(got), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := newArchMaintenance(NewFakeRunner())
+	if _, err := b.loadConfig(userPath); err != nil {
+		t.Fatal(err)
+	}
+	if b.config.LogRetentionDays != 21 || b.config.CacheKeepVersions != 5 || b.config.DiskWarnPercent != 75 {
+		t.Errorf("reloaded %+v", b.config)
+	}
+	for key, layer := range map[string]string{
+		"CACHE_RETENTION_DAYS": layerSystem,
+		"HEALTH_MEMORY_WARN":   layerSystem,
+		"BACKUP_ENABLED":       layerEnv,
+		"DRY_RUN":              layerDefault,
+	} {
+		if got := b.layers.origin(key).Layer; got != layer {
+			t.Errorf("%s origin after export = %s, want %s", key, got, layer)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// customPrefix starts every config key that declares a custom command, as in
+//
+//	CUSTOM_DKMS_COMMAND=sudo dkms autoinstall
+//	CUSTOM_DKMS_DESCRIPTION=Rebuild DKMS modules
+//	CUSTOM_DKMS_DANGEROUS=false
+//	CUSTOM_DKMS_MAINTENANCE=true
+const customPrefix = "CUSTOM_"
+
+var customFields = []string{"_COMMAND", "_DESCRIPTION", "_DANGEROUS", "_MAINTENANCE"}
+
+// customCommandKey returns the config key for a CUSTOM_<NAME>_<FIELD> entry,
+// or nil if name is not one
+func customCommandKey(name string) *configKey {
+	rest, ok := strings.CutPrefix(name, customPrefix)
+	if !ok {
+		return nil
+	}
+
+	for _, field := range customFields {
+		id, ok := strings.CutSuffix(rest, field)
+		if !ok || id == "" {
+			continue
+		}
+		cmdName := strings.ReplaceAll(strings.ToLower(id), "_", "-")
+
+		key := &configKey{name: name}
+		switch field {
+		case "_COMMAND":
+			key.format = func(c *Config) string { return joinCommandLine(c.CustomCommands[cmdName].Command) }
+			key.parse = func(c *Config, value string) error {
+				args, err := splitCommandLine(value)
+				if err != nil {
+					return err
+				}
+				if len(args) == 0 {
+					return errors.New("command must not be empty")
+				}
+				updateCustomCommand(c, cmdName, func(cmd *CustomCommand) { cmd.Command = args })
+				return nil
+			}
+		case "_DESCRIPTION":
+			key.format = func(c *Config) string { return c.CustomCommands[cmdName].Description }
+			key.parse = func(c *Config, value string) error {
+				updateCustomCommand(c, cmdName, func(cmd *CustomCommand) { cmd.Description = value })
+				return nil
+			}
+		case "_DANGEROUS":
+			key.format = func(c *Config) string { return strconv.FormatBool(c.CustomCommands[cmdName].Dangerous) }
+			key.parse = func(c *Config, value string) error {
+				b, err := parseBool(value)
+				if err != nil {
+					return err
+				}
+				updateCustomCommand(c, cmdName, func(cmd *CustomCommand) { cmd.Dangerous = b })
+				return nil
+			}
+		case "_MAINTENANCE":
+			key.format = func(c *Config) string { return strconv.FormatBool(c.CustomCommands[cmdName].Maintenance) }
+			key.parse = func(c *Config, value string) error {
+				b, err := parseBool(value)
+				if err != nil {
+					return err
+				}
+				updateCustomCommand(c, cmdName, func(cmd *CustomCommand) { cmd.Maintenance = b })
+				return nil
+			}
+		}
+		return key
+	}
+
+	return nil
+}
+
+// updateCustomCommand copies the map so that scratch configs used while
+// rendering never write through to the live one
+func updateCustomCommand(c *Config, name string, update func(cmd *CustomCommand)) {
+	commands := make(map[string]CustomCommand, len(c.CustomCommands)+1)
+	for k, v := range c.CustomCommands {
+		commands[k] = v
+	}
+	cmd := commands[name]
+	cmd.Name = name
+	update(&cmd)
+	commands[name] = cmd
+	c.CustomCommands = commands
+}
+
+// validateCustomCommands drops declared commands that never got a COMMAND
+func (l *configLoader) validateCustomCommands() []error {
+	var errs []error
+	for _, name := range l.config.customCommandNames() {
+		if len(l.config.CustomCommands[name].Command) != 0 {
+			continue
+		}
+		prefix := customPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		errs = append(errs, fmt.Errorf("custom command %s has no %sCOMMAND", name, prefix))
+		delete(l.config.CustomCommands, name)
+		for key := range l.origins {
+			if strings.HasPrefix(key, prefix) {
+				delete(l.origins, key)
+			}
+		}
+	}
+	return errs
+}
+
+func (c *Config) customCommandNames() []string {
+	names := make([]string, 0, len(c.CustomCommands))
+	for name := range c.CustomCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitCommandLine splits s into words the way a shell would for simple
+// commands: whitespace separates words, quotes group them and backslash
+// escapes the next character. No expansion is performed.
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for i := 0; i < len(s); i++ {
+		ch := rune(s[i])
+		switch {
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(s[i])
+			}
+		case ch == '\\':
+			if i+1 >= len(s) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case quote == '"':
+			if ch == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(s[i])
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inWord = true
+		case ch == ' ' || ch == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(s[i])
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// joinCommandLine is the inverse of splitCommandLine
+func joinCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t'\"\\$`|&;<>(){}*?#~") {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// loadCustomEnv applies ARCHMAINT_CUSTOM_* variables
+func (l *configLoader) loadCustomEnv() []error {
+	var errs []error
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		key, ok := strings.CutPrefix(name, envPrefix)
+		if !ok || !strings.HasPrefix(key, customPrefix) {
+			continue
+		}
+		if err := l.set(key, value, configOrigin{Layer: layerEnv, Source: "$" + name}); err != nil {
+			errs = append(errs, fmt.Errorf("$%s: %v", name, err))
+		}
+	}
+	return errs
+}
+
+func (a *ArchMaintenance) listCustomCommands() {
+	headerColor.Println("\n=== CUSTOM COMMANDS ===")
+
+	names := a.config.customCommandNames()
+	if len(names) == 0 {
+		infoColor.Println("No custom commands configured.")
+		fmt.Printf("Declare them in the config file with %s<NAME>_COMMAND=...\n", customPrefix)
+		return
+	}
+
+	for _, name := range names {
+		cmd := a.config.CustomCommands[name]
+		fmt.Printf("  %s", name)
+		if cmd.Dangerous {
+			dangerColor.Print(" [dangerous]")
+		}
+		if cmd.Maintenance {
+			infoColor.Print(" [maintenance]")
+		}
+		fmt.Println()
+		if cmd.Description != "" {
+			fmt.Printf("      %s\n", cmd.Description)
+		}
+		fmt.Printf("      $ %s\n", joinCommandLine(cmd.Command))
+	}
+}
+
+func (a *ArchMaintenance) runCustomCommand(name string) {
+	headerColor.Printf("\n=== CUSTOM COMMAND: %s ===\n", name)
+
+	cmd, ok := a.config.CustomCommands[name]
+	if !ok {
+		errorColor.Printf("Unknown custom command: %s\n", name)
+		a.status.failures++
+		return
+	}
+
+	if cmd.Description != "" {
+		fmt.Printf("Description: %s\n", cmd.Description)
+	}
+	fmt.Printf("Command: %s\n", joinCommandLine(cmd.Command))
+
+	if cmd.Dangerous {
+		dangerColor.Printf("[CAUTION] This action can be dangerous!\n")
+	}
+
+	if a.proceed(fmt.Sprintf("Run %s?", name), cmd.Dangerous) {
+		if !a.config.DryRun {
+			a.runCommandWithProgress(cmd.Command[0], cmd.Command[1:]...)
+		} else {
+			fmt.Printf("  Would run: %s\n", joinCommandLine(cmd.Command))
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+
+	"archmaint/internal/pacmandb"
+)
+
+// plainTable returns a borderless, left-aligned table on stdout
+func plainTable(header ...string) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+	table.SetBorder(false)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+	table.SetAutoWrapText(false)
+	return table
+}
+
+// dirUsage sums the regular files below root. When match is set only
+// files it accepts are counted. Unreadable entries are skipped.
+func dirUsage(root string, match func(info fs.FileInfo) bool) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if match == nil || match(info) {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func olderThan(days int, stamp func(fs.FileInfo) time.Time) func(fs.FileInfo) bool {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	return func(info fs.FileInfo) bool { return stamp(info).Before(cutoff) }
+}
+
+func modTime(info fs.FileInfo) time.Time { return info.ModTime() }
+
+// installedVersions maps installed package names to versions, from the
+// local database or, failing that, pacman -Q
+func (a *ArchMaintenance) installedVersions() (map[string]string, error) {
+	installed := make(map[string]string)
+	if local, err := a.packageDB().Local(); err == nil {
+		for _, pkg := range local {
+			installed[pkg.Name] = pkg.Version
+		}
+		return installed, nil
+	}
+
+	lines, err := a.queryList("pacman", "-Q")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			installed[fields[0]] = fields[1]
+		}
+	}
+	return installed, nil
+}
+
+// sizedEntry is a named amount of disk space
+type sizedEntry struct {
+	name string
+	size int64
+}
+
+// largestEntries sizes every entry directly below dir, largest first
+func largestEntries(dir string) []sizedEntry {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var sized []sizedEntry
+	for _, entry := range entries {
+		size := dirUsage(filepath.Join(dir, entry.Name()), nil)
+		if size > 0 {
+			sized = append(sized, sizedEntry{entry.Name(), size})
+		}
+	}
+	sort.Slice(sized, func(i, j int) bool { return sized[i].size > sized[j].size })
+	return sized
+}
+
+func (a *ArchMaintenance) diskAnalyze(top int) {
+	headerColor.Println("\n=== DISK ANALYSIS ===")
+
+	a.showDiskHealth()
+
+	installed, _ := a.installedVersions()
+	a.analyzeInstalledPackages(top)
+
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		warningColor.Printf("\nCould not read the package cache: %v\n", err)
+	}
+	a.analyzePackageCache(cache, installed, top)
+
+	journalDir := filepath.Join(a.config.PacmanRoot, "var/log/journal")
+	a.analyzeJournal(journalDir)
+
+	homeDir, _ := os.UserHomeDir()
+	userCache := filepath.Join(homeDir, ".cache")
+	infoColor.Printf("\nUser cache (%s):\n", userCache)
+	if entries := largestEntries(userCache); len(entries) == 0 {
+		fmt.Println("  Empty or not readable")
+	} else {
+		var total int64
+		table := plainTable("Entry", "Size")
+		for i, entry := range entries {
+			total += entry.size
+			if i < top {
+				table.Append([]string{"  " + entry.name, formatSize(entry.size)})
+			}
+		}
+		table.Render()
+		fmt.Printf("  Total: %s\n", formatSize(total))
+	}
+
+	a.analyzeKernelModules(filepath.Join(a.config.PacmanRoot, "usr/lib/modules"))
+
+	// What each step of 'archmaint clean' would free
+	estimates := map[string]int64{
+		"Package Cache":             -1,
+		"System Logs":               dirUsage(journalDir, olderThan(a.config.LogRetentionDays, modTime)),
+		"Temporary Files":           dirUsage("/tmp", olderThan(7, fileAtime)) + dirUsage("/var/tmp", olderThan(7, fileAtime)),
+		"User Cache":                dirUsage(userCache, olderThan(30, fileAtime)),
+		"Uninstalled Package Cache": -1,
+	}
+	if installed != nil {
+		estimates["Package Cache"] = cacheSize(cacheBeyondRetention(cache, installed, a.config.CacheKeepVersions, a.config.CacheRetentionDays))
+		estimates["Uninstalled Package Cache"] = cacheSize(cacheOfUninstalled(cache, installed))
+	}
+
+	infoColor.Println("\nEstimated space freed by 'archmaint clean':")
+	table := plainTable("Task", "Estimate")
+	var total int64
+	for _, task := range a.cleanTasks() {
+		estimate, ok := estimates[task.Name]
+		if !ok {
+			continue
+		}
+		if estimate > 0 {
+			total += estimate
+		}
+		table.Append([]string{"  " + task.Name, formatSize(estimate)})
+	}
+	table.Append([]string{"  Total", formatSize(total)})
+	table.Render()
+	infoColor.Println("The two package cache estimates can overlap.")
+
+	a.waitForContinue()
+}
+
+func (a *ArchMaintenance) analyzeInstalledPackages(top int) {
+	local, err := a.packageDB().Local()
+	if err != nil {
+		warningColor.Printf("\nCould not read the local package database: %v\n", err)
+		return
+	}
+
+	groups := []struct {
+		title  string
+		reason pacmandb.Reason
+	}{
+		{"Largest explicitly installed packages", pacmandb.Explicit},
+		{"Largest dependencies", pacmandb.Dependency},
+	}
+
+	for _, group := range groups {
+		var pkgs []*pacmandb.Package
+		var total int64
+		for _, pkg := range local {
+			if pkg.Reason == group.reason {
+				pkgs = append(pkgs, pkg)
+				total += pkg.InstalledSize
+			}
+		}
+		sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].InstalledSize > pkgs[j].InstalledSize })
+
+		infoColor.Printf("\n%s (%d packages, %s total):\n", group.title, len(pkgs), formatSize(total))
+		table := plainTable("Package", "Version", "Installed Size")
+		for i, pkg := range pkgs {
+			if i >= top {
+				break
+			}
+			table.Append([]string{"  " + pkg.Name, pkg.Version, formatSize(pkg.InstalledSize)})
+		}
+		table.Render()
+	}
+}
+
+func (a *ArchMaintenance) analyzePackageCache(cache []cachedPackage, installed map[string]string, top int) {
+	infoColor.Printf("\nPackage cache (%s):\n", strings.Join(a.packageCacheDirs(), ", "))
+	if len(cache) == 0 {
+		fmt.Println("  Empty")
+		return
+	}
+
+	// Reclaimable space follows the Package Cache task; it is unknown when
+	// the installed versions cannot be read
+	reclaimable := make(map[string]int64)
+	if installed != nil {
+		for _, pkg := range cacheBeyondRetention(cache, installed, a.config.CacheKeepVersions, a.config.CacheRetentionDays) {
+			reclaimable[pkg.Name+" "+pkg.Arch] += pkg.Size
+		}
+	}
+
+	type cacheUsage struct {
+		name        string
+		versions    int
+		size        int64
+		reclaimable int64
+	}
+	var usage []cacheUsage
+	var total int64
+	for key, group := range groupCachedPackages(cache) {
+		usage = append(usage, cacheUsage{
+			name:        group[0].Name,
+			versions:    len(group),
+			size:        cacheSize(group),
+			reclaimable: reclaimable[key],
+		})
+		total += reclaimable[key]
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].size > usage[j].size })
+
+	table := plainTable("Package", "Versions", "Size", "Reclaimable")
+	for i, u := range usage {
+		if i >= top {
+			break
+		}
+		table.Append([]string{"  " + u.name, fmt.Sprint(u.versions), formatSize(u.size), formatSize(u.reclaimable)})
+	}
+	table.Render()
+
+	fmt.Printf("  Total: %s in %d files\n", formatSize(cacheSize(cache)), len(cache))
+	if installed != nil {
+		fmt.Printf("  Reclaimable keeping %d versions or %d days: %s\n",
+			a.config.CacheKeepVersions, a.config.CacheRetentionDays, formatSize(total))
+	}
+}
+
+func (a *ArchMaintenance) analyzeJournal(journalDir string) {
+	infoColor.Println("\nSystem journal:")
+
+	if output, err := a.query("journalctl", "--disk-usage"); err == nil {
+		fmt.Printf("  %s\n", strings.TrimSpace(string(output)))
+	} else {
+		fmt.Printf("  %s: %s\n", journalDir, formatSize(dirUsage(journalDir, nil)))
+	}
+	fmt.Printf("  Older than %d days: %s\n", a.config.LogRetentionDays,
+		formatSize(dirUsage(journalDir, olderThan(a.config.LogRetentionDays, modTime))))
+}
+
+// analyzeKernelModules lists /usr/lib/modules. Arch kernel packages ship
+// vmlinuz next to their modules, so a directory without one is left over
+// from a removed kernel, usually DKMS builds.
+func (a *ArchMaintenance) analyzeKernelModules(modulesDir string) {
+	infoColor.Printf("\nKernel modules (%s):\n", modulesDir)
+
+	entries, err := os.ReadDir(modulesDir)
+	if err != nil || len(entries) == 0 {
+		fmt.Println("  None found")
+		return
+	}
+
+	running := ""
+	if output, err := a.query("uname", "-r"); err == nil {
+		running = strings.TrimSpace(string(output))
+	}
+
+	table := plainTable("Kernel", "Size", "State")
+	var leftover int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(modulesDir, entry.Name())
+		size := dirUsage(dir, nil)
+
+		state := "installed"
+		if entry.Name() == running {
+			state = "running"
+		} else if _, err := os.Stat(filepath.Join(dir, "vmlinuz")); err != nil {
+			state = "left over"
+			leftover += size
+		}
+		table.Append([]string{"  " + entry.Name(), formatSize(size), state})
+	}
+	table.Render()
+
+	if leftover > 0 {
+		warningColor.Printf("  %s in module directories of removed kernels\n", formatSize(leftover))
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"archmaint/internal/pacmandb"
+	"archmaint/internal/pacmanlog"
+	"archmaint/internal/vercmp"
+)
+
+// defaultArchiveURL is the Arch Linux Archive
+const defaultArchiveURL = "https://archive.archlinux.org"
+
+// archiveShown bounds the archive versions listed when choosing interactively
+const archiveShown = 10
+
+// packageVersion is one version of a package that can be installed with
+// pacman -U. Source is a cached file or an archive URL.
+type packageVersion struct {
+	Version string
+	Source  string
+	Cached  bool
+}
+
+var archiveLink = regexp.MustCompile(`href="([^"]+\.pkg\.tar[^"]*)"`)
+
+// archiveDir is the archive directory holding every version of a package
+func (a *ArchMaintenance) archiveDir(name string) string {
+	return fmt.Sprintf("%s/packages/%c/%s/", a.config.ArchiveURL, name[0], name)
+}
+
+// archiveVersions lists the versions of a package in the archive for arch
+func (a *ArchMaintenance) archiveVersions(name, arch string) ([]packageVersion, error) {
+	dir := a.archiveDir(name)
+	data, err := a.fetchURL(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []packageVersion
+	for _, m := range archiveLink.FindAllStringSubmatch(string(data), -1) {
+		file, err := url.PathUnescape(m[1])
+		if err != nil {
+			continue
+		}
+		pkgName, version, pkgArch, ok := parsePackageFilename(filepath.Base(file))
+		if !ok || pkgName != name || (arch != "" && pkgArch != arch && pkgArch != "any") {
+			continue
+		}
+		versions = append(versions, packageVersion{Version: version, Source: dir + m[1]})
+	}
+	return versions, nil
+}
+
+// cachedVersions lists the versions of a package in the package cache
+func (a *ArchMaintenance) cachedVersions(name, arch string) ([]packageVersion, error) {
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		return nil, err
+	}
+	var versions []packageVersion
+	for _, pkg := range cache {
+		if pkg.Name == name && (arch == "" || pkg.Arch == arch || pkg.Arch == "any") {
+			versions = append(versions, packageVersion{Version: pkg.Version, Source: pkg.Path, Cached: true})
+		}
+	}
+	return versions, nil
+}
+
+// availableVersions merges the cached and archived versions of a package,
+// newest first. A cached copy wins over the archive.
+func (a *ArchMaintenance) availableVersions(name, arch string) ([]packageVersion, error) {
+	cached, err := a.cachedVersions(name, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var versions []packageVersion
+	for _, v := range cached {
+		if !seen[v.Version] {
+			seen[v.Version] = true
+			versions = append(versions, v)
+		}
+	}
+
+	if a.config.ArchiveURL != "" {
+		archived, err := a.archiveVersions(name, arch)
+		if err != nil {
+			warningColor.Printf("Could not list the archive: %v\n", err)
+		}
+		for _, v := range archived {
+			if !seen[v.Version] {
+				seen[v.Version] = true
+				versions = append(versions, v)
+			}
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return vercmp.Compare(versions[i].Version, versions[j].Version) > 0
+	})
+	return versions, nil
+}
+
+// brokenDependents lists the installed packages whose dependencies on the
+// given packages the new versions would no longer satisfy. Packages in skip
+// are being changed as well and are not checked.
+func brokenDependents(local []*pacmandb.Package, versions map[string]string, skip []string) []string {
+	var broken []string
+	for _, pkg := range local {
+		if contains(skip, pkg.Name) {
+			continue
+		}
+		for _, dep := range pkg.Depends {
+			name := pacmandb.DepName(dep)
+			if version, ok := versions[name]; ok && !pacmandb.Satisfies(dep, name, version) {
+				broken = append(broken, fmt.Sprintf("%s (requires %s)", pkg.Name, dep))
+			}
+		}
+	}
+	return broken
+}
+
+// warnBrokenDependents prints what brokenDependents finds and reports
+// whether there was anything
+func (a *ArchMaintenance) warnBrokenDependents(versions map[string]string, skip []string) bool {
+	local, err := a.packageDB().Local()
+	if err != nil {
+		warningColor.Printf("Could not check dependents: %v\n", err)
+		return false
+	}
+	broken := brokenDependents(local, versions, skip)
+	if len(broken) == 0 {
+		return false
+	}
+	warningColor.Println("\nThese installed packages require other versions; pacman will refuse unless they change too:")
+	for _, dep := range broken {
+		fmt.Printf("  • %s\n", dep)
+	}
+	return true
+}
+
+// installedPackage looks up a package in the local database
+func (a *ArchMaintenance) installedPackage(name string) (*pacmandb.Package, error) {
+	local, err := a.packageDB().Local()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range local {
+		if pkg.Name == name {
+			return pkg, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not installed", name)
+}
+
+func (a *ArchMaintenance) downgradePackage(name, version string, ignore bool) {
+	headerColor.Printf("\n=== DOWNGRADE %s ===\n", strings.ToUpper(name))
+
+	installed, err := a.installedPackage(name)
+	if err != nil {
+		errorColor.Println(err)
+		a.status.failures++
+		return
+	}
+	infoColor.Printf("Installed: %s %s\n", name, installed.Version)
+
+	versions, err := a.availableVersions(name, installed.Arch)
+	if err != nil {
+		errorColor.Printf("Failed to read the package cache: %v\n", err)
+		a.status.failures++
+		return
+	}
+
+	var selected *packageVersion
+	if version != "" {
+		for i := range versions {
+			if versions[i].Version == version {
+				selected = &versions[i]
+			}
+		}
+		if selected == nil {
+			errorColor.Printf("%s %s is neither in the package cache nor in the archive\n", name, version)
+			a.status.failures++
+			return
+		}
+	} else {
+		selected = a.chooseVersion(name, installed.Version, versions)
+		if selected == nil {
+			return
+		}
+	}
+
+	if selected.Version == installed.Version {
+		successColor.Printf("%s %s is already installed.\n", name, selected.Version)
+		return
+	}
+
+	fmt.Printf("\n%s %s -> %s from %s\n", name, installed.Version, selected.Version, selected.Source)
+	// pacman -U takes missing dependencies from the sync databases
+	if a.refusePartialUpgrade() {
+		return
+	}
+	broken := a.warnBrokenDependents(map[string]string{name: selected.Version}, nil)
+	if !a.proceed(fmt.Sprintf("Install %s %s?", name, selected.Version), broken) {
+		return
+	}
+
+	failures := a.status.failures
+	a.runCommand("sudo", "pacman", "-U", "--noconfirm", selected.Source)
+	if a.status.failures != failures {
+		return
+	}
+	if !a.config.DryRun {
+		successColor.Printf("Installed %s %s\n", name, selected.Version)
+	}
+
+	if ignore {
+		a.addIgnorePkg([]string{name})
+	} else {
+		infoColor.Printf("The next upgrade replaces it again; pass --ignore to add %s to IgnorePkg.\n", name)
+	}
+	a.waitForContinue()
+}
+
+// chooseVersion lists versions and asks for one. It returns nil when the
+// choice is cancelled or cannot be made.
+func (a *ArchMaintenance) chooseVersion(name, installed string, versions []packageVersion) *packageVersion {
+	if len(versions) == 0 {
+		errorColor.Printf("No other versions of %s found\n", name)
+		a.status.failures++
+		return nil
+	}
+
+	// Every cached version, then the newest archived ones
+	var shown []int
+	archived := 0
+	for i, v := range versions {
+		if v.Cached {
+			shown = append(shown, i)
+		} else if archived++; archived <= archiveShown {
+			shown = append(shown, i)
+		}
+	}
+
+	fmt.Println("\nAvailable versions:")
+	for n, i := range shown {
+		v := versions[i]
+		source := "archive"
+		if v.Cached {
+			source = "cache"
+		}
+		line := fmt.Sprintf("  %d. %-24s %s", n+1, v.Version, source)
+		if v.Version == installed {
+			successColor.Println(line + " (installed)")
+		} else {
+			fmt.Println(line)
+		}
+	}
+	if archived > archiveShown {
+		infoColor.Printf("  %d older versions in %s\n", archived-archiveShown, a.archiveDir(name))
+	}
+
+	if a.config.NonInteractive {
+		errorColor.Println("Non-interactive downgrade needs a version")
+		a.status.failures++
+		return nil
+	}
+
+	fmt.Print("\nSelect version to install (0 to cancel): ")
+	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	choice := parseInt(strings.TrimSpace(input))
+	if choice <= 0 || choice > len(shown) {
+		infoColor.Println("Downgrade cancelled.")
+		a.status.aborted = true
+		return nil
+	}
+	return &versions[shown[choice-1]]
+}
+
+// withIgnorePkg adds names to the IgnorePkg directive of a pacman.conf,
+// creating the directive in [options] when there is none
+func withIgnorePkg(conf string, names []string) string {
+	lines := strings.Split(conf, "\n")
+	section, options, commented := "", -1, -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section = strings.Trim(trimmed, "[]")
+			if section == "options" {
+				options = i
+			}
+			continue
+		}
+		if section != "options" {
+			continue
+		}
+		key, _, _ := strings.Cut(trimmed, "=")
+		switch strings.TrimSpace(key) {
+		case "IgnorePkg":
+			value, comment, _ := strings.Cut(line, "#")
+			lines[i] = strings.TrimRight(value, " \t") + " " + strings.Join(names, " ")
+			if comment != "" {
+				lines[i] += " #" + comment
+			}
+			return strings.Join(lines, "\n")
+		case "#IgnorePkg":
+			commented = i
+		}
+	}
+
+	directive := "IgnorePkg   = " + strings.Join(names, " ")
+	switch {
+	case commented >= 0:
+		options = commented
+	case options < 0:
+		return "[options]\n" + directive + "\n\n" + conf
+	}
+	lines = append(lines[:options+1], append([]string{directive}, lines[options+1:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+// addIgnorePkg adds packages to IgnorePkg in pacman.conf so upgrades leave
+// them alone. The old file is backed up first.
+func (a *ArchMaintenance) addIgnorePkg(names []string) {
+	path := filepath.Join(a.config.PacmanRoot, "etc/pacman.conf")
+
+	var add []string
+	if conf, err := a.packageDB().Conf(); err == nil {
+		for _, name := range names {
+			if !contains(conf.Options["IgnorePkg"], name) {
+				add = append(add, name)
+			}
+		}
+	} else {
+		add = names
+	}
+	if len(add) == 0 {
+		infoColor.Printf("%s already in IgnorePkg\n", strings.Join(names, ", "))
+		return
+	}
+
+	if a.config.DryRun {
+		fmt.Printf("  Would add %s to IgnorePkg in %s\n", strings.Join(add, " "), path)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errorColor.Printf("Could not read %s: %v\n", path, err)
+		a.status.failures++
+		return
+	}
+	if a.replaceConfigFile(path, []byte(withIgnorePkg(string(data), add))) {
+		successColor.Printf("Added %s to IgnorePkg\n", strings.Join(add, " "))
+	}
+}
+
+// rollbackStep is one package change needed to undo a transaction
+type rollbackStep struct {
+	Change pacmanlog.Change
+	// Source is the cached package to install; empty for removals
+	Source string
+}
+
+// rollbackPlan works out how to undo tx with the package cache. Packages
+// changed again by a later transaction are skipped, and changes whose old
+// version is not cached are returned as missing.
+func (a *ArchMaintenance) rollbackPlan(tx pacmanlog.Transaction) (steps []rollbackStep, skipped, missing []string, err error) {
+	installed, err := a.installedVersions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cached := func(name, version string) string {
+		for _, pkg := range cache {
+			if pkg.Name == name && pkg.Version == version {
+				return pkg.Path
+			}
+		}
+		return ""
+	}
+
+	for _, change := range tx.Changes {
+		current, isInstalled := installed[change.Package]
+		switch change.Action {
+		case pacmanlog.Reinstalled:
+			continue
+		case pacmanlog.Installed:
+			if !isInstalled || current != change.NewVersion {
+				skipped = append(skipped, change.Package)
+				continue
+			}
+			steps = append(steps, rollbackStep{Change: change})
+			continue
+		case pacmanlog.Removed:
+			if isInstalled {
+				skipped = append(skipped, change.Package)
+				continue
+			}
+		default:
+			if !isInstalled || current != change.NewVersion {
+				skipped = append(skipped, change.Package)
+				continue
+			}
+		}
+
+		source := cached(change.Package, change.OldVersion)
+		if source == "" {
+			missing = append(missing, change.Package+" "+change.OldVersion)
+			continue
+		}
+		steps = append(steps, rollbackStep{Change: change, Source: source})
+	}
+	return steps, skipped, missing, nil
+}
+
+func (a *ArchMaintenance) rollbackTransaction(id int) {
+	headerColor.Printf("\n=== ROLLBACK TRANSACTION #%d ===\n", id)
+
+	txs, err := a.transactions()
+	if err != nil {
+		errorColor.Printf("Failed to read the pacman log: %v\n", err)
+		a.status.failures++
+		return
+	}
+	var tx *pacmanlog.Transaction
+	for i := range txs {
+		if txs[i].ID == id {
+			tx = &txs[i]
+		}
+	}
+	if tx == nil {
+		errorColor.Printf("No transaction #%d in %s; see 'archmaint history'\n", id, a.pacmanLogPath())
+		a.status.failures++
+		return
+	}
+
+	fmt.Printf("%s  %s", tx.Started.Local().Format("2006-01-02 15:04"), tx.Command)
+	if tx.Status != pacmanlog.Completed {
+		warningColor.Printf(" [%s]", tx.Status)
+	}
+	fmt.Println()
+
+	steps, skipped, missing, err := a.rollbackPlan(*tx)
+	if err != nil {
+		errorColor.Printf("Failed to plan the rollback: %v\n", err)
+		a.status.failures++
+		return
+	}
+
+	if len(skipped) > 0 {
+		warningColor.Printf("Changed again since, left alone: %s\n", strings.Join(skipped, ", "))
+	}
+	if len(missing) > 0 {
+		errorColor.Println("Not in the package cache:")
+		for _, pkg := range missing {
+			fmt.Printf("  • %s\n", pkg)
+		}
+		infoColor.Println("'archmaint downgrade <pkg> <version>' can install them from the archive.")
+		a.status.failures++
+		return
+	}
+	if len(steps) == 0 {
+		successColor.Println("Nothing to roll back.")
+		return
+	}
+
+	var files, remove, changed []string
+	versions := make(map[string]string)
+	fmt.Println("\nRollback plan:")
+	for _, step := range steps {
+		change := step.Change
+		changed = append(changed, change.Package)
+		if step.Source == "" {
+			remove = append(remove, change.Package)
+			errorColor.Printf("  remove      %s %s\n", change.Package, change.NewVersion)
+			continue
+		}
+		files = append(files, step.Source)
+		versions[change.Package] = change.OldVersion
+		if change.Action == pacmanlog.Removed {
+			successColor.Printf("  install     %s %s\n", change.Package, change.OldVersion)
+		} else {
+			fmt.Printf("  revert      %s %s -> %s\n", change.Package, change.NewVersion, change.OldVersion)
+		}
+	}
+
+	if len(files) > 0 && a.refusePartialUpgrade() {
+		return
+	}
+	a.warnBrokenDependents(versions, changed)
+	if !a.proceed(fmt.Sprintf("Roll back transaction #%d?", id), true) {
+		return
+	}
+
+	failures := a.status.failures
+	if len(files) > 0 {
+		a.runCommand("sudo", append([]string{"pacman", "-U", "--noconfirm"}, files...)...)
+	}
+	if len(remove) > 0 && a.status.failures == failures {
+		a.runCommand("sudo", append([]string{"pacman", "-R", "--noconfirm"}, remove...)...)
+	}
+	if a.status.failures == failures && !a.config.DryRun {
+		successColor.Printf("Rolled back transaction #%d\n", id)
+	}
+	a.waitForContinue()
+}
+
+// rollbackArgs reads the transaction number of the rollback command line
+func rollbackArgs(inv *invocation) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(inv.arg(0), "#"))
+	if err != nil || id <= 0 {
+		return 0, usagef("rollback expects a transaction number from 'archmaint history', got %q", inv.arg(0))
+	}
+	return id, nil
+}
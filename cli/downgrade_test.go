@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// downgradeFixture installs the testdata system into a root of its own,
+// with the pacman.log of testdata/root and the given package cache files.
+// With current set the sync databases hold nothing newer than the system.
+func downgradeFixture(t *testing.T, a *ArchMaintenance, current bool, cache ...string) string {
+	t.Helper()
+	syncFixture(t, a)
+	if current {
+		for _, repo := range []string{"core", "extra"} {
+			packSyncDB(t, t.TempDir(), filepath.Join(a.config.PacmanDBPath, "sync", repo+".db"))
+		}
+	}
+
+	root := t.TempDir()
+	log, err := os.ReadFile(filepath.Join(a.config.PacmanRoot, "var/log/pacman.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "var/log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "var/log/pacman.log"), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "var/cache/pacman/pkg")
+	files := make(map[string]int)
+	for _, file := range cache {
+		files[file] = 1
+	}
+	writeCache(t, dir, files)
+	a.config.PacmanRoot = root
+	a.config.ArchiveURL = ""
+	a.config.AllowDangerous = true
+	return dir
+}
+
+func TestDowngrade(t *testing.T) {
+	// No sync package is newer, so pacman -Qu decides
+	fake := NewFakeRunner().On("pacman -Qu", FakeResponse{ExitCode: 1})
+	a := newTestApp(t, fake)
+	cache := downgradeFixture(t, a, true, "vim-9.0.0-1-x86_64.pkg.tar.zst")
+	pkg := filepath.Join(cache, "vim-9.0.0-1-x86_64.pkg.tar.zst")
+	fake.On("sudo pacman -U --noconfirm "+pkg, FakeResponse{})
+
+	a.downgradePackage("vim", "9.0.0-1", false)
+
+	assertCommands(t, fake, "pacman -Qu", "sudo pacman -U --noconfirm "+pkg)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestDowngradeRefusesPartialUpgrade(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	downgradeFixture(t, a, false, "vim-9.0.0-1-x86_64.pkg.tar.zst")
+
+	a.downgradePackage("vim", "9.0.0-1", false)
+
+	if commands := fake.Commands(); len(commands) > 0 {
+		t.Errorf("ran %q over outdated packages", commands)
+	}
+	if code := a.status.exitCode(); code != exitFailure {
+		t.Errorf("exit code = %d, want %d", code, exitFailure)
+	}
+}
+
+func TestRollbackRefusesPartialUpgrade(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	// Transaction #1 upgraded bash from 5.2.026-1
+	downgradeFixture(t, a, false, "bash-5.2.026-1-x86_64.pkg.tar.zst")
+
+	a.rollbackTransaction(1)
+
+	if commands := fake.Commands(); len(commands) > 0 {
+		t.Errorf("ran %q over outdated packages", commands)
+	}
+	if code := a.status.exitCode(); code != exitFailure {
+		t.Errorf("exit code = %d, want %d", code, exitFailure)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	fake := NewFakeRunner().On("pacman -Qu", FakeResponse{ExitCode: 1})
+	a := newTestApp(t, fake)
+	cache := downgradeFixture(t, a, true, "bash-5.2.026-1-x86_64.pkg.tar.zst")
+	pkg := filepath.Join(cache, "bash-5.2.026-1-x86_64.pkg.tar.zst")
+	fake.On("sudo pacman -U --noconfirm "+pkg, FakeResponse{})
+
+	a.rollbackTransaction(1)
+
+	// pacman-mirrorlist is no longer installed and is left alone
+	assertCommands(t, fake, "pacman -Qu", "sudo pacman -U --noconfirm "+pkg)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promFileName is the file written into the node_exporter textfile directory
+const promFileName = "archmaint.prom"
+
+// exportFormats are the targets of archmaint export
+var exportFormats = []string{"prometheus"}
+
+// promMetric is one gauge family in the Prometheus text exposition format
+type promMetric struct {
+	name    string
+	help    string
+	samples []promSample
+}
+
+type promSample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (m *promMetric) add(value float64, labels ...[2]string) {
+	m.samples = append(m.samples, promSample{labels: labels, value: value})
+}
+
+func label(name, value string) [2]string {
+	return [2]string{name, value}
+}
+
+// escapePromLabel escapes a label value as the exposition format requires
+func escapePromLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writePromMetrics(w io.Writer, metrics []*promMetric) error {
+	for _, m := range metrics {
+		if len(m.samples) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for _, s := range m.samples {
+			line := m.name
+			if len(s.labels) > 0 {
+				pairs := make([]string, len(s.labels))
+				for i, l := range s.labels {
+					pairs[i] = fmt.Sprintf(`%s="%s"`, l[0], escapePromLabel(l[1]))
+				}
+				line += "{" + strings.Join(pairs, ",") + "}"
+			}
+			if _, err := fmt.Fprintf(w, "%s %s\n", line, strconv.FormatFloat(s.value, 'f', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// metricName turns a check name such as "Disk Space" into "disk_space"
+func metricName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+}
+
+// healthStatusValue maps a status onto the plugin exit code convention:
+// 0 ok, 1 warn, 2 critical, 3 unknown
+func healthStatusValue(status HealthStatus) float64 {
+	switch status {
+	case HealthOK:
+		return 0
+	case HealthWarn:
+		return 1
+	case HealthCritical:
+		return 2
+	}
+	return 3
+}
+
+// prometheusMetrics gathers the same data as status and health. Values that
+// could not be determined are left out rather than reported as zero.
+func (a *ArchMaintenance) prometheusMetrics() []*promMetric {
+	updates := &promMetric{name: "archmaint_pending_updates", help: "Packages with a pending update."}
+	orphans := &promMetric{name: "archmaint_orphan_packages", help: "Installed packages no longer required by any other."}
+	installed := &promMetric{name: "archmaint_installed_packages", help: "Installed packages."}
+	explicit := &promMetric{name: "archmaint_explicit_packages", help: "Explicitly installed packages."}
+	failedUnits := &promMetric{name: "archmaint_failed_units", help: "Systemd units in the failed state."}
+	score := &promMetric{name: "archmaint_health_score", help: "Weighted health score from 0 to 100."}
+	checkStatus := &promMetric{name: "archmaint_health_check_status", help: "Health check status: 0 ok, 1 warn, 2 critical, 3 unknown."}
+	checkValue := &promMetric{name: "archmaint_health_check_value", help: "Value measured by a health check."}
+	diskUsed := &promMetric{name: "archmaint_disk_used_percent", help: "Used space of a mounted filesystem in percent."}
+	backupTime := &promMetric{name: "archmaint_last_backup_timestamp_seconds", help: "Unix time of the newest backup."}
+	backupAge := &promMetric{name: "archmaint_last_backup_age_seconds", help: "Age of the newest backup when the metrics were written."}
+	reboot := &promMetric{name: "archmaint_reboot_required", help: "1 when the running kernel is outdated or a kernel, systemd, glibc or microcode package was upgraded since boot."}
+	lastRun := &promMetric{name: "archmaint_last_run_timestamp_seconds", help: "Unix time at which these metrics were written."}
+
+	now := time.Now()
+
+	counts := a.packageCounts()
+	for _, c := range []struct {
+		metric *promMetric
+		count  int
+	}{{updates, counts.Updates}, {orphans, counts.Orphans}, {installed, counts.Installed}, {explicit, counts.Explicit}} {
+		if c.count >= 0 {
+			c.metric.add(float64(c.count))
+		}
+	}
+
+	health := a.runHealthChecks()
+	if health.Total > health.Unknown {
+		score.add(float64(health.Score))
+	}
+	for _, result := range health.Checks {
+		check := metricName(result.Name)
+		checkStatus.add(healthStatusValue(result.Status), label("check", check))
+		if result.Metric != nil && result.Status != HealthUnknown {
+			checkValue.add(result.Metric.Value, label("check", check), label("unit", result.Metric.Unit))
+			if result.Name == "Failed Services" {
+				failedUnits.add(result.Metric.Value)
+			}
+		}
+	}
+
+	disks := a.diskUsage()
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Mount < disks[j].Mount })
+	for _, disk := range disks {
+		diskUsed.add(float64(disk.UsedPercent), label("mount", disk.Mount), label("device", disk.Filesystem))
+	}
+
+	if backups, err := a.backups(); err == nil && len(backups.Backups) > 0 {
+		newest := backups.Backups[0].Created
+		backupTime.add(float64(newest.Unix()))
+		backupAge.add(now.Sub(newest).Seconds())
+	}
+
+	if needed, known := a.rebootStatus(); known {
+		value := 0.0
+		if needed {
+			value = 1
+		}
+		reboot.add(value)
+	}
+
+	lastRun.add(float64(now.Unix()))
+
+	return []*promMetric{
+		updates, orphans, installed, explicit, failedUnits,
+		score, checkStatus, checkValue, diskUsed,
+		backupTime, backupAge, reboot, lastRun,
+	}
+}
+
+// exportPrometheus writes the metrics to stdout, or atomically replaces
+// archmaint.prom in dir for the node_exporter textfile collector
+func (a *ArchMaintenance) exportPrometheus(dir string) error {
+	metrics := a.prometheusMetrics()
+
+	if dir == "" {
+		return writePromMetrics(os.Stdout, metrics)
+	}
+
+	var data strings.Builder
+	if err := writePromMetrics(&data, metrics); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, promFileName)
+	if err := writeFileAtomic(path, []byte(data.String()), 0644); err != nil {
+		return err
+	}
+	infoColor.Printf("Wrote %s\n", path)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// maxHealthRuns bounds the health history file; older runs are dropped
+const maxHealthRuns = 500
+
+// defaultStatePath is where archmaint keeps state between runs:
+// /var/lib/archmaint for root, ~/.archmaint for everyone else
+func defaultStatePath(homeDir string) string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/archmaint"
+	}
+	return filepath.Join(homeDir, ".archmaint")
+}
+
+func (a *ArchMaintenance) healthHistoryPath() string {
+	return filepath.Join(a.config.StatePath, "health-history.jsonl")
+}
+
+func newHealthRun(report HealthReport) HealthRun {
+	run := HealthRun{Time: time.Now().UTC().Truncate(time.Second), Score: report.Score}
+	for _, result := range report.Checks {
+		run.Checks = append(run.Checks, HealthRunCheck{
+			Name:   result.Name,
+			Status: result.Status,
+			Value:  result.Value,
+		})
+	}
+	return run
+}
+
+// loadHealthHistory reads every recorded run, oldest first. A missing
+// history is empty; unreadable lines are skipped.
+func (a *ArchMaintenance) loadHealthHistory() ([]HealthRun, error) {
+	f, err := os.Open(a.healthHistoryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []HealthRun
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var run HealthRun
+		if err := json.Unmarshal(scanner.Bytes(), &run); err == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, scanner.Err()
+}
+
+func (a *ArchMaintenance) lastHealthRun() (*HealthRun, error) {
+	runs, err := a.loadHealthHistory()
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[len(runs)-1], nil
+}
+
+// recordHealthRun appends report to the history. Dry runs leave no trace.
+func (a *ArchMaintenance) recordHealthRun(report HealthReport) {
+	if a.config.DryRun {
+		return
+	}
+
+	runs, err := a.loadHealthHistory()
+	if err == nil {
+		runs = append(runs, newHealthRun(report))
+		if len(runs) > maxHealthRuns {
+			runs = runs[len(runs)-maxHealthRuns:]
+		}
+
+		var data strings.Builder
+		for _, run := range runs {
+			line, _ := json.Marshal(run)
+			data.Write(line)
+			data.WriteByte('\n')
+		}
+
+		if err = os.MkdirAll(a.config.StatePath, 0755); err == nil {
+			err = writeFileAtomic(a.healthHistoryPath(), []byte(data.String()), 0644)
+		}
+	}
+	if err != nil {
+		warningColor.Printf("Could not save health history: %v\n", err)
+	}
+}
+
+// healthStatusRank orders statuses from best to worst. Unknown ranks as
+// best so that a check that could not run never counts as a regression.
+func healthStatusRank(status HealthStatus) int {
+	switch status {
+	case HealthWarn:
+		return 1
+	case HealthCritical:
+		return 2
+	}
+	return 0
+}
+
+// healthRegressions lists the checks whose status got worse from previous
+// to current
+func healthRegressions(previous, current HealthRun) []HealthRegression {
+	before := make(map[string]HealthStatus)
+	for _, check := range previous.Checks {
+		before[check.Name] = check.Status
+	}
+
+	regressions := []HealthRegression{}
+	for _, check := range current.Checks {
+		old, ok := before[check.Name]
+		if !ok || old == HealthUnknown || check.Status == HealthUnknown {
+			continue
+		}
+		if healthStatusRank(check.Status) > healthStatusRank(old) {
+			regressions = append(regressions, HealthRegression{
+				Name:     check.Name,
+				Previous: old,
+				Current:  check.Status,
+				Value:    check.Value,
+			})
+		}
+	}
+	return regressions
+}
+
+// healthHistoryReport returns the last limit runs (all when limit is 0) and
+// the regressions between the two most recent ones
+func (a *ArchMaintenance) healthHistoryReport(limit int) (HealthHistoryReport, error) {
+	report := HealthHistoryReport{Runs: []HealthRun{}, Regressions: []HealthRegression{}}
+
+	runs, err := a.loadHealthHistory()
+	if err != nil {
+		return report, err
+	}
+	if n := len(runs); n >= 2 {
+		report.Regressions = healthRegressions(runs[n-2], runs[n-1])
+	}
+	if limit > 0 && len(runs) > limit {
+		runs = runs[len(runs)-limit:]
+	}
+	if runs != nil {
+		report.Runs = runs
+	}
+	return report, nil
+}
+
+func (a *ArchMaintenance) showHealthHistory(limit int) {
+	headerColor.Println("\n=== HEALTH HISTORY ===")
+
+	report, err := a.healthHistoryReport(limit)
+	if err != nil {
+		errorColor.Printf("Failed to read health history: %v\n", err)
+		a.status.failures++
+		return
+	}
+	if len(report.Runs) == 0 {
+		infoColor.Println("No health checks recorded yet. Run 'archmaint health' first.")
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Time", "Score", "Change", "Warn", "Critical", "Unknown"})
+	table.SetAutoWrapText(false)
+	for i, run := range report.Runs {
+		change := ""
+		if i > 0 {
+			change = fmt.Sprintf("%+d", run.Score-report.Runs[i-1].Score)
+		}
+		counts := make(map[HealthStatus]int)
+		for _, check := range run.Checks {
+			counts[check.Status]++
+		}
+		table.Append([]string{
+			run.Time.Local().Format("2006-01-02 15:04"),
+			fmt.Sprintf("%d%%", run.Score),
+			change,
+			fmt.Sprint(counts[HealthWarn]),
+			fmt.Sprint(counts[HealthCritical]),
+			fmt.Sprint(counts[HealthUnknown]),
+		})
+	}
+	table.Render()
+
+	first, last := report.Runs[0], report.Runs[len(report.Runs)-1]
+	switch delta := last.Score - first.Score; {
+	case len(report.Runs) < 2:
+	case delta > 0:
+		successColor.Printf("Trend: improving, %+d points over %d runs\n", delta, len(report.Runs))
+	case delta < 0:
+		errorColor.Printf("Trend: declining, %+d points over %d runs\n", delta, len(report.Runs))
+	default:
+		infoColor.Printf("Trend: steady over %d runs\n", len(report.Runs))
+	}
+
+	if len(report.Regressions) == 0 {
+		if len(report.Runs) > 1 {
+			successColor.Println("No checks regressed since the previous run.")
+		}
+		return
+	}
+	warningColor.Println("\nRegressed since the previous run:")
+	for _, r := range report.Regressions {
+		fmt.Printf("  %s: %s -> %s (%s)\n", r.Name, r.Previous, r.Current, r.Value)
+	}
+}
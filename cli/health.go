@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HealthStatus grades a single health check result
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthWarn     HealthStatus = "warn"
+	HealthCritical HealthStatus = "critical"
+	// HealthUnknown means the check could not measure anything, for
+	// example because the tool it relies on is missing. It is not a failure.
+	HealthUnknown HealthStatus = "unknown"
+)
+
+// HealthCheck is one check run by the health command
+type HealthCheck interface {
+	Name() string
+	Description() string
+	// Weight is the check's share of the health score relative to the
+	// other checks
+	Weight() int
+	Run(a *ArchMaintenance) HealthCheckResult
+}
+
+var healthRegistry []HealthCheck
+
+// RegisterHealthCheck adds a check to the health command. Checks run in
+// registration order and names must be unique.
+func RegisterHealthCheck(check HealthCheck) {
+	for _, registered := range healthRegistry {
+		if registered.Name() == check.Name() {
+			panic("health check registered twice: " + check.Name())
+		}
+	}
+	healthRegistry = append(healthRegistry, check)
+}
+
+// healthCheckFunc adapts a method of ArchMaintenance to HealthCheck
+type healthCheckFunc struct {
+	name   string
+	desc   string
+	weight int
+	fn     func(a *ArchMaintenance) HealthCheckResult
+}
+
+func (c healthCheckFunc) Name() string        { return c.name }
+func (c healthCheckFunc) Description() string { return c.desc }
+func (c healthCheckFunc) Weight() int         { return c.weight }
+func (c healthCheckFunc) Run(a *ArchMaintenance) HealthCheckResult {
+	return c.fn(a)
+}
+
+func init() {
+	RegisterHealthCheck(healthCheckFunc{"Disk Space", "Checking available disk space", 2, (*ArchMaintenance).checkDiskSpace})
+	RegisterHealthCheck(healthCheckFunc{"Memory Usage", "Checking memory usage", 1, (*ArchMaintenance).checkMemory})
+	RegisterHealthCheck(healthCheckFunc{"Failed Services", "Checking for failed services", 2, (*ArchMaintenance).checkServices})
+	RegisterHealthCheck(healthCheckFunc{"Package Database", "Verifying package database integrity", 3, (*ArchMaintenance).checkPackageDB})
+	RegisterHealthCheck(healthCheckFunc{"System Errors", "Checking for recent system errors", 1, (*ArchMaintenance).checkSystemErrors})
+	RegisterHealthCheck(healthCheckFunc{"Security Updates", "Checking for security updates", 3, (*ArchMaintenance).checkSecurityUpdates})
+	RegisterHealthCheck(healthCheckFunc{"Pacnew Files", "Checking for unresolved .pacnew files", 1, (*ArchMaintenance).checkPacnewFiles})
+	RegisterHealthCheck(healthCheckFunc{"Mirrors", "Checking mirror freshness", 1, (*ArchMaintenance).checkMirrorHealth})
+}
+
+// runHealthCheck runs one check and fills in its name, description, weight
+// and the Passed flag derived from its status
+func (a *ArchMaintenance) runHealthCheck(check HealthCheck) HealthCheckResult {
+	result := check.Run(a)
+	result.Name = check.Name()
+	result.Description = check.Description()
+	result.Weight = check.Weight()
+	if result.Weight <= 0 {
+		result.Weight = 1
+	}
+	if result.Status == "" {
+		result.Status = HealthUnknown
+	}
+	result.Passed = result.Status == HealthOK || result.Status == HealthWarn
+	return result
+}
+
+// newHealthReport scores a set of check results
+func newHealthReport(results []HealthCheckResult) HealthReport {
+	report := HealthReport{Total: len(results), Checks: results}
+	earned, possible := 0, 0
+	for _, result := range results {
+		switch result.Status {
+		case HealthOK:
+			report.Passed++
+			earned += 2 * result.Weight
+		case HealthWarn:
+			report.Passed++
+			report.Warnings++
+			earned += result.Weight
+		case HealthCritical:
+			report.Critical++
+		default:
+			report.Unknown++
+			continue
+		}
+		possible += 2 * result.Weight
+	}
+	if possible > 0 {
+		report.Score = earned * 100 / possible
+	}
+	return report
+}
+
+// healthReport runs every registered check and records the run in the
+// health history
+func (a *ArchMaintenance) healthReport() HealthReport {
+	report := a.runHealthChecks()
+	if report.Critical > 0 {
+		a.status.healthFailed = true
+	}
+	a.recordHealthRun(report)
+	return report
+}
+
+// runHealthChecks runs every registered check without recording anything
+func (a *ArchMaintenance) runHealthChecks() HealthReport {
+	var results []HealthCheckResult
+	for _, check := range healthRegistry {
+		results = append(results, a.runHealthCheck(check))
+	}
+	return newHealthReport(results)
+}
+
+func (a *ArchMaintenance) systemHealthCheck() {
+	headerColor.Println("\n=== SYSTEM HEALTH CHECK ===")
+
+	totalChecks := len(healthRegistry)
+	var results []HealthCheckResult
+
+	for i, check := range healthRegistry {
+		fmt.Printf("\n[%d/%d] %s\n", i+1, totalChecks, check.Name())
+		infoColor.Printf("     %s...\n", check.Description())
+
+		result := a.runHealthCheck(check)
+		results = append(results, result)
+		printHealthResult(result)
+	}
+
+	fmt.Println()
+	fmt.Println(strings.Repeat("=", 50))
+
+	report := newHealthReport(results)
+	if report.Critical > 0 {
+		a.status.healthFailed = true
+	}
+
+	summary := fmt.Sprintf("Health Score: %d%% (%d/%d checks passed", report.Score, report.Passed, totalChecks)
+	if report.Unknown > 0 {
+		summary += fmt.Sprintf(", %d unknown", report.Unknown)
+	}
+	summary += ")"
+
+	previous, _ := a.lastHealthRun()
+	a.recordHealthRun(report)
+
+	if report.Critical == 0 && report.Warnings == 0 {
+		successColor.Println(summary)
+	} else if report.Score >= 80 {
+		warningColor.Println(summary)
+	} else {
+		errorColor.Println(summary)
+	}
+
+	if previous != nil {
+		regressions := healthRegressions(*previous, newHealthRun(report))
+		if len(regressions) > 0 {
+			warningColor.Println("\nRegressed since the last run:")
+			for _, r := range regressions {
+				fmt.Printf("  %s: %s -> %s (%s)\n", r.Name, r.Previous, r.Current, r.Value)
+			}
+		}
+	}
+
+	a.waitForContinue()
+}
+
+func printHealthResult(result HealthCheckResult) {
+	switch result.Status {
+	case HealthOK:
+		successColor.Printf("     OK (%s)\n", result.Value)
+	case HealthWarn:
+		warningColor.Printf("     WARNING (%s; %s)\n", result.Value, result.Threshold)
+	case HealthCritical:
+		errorColor.Printf("     FAILED (%s; %s)\n", result.Value, result.Threshold)
+	default:
+		infoColor.Printf("     UNKNOWN\n")
+	}
+	if result.Message != "" {
+		fmt.Printf("     %s\n", result.Message)
+	}
+	if result.Hint != "" && result.Status != HealthOK {
+		infoColor.Printf("     Hint: %s\n", result.Hint)
+	}
+}
+
+// gradeMetric sets the status of result from a measured value. label names
+// the value in plugin perfdata.
+func gradeMetric(result *HealthCheckResult, label string, value, warn, critical float64, unit string) {
+	result.Metric = &HealthMetric{Label: label, Value: value, Unit: unit, Warn: warn, Critical: critical}
+	switch {
+	case value >= critical:
+		result.Status = HealthCritical
+	case value >= warn:
+		result.Status = HealthWarn
+	default:
+		result.Status = HealthOK
+	}
+}
+
+// unknownResult reports that a check could not run its query
+func unknownResult(threshold string, err error) HealthCheckResult {
+	return HealthCheckResult{
+		Status:    HealthUnknown,
+		Value:     "unknown",
+		Threshold: threshold,
+		Message:   err.Error(),
+	}
+}
+
+// toolFailed reports whether err means a command could not be run at all,
+// as opposed to running and exiting non-zero
+func toolFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, exited := err.(*ExitError)
+	return !exited
+}
+
+func (a *ArchMaintenance) checkDiskSpace() HealthCheckResult {
+	warn, critical := a.config.DiskWarnPercent, a.config.DiskCriticalPercent
+	threshold := fmt.Sprintf("warn at %d%%, critical at %d%%", warn, critical)
+
+	output, err := a.query("df", "-h", "/")
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+
+	lines := strings.Split(string(output), "\n")
+	if len(lines) > 1 {
+		fields := strings.Fields(lines[1])
+		if len(fields) >= 5 {
+			usage := parseInt(strings.TrimSuffix(fields[4], "%"))
+			result := HealthCheckResult{
+				Value:     fields[4] + " used",
+				Threshold: threshold,
+				Message:   fmt.Sprintf("%s of %s free on /", fields[3], fields[1]),
+				Hint:      "Free space with 'archmaint clean' or remove large files from /",
+			}
+			gradeMetric(&result, "disk_used", float64(usage), float64(warn), float64(critical), "%")
+			return result
+		}
+	}
+	return unknownResult(threshold, fmt.Errorf("unexpected df output"))
+}
+
+func (a *ArchMaintenance) checkMemory() HealthCheckResult {
+	warn, critical := a.config.MemoryWarnPercent, a.config.MemoryCriticalPercent
+	threshold := fmt.Sprintf("warn at %d%%, critical at %d%%", warn, critical)
+
+	output, err := a.query("free")
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+
+	lines := strings.Split(string(output), "\n")
+	if len(lines) > 1 {
+		fields := strings.Fields(lines[1])
+		if len(fields) >= 3 {
+			total := parseInt(fields[1])
+			used := parseInt(fields[2])
+			if total > 0 {
+				usage := used * 100 / total
+				result := HealthCheckResult{
+					Value:     fmt.Sprintf("%d%% used", usage),
+					Threshold: threshold,
+					Hint:      "Find the largest processes with 'ps aux --sort=-rss | head'",
+				}
+				gradeMetric(&result, "memory_used", float64(usage), float64(warn), float64(critical), "%")
+				return result
+			}
+		}
+	}
+	return unknownResult(threshold, fmt.Errorf("unexpected free output"))
+}
+
+func (a *ArchMaintenance) checkServices() HealthCheckResult {
+	threshold := "critical at 1 failed unit"
+
+	output, err := a.query("systemctl", "--failed", "--no-legend", "--plain")
+	if toolFailed(err) {
+		return unknownResult(threshold, err)
+	}
+
+	var units []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+
+	result := HealthCheckResult{
+		Value:     fmt.Sprintf("%d failed units", len(units)),
+		Threshold: threshold,
+		Hint:      "Inspect with 'systemctl status <unit>' or 'archmaint services'",
+	}
+	if len(units) > 0 {
+		result.Message = "Failed: " + strings.Join(units, ", ")
+	}
+	gradeMetric(&result, "failed_units", float64(len(units)), 1, 1, "units")
+	return result
+}
+
+func (a *ArchMaintenance) checkPackageDB() HealthCheckResult {
+	threshold := "pacman -Dk reports no errors"
+
+	output, err := a.query("pacman", "-Dk")
+	if toolFailed(err) {
+		return unknownResult(threshold, err)
+	}
+
+	result := HealthCheckResult{Status: HealthOK, Value: "consistent", Threshold: threshold}
+	if err != nil {
+		result.Status = HealthCritical
+		result.Value = "errors found"
+		result.Hint = "Run 'pacman -Dk' to see the inconsistencies"
+		if lines := strings.Split(strings.TrimSpace(string(output)), "\n"); lines[0] != "" {
+			result.Message = lines[0]
+		}
+	}
+	return result
+}
+
+func (a *ArchMaintenance) checkSystemErrors() HealthCheckResult {
+	warn, critical := a.config.JournalErrorsWarn, a.config.JournalErrorsCritical
+	threshold := fmt.Sprintf("warn at %d, critical at %d error entries today", warn, critical)
+
+	output, err := a.query("journalctl", "-p", "3", "--since", "today", "--no-pager", "--quiet")
+	if toolFailed(err) {
+		return unknownResult(threshold, err)
+	}
+
+	count := 0
+	if trimmed := strings.TrimSpace(string(output)); trimmed != "" {
+		count = len(strings.Split(trimmed, "\n"))
+	}
+
+	result := HealthCheckResult{
+		Value:     fmt.Sprintf("%d error entries today", count),
+		Threshold: threshold,
+		Hint:      "Review them with 'archmaint logs' or 'journalctl -p 3 -b'",
+	}
+	gradeMetric(&result, "journal_errors", float64(count), float64(warn), float64(critical), "entries")
+	return result
+}
+
+func (a *ArchMaintenance) checkSecurityUpdates() HealthCheckResult {
+	threshold := "no pending updates to " + strings.Join(criticalPackages, ", ")
+
+	dbPath, err := a.tempSyncDB()
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+	updates, err := a.pendingUpdates(dbPath)
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+
+	var pending []string
+	for _, update := range criticalUpdates(updates) {
+		pending = append(pending, fmt.Sprintf("%s %s", update.Name, update.NewVersion))
+	}
+
+	result := HealthCheckResult{
+		Value:     "none",
+		Threshold: threshold,
+		Hint:      "Install them with 'archmaint update'",
+	}
+	if len(pending) > 0 {
+		result.Value = strings.Join(pending, ", ")
+		result.Message = fmt.Sprintf("%d critical packages have pending updates", len(pending))
+	}
+	gradeMetric(&result, "critical_updates", float64(len(pending)), 1, 1, "packages")
+	return result
+}
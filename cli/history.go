@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"archmaint/internal/pacmanlog"
+)
+
+// rebootPackages are the packages whose upgrade only takes full effect
+// after a reboot
+var rebootPackages = []string{
+	"linux", "linux-lts", "linux-zen", "linux-hardened",
+	"systemd", "glibc", "amd-ucode", "intel-ucode",
+}
+
+// historyDateLayouts are accepted by history --since and --until
+var historyDateLayouts = []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05"}
+
+// transactions reads every transaction in pacman.log, oldest first
+func (a *ArchMaintenance) transactions() ([]pacmanlog.Transaction, error) {
+	return pacmanlog.ParseFile(a.pacmanLogPath())
+}
+
+// bootTime is when the running system started
+func (a *ArchMaintenance) bootTime() (time.Time, error) {
+	output, err := a.query("uptime", "-s")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", strings.TrimSpace(string(output)), time.Local)
+}
+
+// lastBackupTime is when the newest backup with a package list was taken
+func (a *ArchMaintenance) lastBackupTime() (time.Time, error) {
+	report, err := a.backups()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, backup := range report.Backups {
+		if contains(backup.Files, "packages_explicit.txt") {
+			return backupTime(backup.Name, backup.Created), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no backups in %s", a.config.BackupPath)
+}
+
+// backupTime reads the creation time from a backup directory name, falling
+// back to fallback for names archmaint did not generate
+func backupTime(name string, fallback time.Time) time.Time {
+	if t, err := time.ParseInLocation("2006-01-02_15-04-05", name, time.Local); err == nil {
+		return t
+	}
+	return fallback
+}
+
+// changesSince lists the package changes of completed transactions started
+// at or after since, oldest first
+func (a *ArchMaintenance) changesSince(since time.Time) ([]pacmanlog.Change, error) {
+	txs, err := a.transactions()
+	if err != nil {
+		return nil, err
+	}
+	var changes []pacmanlog.Change
+	for _, tx := range (pacmanlog.Filter{Since: since}).Apply(txs) {
+		if tx.Status == pacmanlog.Completed {
+			changes = append(changes, tx.Changes...)
+		}
+	}
+	return changes, nil
+}
+
+// summarizeChanges counts changes per action, e.g. "3 upgraded, 1 removed"
+func summarizeChanges(changes []pacmanlog.Change) string {
+	counts := make(map[pacmanlog.Action]int)
+	for _, change := range changes {
+		counts[change.Action]++
+	}
+	var parts []string
+	for _, action := range pacmanlog.Actions {
+		if counts[action] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[action], action))
+		}
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// upgradedSinceBoot lists the rebootPackages changed since the system
+// started. known is false when the boot time or the log is unavailable.
+func (a *ArchMaintenance) upgradedSinceBoot() (pkgs []string, known bool) {
+	boot, err := a.bootTime()
+	if err != nil {
+		return nil, false
+	}
+	changes, err := a.changesSince(boot)
+	if err != nil {
+		return nil, false
+	}
+	for _, change := range changes {
+		if contains(rebootPackages, change.Package) && !contains(pkgs, change.Package) {
+			pkgs = append(pkgs, change.Package)
+		}
+	}
+	return pkgs, true
+}
+
+func formatChange(change pacmanlog.Change) string {
+	switch change.Action {
+	case pacmanlog.Upgraded, pacmanlog.Downgraded:
+		return fmt.Sprintf("%s %s -> %s", change.Package, change.OldVersion, change.NewVersion)
+	case pacmanlog.Removed:
+		return fmt.Sprintf("%s %s", change.Package, change.OldVersion)
+	}
+	return fmt.Sprintf("%s %s", change.Package, change.NewVersion)
+}
+
+// historyArgs turns the history command line into a filter and a limit on
+// the number of transactions
+func (a *ArchMaintenance) historyArgs(inv *invocation) (pacmanlog.Filter, int, error) {
+	filter := pacmanlog.Filter{Package: inv.value("package")}
+
+	if action := inv.value("action"); action != "" {
+		if !strings.Contains(" "+joinActions()+",", " "+action+",") {
+			return filter, 0, usagef("--action expects one of %s, got %q", joinActions(), action)
+		}
+		filter.Action = pacmanlog.Action(action)
+	}
+
+	var err error
+	switch since := inv.value("since"); since {
+	case "":
+	case "boot":
+		if filter.Since, err = a.bootTime(); err != nil {
+			return filter, 0, fmt.Errorf("could not determine the boot time: %v", err)
+		}
+	case "backup":
+		if filter.Since, err = a.lastBackupTime(); err != nil {
+			return filter, 0, err
+		}
+	default:
+		if filter.Since, err = parseHistoryDate(since, false); err != nil {
+			return filter, 0, usagef("--since expects a date, 'boot' or 'backup', got %q", since)
+		}
+	}
+	if until := inv.value("until"); until != "" {
+		if filter.Until, err = parseHistoryDate(until, true); err != nil {
+			return filter, 0, usagef("--until expects a date, got %q", until)
+		}
+	}
+
+	limit := 20
+	if value := inv.value("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return filter, 0, usagef("--limit expects a number, got %q", value)
+		}
+		limit = n
+	}
+	return filter, limit, nil
+}
+
+// parseHistoryDate reads a date in local time. A bare day used as an upper
+// bound covers that whole day.
+func parseHistoryDate(value string, endOfDay bool) (time.Time, error) {
+	var err error
+	for _, layout := range historyDateLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			if endOfDay && layout == "2006-01-02" {
+				t = t.Add(24*time.Hour - time.Second)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func joinActions() string {
+	names := make([]string, len(pacmanlog.Actions))
+	for i, action := range pacmanlog.Actions {
+		names[i] = string(action)
+	}
+	return strings.Join(names, ", ")
+}
+
+// historyReport applies filter and keeps the newest limit transactions,
+// oldest first; limit 0 keeps all
+func (a *ArchMaintenance) historyReport(filter pacmanlog.Filter, limit int) (HistoryReport, error) {
+	report := HistoryReport{Log: a.pacmanLogPath(), Transactions: []pacmanlog.Transaction{}}
+	txs, err := a.transactions()
+	if err != nil {
+		return report, err
+	}
+	matched := filter.Apply(txs)
+	if limit > 0 && len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	report.Transactions = append(report.Transactions, matched...)
+	return report, nil
+}
+
+func (a *ArchMaintenance) showHistory(filter pacmanlog.Filter, limit int) {
+	headerColor.Println("\n=== PACKAGE HISTORY ===")
+
+	report, err := a.historyReport(filter, limit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			errorColor.Printf("No pacman log at %s\n", report.Log)
+		} else {
+			errorColor.Printf("Failed to read the pacman log: %v\n", err)
+		}
+		a.status.failures++
+		return
+	}
+
+	if !filter.Since.IsZero() {
+		infoColor.Printf("Since %s\n", filter.Since.Local().Format("2006-01-02 15:04"))
+	}
+	if len(report.Transactions) == 0 {
+		successColor.Println("No matching transactions.")
+		return
+	}
+
+	var all []pacmanlog.Change
+	for _, tx := range report.Transactions {
+		all = append(all, tx.Changes...)
+
+		status := ""
+		if tx.Status != pacmanlog.Completed {
+			status = " [" + string(tx.Status) + "]"
+		}
+		command := tx.Command
+		if command == "" {
+			command = "unknown command"
+		}
+		headerColor.Printf("\n#%d  %s  %s%s\n", tx.ID, tx.Started.Local().Format("2006-01-02 15:04"), command, status)
+
+		for _, change := range tx.Changes {
+			line := fmt.Sprintf("  %-11s %s", change.Action, formatChange(change))
+			switch change.Action {
+			case pacmanlog.Installed:
+				successColor.Println(line)
+			case pacmanlog.Removed:
+				errorColor.Println(line)
+			case pacmanlog.Downgraded:
+				warningColor.Println(line)
+			default:
+				fmt.Println(line)
+			}
+		}
+	}
+
+	fmt.Printf("\n%d transactions: %s\n", len(report.Transactions), summarizeChanges(all))
+	a.waitForContinue()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHistoryDate(t *testing.T) {
+	tests := []struct {
+		value    string
+		endOfDay bool
+		want     time.Time
+	}{
+		{"2024-06-01", false, time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)},
+		// A bare day as --until covers all of it
+		{"2024-06-01", true, time.Date(2024, 6, 1, 23, 59, 59, 0, time.Local)},
+		// A time of day is taken as given either way
+		{"2024-06-01 09:30", false, time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)},
+		{"2024-06-01 09:30", true, time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)},
+		{"2024-06-01T09:30:15", true, time.Date(2024, 6, 1, 9, 30, 15, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseHistoryDate(tt.value, tt.endOfDay)
+		if err != nil {
+			t.Errorf("parseHistoryDate(%q, %v): %v", tt.value, tt.endOfDay, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseHistoryDate(%q, %v) = %v, want %v", tt.value, tt.endOfDay, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday", "01/06/2024", "2024-06-01 9:30pm"} {
+		if _, err := parseHistoryDate(value, false); err == nil {
+			t.Errorf("parseHistoryDate(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pacmandb
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Conf is the part of pacman.conf that archmaint reads
+type Conf struct {
+	// Options holds the [options] directives. Repeated directives and
+	// space separated values accumulate; flags such as Color map to an
+	// empty list.
+	Options map[string][]string
+	// Repos lists the repository sections in declaration order
+	Repos []string
+}
+
+// Conf reads <Root>/etc/pacman.conf. Include directives are not followed.
+func (db *DB) Conf() (*Conf, error) {
+	f, err := os.Open(filepath.Join(db.Root, "etc/pacman.conf"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf := &Conf{Options: make(map[string][]string)}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			if section != "options" {
+				conf.Repos = append(conf.Repos, section)
+			}
+			continue
+		}
+		if section != "options" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		conf.Options[key] = append(conf.Options[key], strings.Fields(value)...)
+	}
+	return conf, scanner.Err()
+}
+
+// Ignores reports whether IgnorePkg or IgnoreGroup holds pkg back from
+// upgrades. Entries may be glob patterns, as in pacman. A nil Conf ignores
+// nothing.
+func (c *Conf) Ignores(pkg *Package) bool {
+	if c == nil {
+		return false
+	}
+	match := func(patterns []string, name string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if match(c.Options["IgnorePkg"], pkg.Name) {
+		return true
+	}
+	for _, group := range pkg.Groups {
+		if match(c.Options["IgnoreGroup"], group) {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheDirs returns the package cache directories, each below Root. Without
+// a CacheDir directive pacman uses <Root>/var/cache/pacman/pkg.
+func (db *DB) CacheDirs() []string {
+	var dirs []string
+	if conf, err := db.Conf(); err == nil {
+		for _, dir := range conf.Options["CacheDir"] {
+			dirs = append(dirs, filepath.Join(db.Root, dir))
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{filepath.Join(db.Root, "var/cache/pacman/pkg")}
+	}
+	return dirs
+}
@@ -0,0 +1,306 @@
+// Package pacmandb reads pacman's package databases directly.
+//
+// The local database is a directory per installed package under
+// <DBPath>/local, each holding a desc file of %FIELD% sections. The sync
+// databases are <DBPath>/sync/<repo>.db tar archives (optionally gzip
+// compressed) holding the same desc files for every package in a repository.
+// Root and DBPath are configurable so a fixture tree can stand in for the
+// real system.
+package pacmandb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"archmaint/internal/vercmp"
+)
+
+// Reason is why a package was installed
+type Reason int
+
+const (
+	// Explicit packages were installed on request
+	Explicit Reason = 0
+	// Dependency packages were pulled in by another package
+	Dependency Reason = 1
+)
+
+// Package is one entry of a local or sync database. Sizes are in bytes.
+type Package struct {
+	Name          string
+	Version       string
+	Base          string
+	Description   string
+	Arch          string
+	URL           string
+	Repo          string
+	Packager      string
+	Reason        Reason
+	InstallDate   time.Time
+	BuildDate     time.Time
+	InstalledSize int64
+	DownloadSize  int64
+	Groups        []string
+	Licenses      []string
+	Depends       []string
+	OptDepends    []string
+	Provides      []string
+	Conflicts     []string
+	Replaces      []string
+}
+
+// DB locates pacman's databases below a root directory
+type DB struct {
+	// Root is the installation root, "/" on a normal system
+	Root string
+	// DBPath holds local/ and sync/; empty means <Root>/var/lib/pacman
+	DBPath string
+}
+
+// New returns a DB for root and dbPath, either of which may be empty to
+// use the defaults
+func New(root, dbPath string) *DB {
+	if root == "" {
+		root = "/"
+	}
+	return &DB{Root: root, DBPath: dbPath}
+}
+
+// Path is the database directory: DBPath, or <Root>/var/lib/pacman
+func (db *DB) Path() string {
+	if db.DBPath != "" {
+		return db.DBPath
+	}
+	return filepath.Join(db.Root, "var/lib/pacman")
+}
+
+// Local reads every installed package, sorted by name
+func (db *DB) Local() ([]*Package, error) {
+	dir := filepath.Join(db.Path(), "local")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []*Package
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name(), "desc"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		pkg := &Package{}
+		err = parseDesc(f, pkg)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		if pkg.Name != "" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	return pkgs, nil
+}
+
+// parseDesc fills pkg from a desc (or old-style depends) file
+func parseDesc(r io.Reader, pkg *Package) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var field string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			field = ""
+			continue
+		}
+		if field == "" && len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			field = strings.Trim(line, "%")
+			continue
+		}
+		if field == "" {
+			continue
+		}
+		setField(pkg, field, line)
+	}
+	return scanner.Err()
+}
+
+func setField(pkg *Package, field, value string) {
+	switch field {
+	case "NAME":
+		pkg.Name = value
+	case "VERSION":
+		pkg.Version = value
+	case "BASE":
+		pkg.Base = value
+	case "DESC":
+		pkg.Description = value
+	case "ARCH":
+		pkg.Arch = value
+	case "URL":
+		pkg.URL = value
+	case "PACKAGER":
+		pkg.Packager = value
+	case "REASON":
+		if value == "1" {
+			pkg.Reason = Dependency
+		}
+	case "INSTALLDATE":
+		pkg.InstallDate = parseUnix(value)
+	case "BUILDDATE":
+		pkg.BuildDate = parseUnix(value)
+	case "SIZE", "ISIZE":
+		pkg.InstalledSize, _ = strconv.ParseInt(value, 10, 64)
+	case "CSIZE":
+		pkg.DownloadSize, _ = strconv.ParseInt(value, 10, 64)
+	case "GROUPS":
+		pkg.Groups = append(pkg.Groups, value)
+	case "LICENSE":
+		pkg.Licenses = append(pkg.Licenses, value)
+	case "DEPENDS":
+		pkg.Depends = append(pkg.Depends, value)
+	case "OPTDEPENDS":
+		pkg.OptDepends = append(pkg.OptDepends, value)
+	case "PROVIDES":
+		pkg.Provides = append(pkg.Provides, value)
+	case "CONFLICTS":
+		pkg.Conflicts = append(pkg.Conflicts, value)
+	case "REPLACES":
+		pkg.Replaces = append(pkg.Replaces, value)
+	}
+}
+
+func parseUnix(value string) time.Time {
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// DepName strips the version constraint and description from a depends,
+// optdepends or provides entry: "glibc>=2.38" and "python: scripting" give
+// "glibc" and "python"
+func DepName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=:"); i >= 0 {
+		dep = dep[:i]
+	}
+	return strings.TrimSpace(dep)
+}
+
+// Satisfies reports whether version of the package name meets a depends
+// entry such as "glibc>=2.38". Entries for other names never match; entries
+// without a constraint accept any version.
+func Satisfies(dep, name, version string) bool {
+	if DepName(dep) != name {
+		return false
+	}
+	i := strings.IndexAny(dep, "<>=")
+	if i < 0 {
+		return true
+	}
+	op := dep[i : i+1]
+	if i+1 < len(dep) && dep[i+1] == '=' {
+		op = dep[i : i+2]
+	}
+	cmp := vercmp.Compare(version, strings.TrimSpace(dep[i+len(op):]))
+	switch op {
+	case "=":
+		return cmp == 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return true
+}
+
+// Index maps package names, and the names they provide, to packages
+type Index map[string][]*Package
+
+// NewIndex indexes pkgs by name and provides
+func NewIndex(pkgs []*Package) Index {
+	index := make(Index)
+	for _, pkg := range pkgs {
+		index[pkg.Name] = append(index[pkg.Name], pkg)
+		for _, provide := range pkg.Provides {
+			if name := DepName(provide); name != pkg.Name {
+				index[name] = append(index[name], pkg)
+			}
+		}
+	}
+	return index
+}
+
+// Resolve returns the packages satisfying a dependency entry by name
+func (idx Index) Resolve(dep string) []*Package {
+	return idx[DepName(dep)]
+}
+
+// RequiredBy maps each package name to the names of the packages that
+// depend on it. With optional set, optdepends count as well.
+func RequiredBy(pkgs []*Package, optional bool) map[string][]string {
+	index := NewIndex(pkgs)
+	required := make(map[string][]string)
+
+	add := func(from *Package, deps []string) {
+		for _, dep := range deps {
+			for _, target := range index.Resolve(dep) {
+				if target != from && !containsString(required[target.Name], from.Name) {
+					required[target.Name] = append(required[target.Name], from.Name)
+				}
+			}
+		}
+	}
+
+	for _, pkg := range pkgs {
+		add(pkg, pkg.Depends)
+		if optional {
+			add(pkg, pkg.OptDepends)
+		}
+	}
+	return required
+}
+
+// Orphans returns the packages installed as dependencies that no installed
+// package requires, matching pacman -Qdt. With optional set, packages that
+// are only optionally required count as orphans too (pacman -Qdtt).
+func Orphans(pkgs []*Package, optional bool) []*Package {
+	required := RequiredBy(pkgs, !optional)
+	var orphans []*Package
+	for _, pkg := range pkgs {
+		if pkg.Reason == Dependency && len(required[pkg.Name]) == 0 {
+			orphans = append(orphans, pkg)
+		}
+	}
+	return orphans
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
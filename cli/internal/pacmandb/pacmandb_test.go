@@ -0,0 +1,281 @@
+package pacmandb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fixtureDB returns a DB over testdata: etc/pacman.conf declares core and
+// extra, local/ is the installed system and sync/<repo>/ holds the entries
+// packed into <repo>.db, gzip compressed like the real ones
+func fixtureDB(t *testing.T) *DB {
+	t.Helper()
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := t.TempDir()
+	if err := os.Symlink(filepath.Join(root, "local"), filepath.Join(dbPath, "local")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dbPath, "sync"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"core", "extra"} {
+		packSyncDB(t, filepath.Join(root, "sync", repo), filepath.Join(dbPath, "sync", repo+".db"))
+	}
+	return New(root, dbPath)
+}
+
+func packSyncDB(t *testing.T, src, dst string) {
+	t.Helper()
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == src {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if d.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: rel + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: rel, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(pkgs []*Package) []string {
+	out := []string{}
+	for _, pkg := range pkgs {
+		out = append(out, pkg.Name)
+	}
+	return out
+}
+
+func TestLocal(t *testing.T) {
+	local, err := New("testdata", "testdata").Local()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"base", "bash", "glibc", "libfoo", "pyfoo", "python", "python-pip", "readline", "vim", "yay-bin"}
+	if got := names(local); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Local() = %v, want %v", got, want)
+	}
+
+	bash := local[1]
+	if bash.Version != "5.2.026-2" || bash.Reason != Dependency {
+		t.Errorf("bash = %s reason %d, want 5.2.026-2 reason %d", bash.Version, bash.Reason, Dependency)
+	}
+	if want := []string{"glibc", "readline>=8.0"}; !reflect.DeepEqual(bash.Depends, want) {
+		t.Errorf("bash depends = %v, want %v", bash.Depends, want)
+	}
+	if want := []string{"sh"}; !reflect.DeepEqual(bash.Provides, want) {
+		t.Errorf("bash provides = %v, want %v", bash.Provides, want)
+	}
+	if bash.InstalledSize != 1048576 || !bash.InstallDate.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("bash size %d installed %v", bash.InstalledSize, bash.InstallDate)
+	}
+	if local[0].Reason != Explicit {
+		t.Errorf("base reason = %d, want %d", local[0].Reason, Explicit)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	local, err := New("testdata", "testdata").Local()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pacman -Qdt: python-pip is still optionally required by python, and
+	// libfoo is required by pyfoo even though pyfoo is an orphan itself
+	if got, want := names(Orphans(local, false)), []string{"pyfoo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Orphans(false) = %v, want %v", got, want)
+	}
+	// pacman -Qdtt counts packages that are only optionally required
+	if got, want := names(Orphans(local, true)), []string{"pyfoo", "python-pip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Orphans(true) = %v, want %v", got, want)
+	}
+}
+
+func TestRequiredBy(t *testing.T) {
+	local, err := New("testdata", "testdata").Local()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := RequiredBy(local, false)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"glibc", []string{"base", "bash", "libfoo", "python", "readline", "vim"}},
+		// base depends on sh, which bash provides
+		{"bash", []string{"base"}},
+		// a versioned depends entry
+		{"readline", []string{"bash"}},
+		{"libfoo", []string{"pyfoo"}},
+		{"python", []string{"pyfoo", "python-pip"}},
+		{"python-pip", nil},
+		{"base", nil},
+	}
+	for _, tt := range tests {
+		if got := required[tt.name]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("RequiredBy(false)[%s] = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	optional := RequiredBy(local, true)
+	if got, want := optional["python-pip"], []string{"python"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RequiredBy(true)[python-pip] = %v, want %v", got, want)
+	}
+}
+
+func TestRepos(t *testing.T) {
+	repos, err := fixtureDB(t).Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"core", "extra"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("Repos() = %v, want %v", repos, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	extra, err := fixtureDB(t).Sync("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"glibc", "libfoo", "pyfoo", "python", "python-pip", "vim"}
+	if got := names(extra); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Sync(extra) = %v, want %v", got, want)
+	}
+	vim := extra[5]
+	if vim.Repo != "extra" || vim.Version != "9.1.0-2" || vim.DownloadSize != 524288 || vim.InstalledSize != 1048576 {
+		t.Errorf("vim = %+v", vim)
+	}
+}
+
+func TestUpgrades(t *testing.T) {
+	db := fixtureDB(t)
+	local, err := db.Local()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err := db.AllSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, update := range Upgrades(local, sync) {
+		got = append(got, update.Local.Name+" "+update.Local.Version+" -> "+update.Sync.Version+" ["+update.Sync.Repo+"]")
+	}
+	// glibc comes from core, the first repository, although extra has a
+	// newer one; the older python-pip in extra is not an upgrade and
+	// yay-bin is in no repository
+	want := []string{
+		"glibc 2.38-7 -> 2.39-1 [core]",
+		"vim 9.1.0-1 -> 9.1.0-2 [extra]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Upgrades() = %v, want %v", got, want)
+	}
+}
+
+func TestCacheDirs(t *testing.T) {
+	root, _ := filepath.Abs("testdata")
+	got := New(root, "").CacheDirs()
+	if want := []string{filepath.Join(root, "var/cache/pacman/pkg")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CacheDirs() = %v, want %v", got, want)
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		dep, name, version string
+		want               bool
+	}{
+		{"glibc", "glibc", "2.38-7", true},
+		{"glibc>=2.38", "glibc", "2.38-7", true},
+		{"glibc>=2.39", "glibc", "2.38-7", false},
+		{"glibc<2.39", "glibc", "2.38-7", true},
+		{"glibc=2.38", "glibc", "2.38", true},
+		{"glibc>2.38", "glibc", "2.38", false},
+		{"glibc<=2.38", "glibc", "2.38", true},
+		{"bash>=5", "glibc", "2.38", false},
+	}
+	for _, tt := range tests {
+		if got := Satisfies(tt.dep, tt.name, tt.version); got != tt.want {
+			t.Errorf("Satisfies(%q, %q, %q) = %v, want %v", tt.dep, tt.name, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestDepName(t *testing.T) {
+	tests := map[string]string{
+		"glibc":                          "glibc",
+		"glibc>=2.38":                    "glibc",
+		"libreadline.so=8-64":            "libreadline.so",
+		"python-pip: the Python package": "python-pip",
+	}
+	for dep, want := range tests {
+		if got := DepName(dep); got != want {
+			t.Errorf("DepName(%q) = %q, want %q", dep, got, want)
+		}
+	}
+}
+
+func TestConfIgnores(t *testing.T) {
+	conf := &Conf{Options: map[string][]string{
+		"IgnorePkg":   {"linux", "python-*"},
+		"IgnoreGroup": {"gnome"},
+	}}
+	tests := []struct {
+		pkg  Package
+		want bool
+	}{
+		{Package{Name: "linux"}, true},
+		{Package{Name: "linux-lts"}, false},
+		{Package{Name: "python-pip"}, true},
+		{Package{Name: "python"}, false},
+		{Package{Name: "nautilus", Groups: []string{"gnome"}}, true},
+		{Package{Name: "vim", Groups: []string{"editors"}}, false},
+	}
+	for _, tt := range tests {
+		if got := conf.Ignores(&tt.pkg); got != tt.want {
+			t.Errorf("Ignores(%s) = %v, want %v", tt.pkg.Name, got, tt.want)
+		}
+	}
+	if (*Conf)(nil).Ignores(&Package{Name: "linux"}) {
+		t.Error("a nil Conf ignores linux")
+	}
+}
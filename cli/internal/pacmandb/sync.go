@@ -0,0 +1,158 @@
+package pacmandb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"archmaint/internal/vercmp"
+)
+
+// Repos lists the sync repositories in the order pacman.conf declares them.
+// Without a readable pacman.conf the sync databases present on disk are
+// returned in lexical order.
+func (db *DB) Repos() ([]string, error) {
+	if conf, err := db.Conf(); err == nil && len(conf.Repos) > 0 {
+		return conf.Repos, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(db.Path(), "sync", "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(paths))
+	for _, p := range paths {
+		repos = append(repos, strings.TrimSuffix(filepath.Base(p), ".db"))
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// Sync reads every package of one sync repository, sorted by name
+func (db *DB) Sync(repo string) ([]*Package, error) {
+	f, err := os.Open(filepath.Join(db.Path(), "sync", repo+".db"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s.db: %v", repo, err)
+	}
+
+	byDir := make(map[string]*Package)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s.db: %v", repo, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, file := path.Split(strings.TrimPrefix(hdr.Name, "./"))
+		if file != "desc" && file != "depends" {
+			continue
+		}
+		pkg := byDir[dir]
+		if pkg == nil {
+			pkg = &Package{Repo: repo}
+			byDir[dir] = pkg
+		}
+		if err := parseDesc(tr, pkg); err != nil {
+			return nil, fmt.Errorf("%s.db: %s: %v", repo, hdr.Name, err)
+		}
+	}
+
+	pkgs := make([]*Package, 0, len(byDir))
+	for _, pkg := range byDir {
+		if pkg.Name != "" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	return pkgs, nil
+}
+
+// AllSync reads every repository from Repos, in order. Repositories whose
+// database has not been downloaded yet are skipped.
+func (db *DB) AllSync() ([]*Package, error) {
+	repos, err := db.Repos()
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*Package
+	for _, repo := range repos {
+		pkgs, err := db.Sync(repo)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, pkgs...)
+	}
+	return all, nil
+}
+
+// decompress detects gzip by its magic number; other data is read as a
+// plain tar. zstd and xz databases are reported as unsupported.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, errors.New("zstd compressed databases are not supported")
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return nil, errors.New("xz compressed databases are not supported")
+	}
+	return br, nil
+}
+
+// Update pairs an installed package with the newer sync package that
+// would replace it
+type Update struct {
+	Local *Package
+	Sync  *Package
+}
+
+// Upgrades finds the installed packages with a newer version in the sync
+// packages, like pacman -Qu. The first repository providing a package wins,
+// so sync must be in pacman.conf order. Replaces are not considered, and
+// IgnorePkg is left to the caller (see Conf.Ignores).
+func Upgrades(local, sync []*Package) []Update {
+	first := make(map[string]*Package)
+	for _, pkg := range sync {
+		if _, ok := first[pkg.Name]; !ok {
+			first[pkg.Name] = pkg
+		}
+	}
+
+	var updates []Update
+	for _, pkg := range local {
+		if candidate, ok := first[pkg.Name]; ok && vercmp.Compare(candidate.Version, pkg.Version) > 0 {
+			updates = append(updates, Update{Local: pkg, Sync: candidate})
+		}
+	}
+	return updates
+}
@@ -0,0 +1,233 @@
+// Package pacmanlog reads pacman's log file into transactions.
+//
+// Every line of /var/log/pacman.log starts with a timestamp and a source
+// tag:
+//
+//	[2024-03-01T10:00:00+0100] [PACMAN] Running 'pacman -Syu'
+//	[2024-03-01T10:00:05+0100] [PACMAN] starting full system upgrade
+//	[2024-03-01T10:00:20+0100] [ALPM] transaction started
+//	[2024-03-01T10:00:20+0100] [ALPM] upgraded linux (6.7.6.arch1-1 -> 6.7.7.arch1-1)
+//	[2024-03-01T10:00:21+0100] [ALPM] transaction completed
+//
+// A transaction runs from "transaction started" to "transaction completed"
+// (or "transaction failed", or the next start when pacman was interrupted)
+// and is attributed to the last command pacman logged before it. Logs from
+// before pacman 5.1 use "[2019-01-01 10:00]" local timestamps, which are
+// read as well.
+package pacmanlog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Action is what a transaction did to one package
+type Action string
+
+const (
+	Installed   Action = "installed"
+	Upgraded    Action = "upgraded"
+	Downgraded  Action = "downgraded"
+	Reinstalled Action = "reinstalled"
+	Removed     Action = "removed"
+)
+
+// Actions lists every action in the order they are usually reported
+var Actions = []Action{Installed, Upgraded, Downgraded, Reinstalled, Removed}
+
+// Change is one package changed by a transaction. OldVersion is empty for
+// installs and NewVersion for removals; reinstalls set both to the same
+// version.
+type Change struct {
+	Action     Action `json:"action" yaml:"action"`
+	Package    string `json:"package" yaml:"package"`
+	OldVersion string `json:"old_version,omitempty" yaml:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty" yaml:"new_version,omitempty"`
+}
+
+// Status is how a transaction ended
+type Status string
+
+const (
+	Completed Status = "completed"
+	Failed    Status = "failed"
+	// Interrupted transactions have no end in the log
+	Interrupted Status = "interrupted"
+)
+
+// Transaction is one pacman transaction. ID numbers transactions from the
+// start of the log, so it stays the same as long as the log is only
+// appended to.
+type Transaction struct {
+	ID       int       `json:"id" yaml:"id"`
+	Started  time.Time `json:"started" yaml:"started"`
+	Finished time.Time `json:"finished" yaml:"finished"`
+	Command  string    `json:"command" yaml:"command"`
+	// SystemUpgrade is set for transactions of a full system upgrade
+	SystemUpgrade bool     `json:"system_upgrade" yaml:"system_upgrade"`
+	Status        Status   `json:"status" yaml:"status"`
+	Changes       []Change `json:"changes" yaml:"changes"`
+}
+
+var (
+	lineRE   = regexp.MustCompile(`^\[([^\]]+)\] \[([^\]]+)\] (.*)$`)
+	changeRE = regexp.MustCompile(`^(installed|upgraded|downgraded|reinstalled|removed) (\S+) \((.*)\)$`)
+)
+
+// Parse reads a whole log. Lines it does not understand are skipped.
+func Parse(r io.Reader) ([]Transaction, error) {
+	var (
+		txs     []Transaction
+		current *Transaction
+		command string
+		upgrade bool
+	)
+
+	finish := func(status Status, at time.Time) {
+		if current == nil {
+			return
+		}
+		current.Status = status
+		current.Finished = at
+		txs = append(txs, *current)
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := lineRE.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		at, ok := parseTime(m[1])
+		if !ok {
+			continue
+		}
+		source, msg := m[2], m[3]
+
+		switch source {
+		case "PACMAN":
+			switch {
+			case strings.HasPrefix(msg, "Running '"):
+				command = strings.TrimSuffix(strings.TrimPrefix(msg, "Running '"), "'")
+				upgrade = false
+			case msg == "starting full system upgrade":
+				upgrade = true
+			}
+		case "ALPM":
+			switch msg {
+			case "transaction started":
+				if current != nil {
+					finish(Interrupted, current.Started)
+				}
+				current = &Transaction{
+					ID:            len(txs) + 1,
+					Started:       at,
+					Command:       command,
+					SystemUpgrade: upgrade,
+					Changes:       []Change{},
+				}
+			case "transaction completed":
+				finish(Completed, at)
+			case "transaction failed":
+				finish(Failed, at)
+			default:
+				if current == nil {
+					continue
+				}
+				if change, ok := parseChange(msg); ok {
+					current.Changes = append(current.Changes, change)
+				}
+			}
+		}
+	}
+	if current != nil {
+		finish(Interrupted, current.Started)
+	}
+	return txs, scanner.Err()
+}
+
+// ParseFile reads the log at path
+func ParseFile(path string) ([]Transaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+func parseTime(stamp string) (time.Time, bool) {
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", stamp); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", stamp, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func parseChange(msg string) (Change, bool) {
+	m := changeRE.FindStringSubmatch(msg)
+	if m == nil {
+		return Change{}, false
+	}
+	change := Change{Action: Action(m[1]), Package: m[2]}
+	versions := m[3]
+	switch change.Action {
+	case Upgraded, Downgraded:
+		from, to, ok := strings.Cut(versions, " -> ")
+		if !ok {
+			return Change{}, false
+		}
+		change.OldVersion, change.NewVersion = from, to
+	case Installed:
+		change.NewVersion = versions
+	case Removed:
+		change.OldVersion = versions
+	case Reinstalled:
+		change.OldVersion, change.NewVersion = versions, versions
+	}
+	return change, true
+}
+
+// Filter selects transactions and, within them, changes. Zero fields match
+// everything.
+type Filter struct {
+	Package string
+	Action  Action
+	// Since and Until bound the start time of a transaction, inclusive
+	Since time.Time
+	Until time.Time
+}
+
+// Apply returns the transactions with at least one matching change,
+// keeping only the matching changes
+func (f Filter) Apply(txs []Transaction) []Transaction {
+	var matched []Transaction
+	for _, tx := range txs {
+		if !f.Since.IsZero() && tx.Started.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && tx.Started.After(f.Until) {
+			continue
+		}
+
+		changes := []Change{}
+		for _, change := range tx.Changes {
+			if (f.Package == "" || change.Package == f.Package) && (f.Action == "" || change.Action == f.Action) {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) > 0 {
+			tx.Changes = changes
+			matched = append(matched, tx)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,180 @@
+package pacmanlog
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLog is the pacman.log of the test system the cli package replays
+var testLog = filepath.Join("..", "..", "testdata", "root", "var", "log", "pacman.log")
+
+func stamp(t *testing.T, value string) time.Time {
+	t.Helper()
+	at, ok := parseTime(value)
+	if !ok {
+		t.Fatalf("bad timestamp %q", value)
+	}
+	return at
+}
+
+func TestParseFile(t *testing.T) {
+	txs, err := ParseFile(testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command           string
+		upgrade           bool
+		status            Status
+		started, finished string
+		changes           []Change
+	}{
+		{"pacman -Syu", true, Completed, "2024-06-01T09:12:41+0000", "2024-06-01T09:12:43+0000", []Change{
+			{Upgraded, "pacman-mirrorlist", "20240501-1", "20240601-1"},
+			{Upgraded, "bash", "5.2.026-1", "5.2.026-2"},
+		}},
+		{"pacman -S htop vim", false, Completed, "2024-06-03T20:01:17+0000", "2024-06-03T20:01:18+0000", []Change{
+			{Installed, "htop", "", "3.3.0-1"},
+			{Reinstalled, "vim", "9.1.0-1", "9.1.0-1"},
+		}},
+		{"pacman -U /var/cache/pacman/pkg/vim-9.0.0-1-x86_64.pkg.tar.zst", false, Failed, "2024-06-05T11:30:03+0000", "2024-06-05T11:30:04+0000", []Change{
+			{Downgraded, "vim", "9.1.0-1", "9.0.0-1"},
+		}},
+		// A new transaction started before this one ended; it ends where it
+		// started
+		{"pacman -Rs htop", false, Interrupted, "2024-06-07T08:00:01+0000", "2024-06-07T08:00:01+0000", []Change{
+			{Removed, "htop", "3.3.0-1", ""},
+		}},
+		{"pacman -S htop", false, Completed, "2024-06-07T08:05:14+0000", "2024-06-07T08:05:14+0000", []Change{
+			{Installed, "htop", "", "3.3.0-1"},
+		}},
+	}
+	if len(txs) != len(tests) {
+		t.Fatalf("parsed %d transactions, want %d", len(txs), len(tests))
+	}
+	for i, tt := range tests {
+		tx := txs[i]
+		if tx.ID != i+1 {
+			t.Errorf("transaction %d: ID = %d", i+1, tx.ID)
+		}
+		if tx.Command != tt.command || tx.SystemUpgrade != tt.upgrade || tx.Status != tt.status {
+			t.Errorf("transaction %d = %q upgrade=%v %s, want %q upgrade=%v %s",
+				tx.ID, tx.Command, tx.SystemUpgrade, tx.Status, tt.command, tt.upgrade, tt.status)
+		}
+		if !tx.Started.Equal(stamp(t, tt.started)) || !tx.Finished.Equal(stamp(t, tt.finished)) {
+			t.Errorf("transaction %d ran %v to %v, want %s to %s", tx.ID, tx.Started, tx.Finished, tt.started, tt.finished)
+		}
+		if !reflect.DeepEqual(tx.Changes, tt.changes) {
+			t.Errorf("transaction %d changes = %+v, want %+v", tx.ID, tx.Changes, tt.changes)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     string
+		started time.Time
+		command string
+		status  Status
+	}{
+		{
+			name: "legacy timestamps",
+			log: `[2018-03-10 14:02] [PACMAN] Running 'pacman -S vim'
+[2018-03-10 14:02] [ALPM] transaction started
+[2018-03-10 14:02] [ALPM] installed vim (8.0.1543-1)
+[2018-03-10 14:03] [ALPM] transaction completed
+`,
+			started: time.Date(2018, 3, 10, 14, 2, 0, 0, time.Local),
+			command: "pacman -S vim",
+			status:  Completed,
+		},
+		{
+			name: "command of the last run before the transaction",
+			log: `[2024-06-01T09:00:00+0000] [PACMAN] Running 'pacman -Syu'
+[2024-06-01T09:00:05+0000] [PACMAN] Running 'pacman -S --asdeps vim'
+[2024-06-01T09:00:06+0000] [ALPM] transaction started
+[2024-06-01T09:00:06+0000] [ALPM] installed vim (9.1.0-1)
+[2024-06-01T09:00:06+0000] [ALPM] transaction completed
+`,
+			started: time.Date(2024, 6, 1, 9, 0, 6, 0, time.UTC),
+			command: "pacman -S --asdeps vim",
+			status:  Completed,
+		},
+		{
+			name: "interrupted at the end of the log",
+			log: `garbage
+[2024-06-01T09:00:06+0000] [ALPM] transaction started
+[2024-06-01T09:00:06+0000] [ALPM] installed vim (9.1.0-1)
+`,
+			started: time.Date(2024, 6, 1, 9, 0, 6, 0, time.UTC),
+			status:  Interrupted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txs, err := Parse(strings.NewReader(tt.log))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txs) != 1 {
+				t.Fatalf("parsed %d transactions, want 1", len(txs))
+			}
+			tx := txs[0]
+			if !tx.Started.Equal(tt.started) || tx.Command != tt.command || tx.Status != tt.status {
+				t.Errorf("parsed %v %q %s, want %v %q %s", tx.Started, tx.Command, tx.Status, tt.started, tt.command, tt.status)
+			}
+			if len(tx.Changes) != 1 || tx.Changes[0].Package != "vim" {
+				t.Errorf("changes = %+v", tx.Changes)
+			}
+		})
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	txs, err := ParseFile(testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		ids    []int
+		// changes counts the changes kept in each matched transaction
+		changes []int
+	}{
+		{"everything", Filter{}, []int{1, 2, 3, 4, 5}, []int{2, 2, 1, 1, 1}},
+		{"package", Filter{Package: "htop"}, []int{2, 4, 5}, []int{1, 1, 1}},
+		{"action", Filter{Action: Reinstalled}, []int{2}, []int{1}},
+		{"package and action", Filter{Package: "vim", Action: Downgraded}, []int{3}, []int{1}},
+		{"since is inclusive", Filter{Since: stamp(t, "2024-06-05T11:30:03+0000")}, []int{3, 4, 5}, []int{1, 1, 1}},
+		{"until is inclusive", Filter{Until: stamp(t, "2024-06-03T20:01:17+0000")}, []int{1, 2}, []int{2, 2}},
+		{"since and until", Filter{
+			Since: stamp(t, "2024-06-02T00:00:00+0000"),
+			Until: stamp(t, "2024-06-06T00:00:00+0000"),
+		}, []int{2, 3}, []int{2, 1}},
+		{"nothing", Filter{Package: "linux"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids, changes []int
+			for _, tx := range tt.filter.Apply(txs) {
+				ids = append(ids, tx.ID)
+				changes = append(changes, len(tx.Changes))
+			}
+			if !reflect.DeepEqual(ids, tt.ids) || !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("Apply() = transactions %v with %v changes, want %v with %v", ids, changes, tt.ids, tt.changes)
+			}
+		})
+	}
+
+	// Filtering keeps the parsed transactions intact
+	if len(txs[0].Changes) != 2 {
+		t.Errorf("Apply() changed its input: %+v", txs[0].Changes)
+	}
+}
@@ -0,0 +1,164 @@
+// Package vercmp compares Arch Linux package versions the way pacman does.
+//
+// Versions have the form [epoch:]pkgver[-pkgrel]. Compare follows libalpm's
+// alpm_pkg_vercmp: epochs are compared first, then pkgver, then pkgrel if
+// both versions have one. Each part is compared with rpmvercmp rules, so
+// 1.10 is newer than 1.9, 1.0 is newer than 1.0rc1 and 1.0.a is newer than
+// 1.0alpha.
+package vercmp
+
+import "strings"
+
+// Compare returns -1 if a is older than b, 0 if they are equal and 1 if a
+// is newer
+func Compare(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	epochA, verA, relA := Parse(a)
+	epochB, verB, relB := Parse(b)
+
+	ret := compareSegments(epochA, epochB)
+	if ret == 0 {
+		ret = compareSegments(verA, verB)
+		if ret == 0 && relA != "" && relB != "" {
+			ret = compareSegments(relA, relB)
+		}
+	}
+	return ret
+}
+
+// Parse splits a version into epoch, pkgver and pkgrel. A missing epoch is
+// "0" and a missing pkgrel is "".
+func Parse(version string) (epoch, pkgver, pkgrel string) {
+	// The epoch is a run of leading digits followed by a colon
+	s := 0
+	for s < len(version) && isDigit(version[s]) {
+		s++
+	}
+	rest := version[s:]
+
+	epoch = "0"
+	pkgver = version
+	if strings.HasPrefix(rest, ":") {
+		if s > 0 {
+			epoch = version[:s]
+		}
+		pkgver = rest[1:]
+	}
+
+	// The release follows the last dash
+	if i := strings.LastIndexByte(pkgver, '-'); i >= 0 {
+		return epoch, pkgver[:i], pkgver[i+1:]
+	}
+	return epoch, pkgver, ""
+}
+
+// compareSegments is rpmvercmp as used by libalpm
+func compareSegments(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	one, two := 0, 0
+	ptr1, ptr2 := 0, 0
+
+	for one < len(a) && two < len(b) {
+		for one < len(a) && !isAlnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !isAlnum(b[two]) {
+			two++
+		}
+
+		// Running out of segments ends the comparison
+		if one >= len(a) || two >= len(b) {
+			break
+		}
+
+		// A longer run of separators makes a version newer
+		if one-ptr1 != two-ptr2 {
+			if one-ptr1 < two-ptr2 {
+				return -1
+			}
+			return 1
+		}
+
+		ptr1, ptr2 = one, two
+
+		// Take the next segment: a run of digits or a run of letters,
+		// whichever the first string starts with
+		isNum := isDigit(a[ptr1])
+		if isNum {
+			for ptr1 < len(a) && isDigit(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isDigit(b[ptr2]) {
+				ptr2++
+			}
+		} else {
+			for ptr1 < len(a) && isAlpha(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isAlpha(b[ptr2]) {
+				ptr2++
+			}
+		}
+
+		seg1, seg2 := a[one:ptr1], b[two:ptr2]
+
+		// Segments of different types: a number is newer than letters
+		if seg2 == "" {
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+
+		if isNum {
+			seg1 = strings.TrimLeft(seg1, "0")
+			seg2 = strings.TrimLeft(seg2, "0")
+
+			// With leading zeros gone, more digits means a larger number
+			if len(seg1) > len(seg2) {
+				return 1
+			}
+			if len(seg2) > len(seg1) {
+				return -1
+			}
+		}
+
+		if seg1 != seg2 {
+			if seg1 < seg2 {
+				return -1
+			}
+			return 1
+		}
+
+		one, two = ptr1, ptr2
+	}
+
+	if one >= len(a) && two >= len(b) {
+		return 0
+	}
+
+	// Whatever is left decides. A remaining alpha segment never beats an
+	// empty string: 1.0 is newer than 1.0rc1, but 1.0.1 is newer than 1.0.
+	if (one >= len(a) && !isAlpha(b[two])) || (one < len(a) && isAlpha(a[one])) {
+		return -1
+	}
+	return 1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isAlpha(c)
+}
@@ -0,0 +1,115 @@
+package vercmp
+
+import "testing"
+
+// compareTests mirrors pacman's test/util/vercmptest.sh. Every case is also
+// checked with its arguments swapped.
+var compareTests = []struct {
+	a, b string
+	want int
+}{
+	// all similar length, no pkgrel
+	{"1.5.0", "1.5.0", 0},
+	{"1.5.1", "1.5.0", 1},
+
+	// mixed length
+	{"1.5.1", "1.5", 1},
+
+	// with pkgrel, simple
+	{"1.5.0-1", "1.5.0-1", 0},
+	{"1.5.0-1", "1.5.0-2", -1},
+	{"1.5.0-1", "1.5.1-1", -1},
+	{"1.5.0-2", "1.5.1-1", -1},
+
+	// with pkgrel, mixed lengths
+	{"1.5-1", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-2", -1},
+
+	// mixed pkgrel inclusion
+	{"1.5", "1.5-1", 0},
+	{"1.5-1", "1.5", 0},
+	{"1.1-1", "1.1", 0},
+	{"1.0-1", "1.1", -1},
+	{"1.1-1", "1.0", 1},
+
+	// alphanumeric versions
+	{"1.5b-1", "1.5-1", -1},
+	{"1.5b", "1.5", -1},
+	{"1.5b-1", "1.5", -1},
+	{"1.5b", "1.5.1", -1},
+
+	// from the manpage
+	{"1.0a", "1.0alpha", -1},
+	{"1.0alpha", "1.0b", -1},
+	{"1.0b", "1.0beta", -1},
+	{"1.0beta", "1.0rc", -1},
+	{"1.0rc", "1.0", -1},
+
+	// going crazy? alpha-dotted versions
+	{"1.5.a", "1.5", 1},
+	{"1.5.b", "1.5.a", 1},
+	{"1.5.1", "1.5.b", 1},
+
+	// alpha dots and dashes
+	{"1.5.b-1", "1.5.b", 0},
+	{"1.5-1", "1.5.b", -1},
+
+	// same/similar content, differing separators
+	{"2.0", "2_0", 0},
+	{"2.0_a", "2_0.a", 0},
+	{"2.0a", "2.0.a", -1},
+	{"2___a", "2_a", 1},
+
+	// epoch included version comparisons
+	{"0:1.0", "0:1.0", 0},
+	{"0:1.0", "0:1.1", -1},
+	{"1:1.0", "0:1.0", 1},
+	{"1:1.0", "0:1.1", 1},
+	{"1:1.0", "2:1.1", -1},
+
+	// epoch + sometimes present pkgrel
+	{"1:1.0", "0:1.0-1", 1},
+	{"1:1.0-1", "0:1.1-1", 1},
+
+	// epoch included on one version
+	{"0:1.0", "1.0", 0},
+	{"0:1.0", "1.1", -1},
+	{"0:1.1", "1.0", 1},
+	{"1:1.0", "1.0", 1},
+	{"1:1.0", "1.1", 1},
+	{"1:1.1", "1.1", 1},
+}
+
+func TestCompare(t *testing.T) {
+	for _, tt := range compareTests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		version               string
+		epoch, pkgver, pkgrel string
+	}{
+		{"1.5.0", "0", "1.5.0", ""},
+		{"1.5.0-1", "0", "1.5.0", "1"},
+		{"2:1.5.0-1", "2", "1.5.0", "1"},
+		{"1:2.0", "1", "2.0", ""},
+		{"6.2.arch1-1", "0", "6.2.arch1", "1"},
+		{"1.0-rc1-2", "0", "1.0-rc1", "2"},
+		{":1.0", "0", "1.0", ""},
+	}
+	for _, tt := range tests {
+		epoch, pkgver, pkgrel := Parse(tt.version)
+		if epoch != tt.epoch || pkgver != tt.pkgver || pkgrel != tt.pkgrel {
+			t.Errorf("Parse(%q) = %q, %q, %q, want %q, %q, %q",
+				tt.version, epoch, pkgver, pkgrel, tt.epoch, tt.pkgver, tt.pkgrel)
+		}
+	}
+}
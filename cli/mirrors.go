@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mirror states
+const (
+	mirrorOK          = "ok"
+	mirrorOutdated    = "outdated"
+	mirrorUnreachable = "unreachable"
+)
+
+// mirrorChecks bounds the mirrors checked at the same time
+const mirrorChecks = 8
+
+// mirrorHealthProbes bounds the mirrors the health check probes. pacman
+// tries servers in order, so the first ones are those that matter.
+const mirrorHealthProbes = 5
+
+// mirrorCacheTTL is how long the health check reuses its last probe, so
+// scheduled exports and plugin checks stay off the network
+const mirrorCacheTTL = time.Hour
+
+// rankedHeader starts the block of servers written by mirrors --rank
+const rankedHeader = "## Ranked by archmaint on "
+
+// mirrorCache is the last probe of the health check, kept in STATE_PATH
+type mirrorCache struct {
+	Checked time.Time      `json:"checked"`
+	Mirrors []MirrorStatus `json:"mirrors"`
+}
+
+func (a *ArchMaintenance) mirrorlistPath() string {
+	return filepath.Join(a.config.PacmanRoot, "etc/pacman.d/mirrorlist")
+}
+
+// mirrorLine reads a Server line of a mirrorlist, enabled or commented out
+func mirrorLine(line string) (server string, enabled, ok bool) {
+	line = strings.TrimSpace(line)
+	commented := strings.HasPrefix(line, "#")
+	line = strings.TrimSpace(strings.TrimLeft(line, "#"))
+
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || strings.TrimSpace(key) != "Server" {
+		return "", false, false
+	}
+	if commented {
+		return strings.TrimSpace(value), false, true
+	}
+	value, _, _ = strings.Cut(value, "#")
+	return strings.TrimSpace(value), true, true
+}
+
+// parseMirrorlist returns the Server URLs of a mirrorlist, enabled and
+// commented out
+func parseMirrorlist(data string) (enabled, disabled []string) {
+	for _, line := range strings.Split(data, "\n") {
+		server, on, ok := mirrorLine(line)
+		switch {
+		case !ok:
+		case on:
+			enabled = append(enabled, server)
+		default:
+			disabled = append(disabled, server)
+		}
+	}
+	return enabled, disabled
+}
+
+// lastsyncURL is where a mirror publishes the time of its last sync, at the
+// root of its Arch tree
+func lastsyncURL(server string) string {
+	if i := strings.Index(server, "$repo"); i >= 0 {
+		return server[:i] + "lastsync"
+	}
+	return strings.TrimSuffix(server, "/") + "/lastsync"
+}
+
+// checkMirror fetches the lastsync file of a mirror and times the request
+func (a *ArchMaintenance) checkMirror(server string) MirrorStatus {
+	status := MirrorStatus{URL: server, Status: mirrorUnreachable, LatencyMS: -1}
+
+	start := time.Now()
+	data, err := a.fetchURL(lastsyncURL(server))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	latency := time.Since(start)
+
+	stamp, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		status.Error = fmt.Sprintf("invalid lastsync %q", strings.TrimSpace(string(data)))
+		return status
+	}
+
+	status.LatencyMS = latency.Milliseconds()
+	status.LastSync = time.Unix(stamp, 0).UTC()
+	status.Status = mirrorOK
+	if time.Since(status.LastSync) > time.Duration(a.config.MirrorMaxAgeHours)*time.Hour {
+		status.Status = mirrorOutdated
+	}
+	return status
+}
+
+// checkMirrors checks servers in parallel, keeping their order
+func (a *ArchMaintenance) checkMirrors(servers []string) []MirrorStatus {
+	statuses := make([]MirrorStatus, len(servers))
+	slots := make(chan struct{}, mirrorChecks)
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			statuses[i] = a.checkMirror(server)
+			<-slots
+		}(i, server)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// mirrorsReport checks every enabled mirror of the mirrorlist
+func (a *ArchMaintenance) mirrorsReport() (MirrorsReport, error) {
+	report := MirrorsReport{Path: a.mirrorlistPath(), MaxAgeHours: a.config.MirrorMaxAgeHours, Mirrors: []MirrorStatus{}}
+	data, err := os.ReadFile(report.Path)
+	if err != nil {
+		return report, err
+	}
+	enabled, _ := parseMirrorlist(string(data))
+	report.Mirrors = append(report.Mirrors, a.checkMirrors(enabled)...)
+	return report, nil
+}
+
+// rankMirrors orders mirrors up to date first, then outdated, then
+// unreachable, each by response time
+func rankMirrors(mirrors []MirrorStatus) []MirrorStatus {
+	order := map[string]int{mirrorOK: 0, mirrorOutdated: 1, mirrorUnreachable: 2}
+	ranked := append([]MirrorStatus(nil), mirrors...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if order[ranked[i].Status] != order[ranked[j].Status] {
+			return order[ranked[i].Status] < order[ranked[j].Status]
+		}
+		return ranked[i].LatencyMS < ranked[j].LatencyMS
+	})
+	return ranked
+}
+
+// rankedMirrorlist rewrites a mirrorlist with its enabled servers in ranked
+// order. The header and the comments and disabled servers after it are kept
+// in place; the ranked servers go between them. Markers of an earlier
+// ranking are dropped.
+func rankedMirrorlist(data string, ranked []MirrorStatus, now time.Time) string {
+	var header, rest []string
+	inHeader := true
+	for _, line := range strings.Split(strings.TrimRight(data, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, rankedHeader) || trimmed == "## Up to date mirrors first, fastest first" ||
+			trimmed == "# "+mirrorOutdated || trimmed == "# "+mirrorUnreachable {
+			continue
+		}
+		_, enabled, ok := mirrorLine(line)
+		if ok && inHeader {
+			// A comment block right above the first server, such as a
+			// country heading, belongs to the servers rather than the header
+			for i := len(header) - 1; i >= 0; i-- {
+				if strings.TrimSpace(header[i]) == "" {
+					header, rest = header[:i], header[i+1:]
+					break
+				}
+			}
+			inHeader = false
+		}
+		switch {
+		case enabled:
+		case inHeader:
+			header = append(header, line)
+		default:
+			rest = append(rest, line)
+		}
+	}
+
+	var b strings.Builder
+	if text := strings.TrimSpace(strings.Join(header, "\n")); text != "" {
+		b.WriteString(strings.TrimRight(strings.Join(header, "\n"), "\n \t"))
+		b.WriteString("\n\n")
+	}
+	fmt.Fprintf(&b, "%s%s\n", rankedHeader, now.Format("2006-01-02 15:04"))
+	b.WriteString("## Up to date mirrors first, fastest first\n")
+	for _, mirror := range ranked {
+		if mirror.Status != mirrorOK {
+			fmt.Fprintf(&b, "# %s\n", mirror.Status)
+		}
+		fmt.Fprintf(&b, "Server = %s\n", mirror.URL)
+	}
+	if text := strings.TrimSpace(strings.Join(rest, "\n")); text != "" {
+		b.WriteString("\n")
+		b.WriteString(strings.Trim(strings.Join(rest, "\n"), "\n"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// formatAge renders how long ago t was in the largest whole unit
+func formatAge(t time.Time) string {
+	age := time.Since(t)
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+}
+
+func (a *ArchMaintenance) showMirrors(rank bool) {
+	headerColor.Println("\n=== MIRRORS ===")
+
+	data, err := os.ReadFile(a.mirrorlistPath())
+	if err != nil {
+		errorColor.Printf("Failed to read the mirrorlist: %v\n", err)
+		a.status.failures++
+		return
+	}
+	enabled, _ := parseMirrorlist(string(data))
+	if len(enabled) == 0 {
+		errorColor.Printf("No enabled mirrors in %s\n", a.mirrorlistPath())
+		a.status.failures++
+		return
+	}
+
+	infoColor.Printf("Checking %d mirrors...\n", len(enabled))
+	mirrors := a.checkMirrors(enabled)
+
+	table := plainTable("#", "Mirror", "Last sync", "Latency", "Status")
+	fresh := 0
+	for i, mirror := range mirrors {
+		lastSync, latency := "-", "-"
+		if !mirror.LastSync.IsZero() {
+			lastSync = formatAge(mirror.LastSync)
+		}
+		if mirror.LatencyMS >= 0 {
+			latency = fmt.Sprintf("%d ms", mirror.LatencyMS)
+		}
+		if mirror.Status == mirrorOK {
+			fresh++
+		}
+		table.Append([]string{strconv.Itoa(i + 1), mirror.URL, lastSync, latency, mirror.Status})
+	}
+	table.Render()
+
+	fmt.Printf("\n%d of %d mirrors synced within %dh\n", fresh, len(mirrors), a.config.MirrorMaxAgeHours)
+	for _, mirror := range mirrors {
+		if mirror.Error != "" {
+			warningColor.Printf("  %s: %s\n", mirror.URL, mirror.Error)
+		}
+	}
+
+	if !rank {
+		if fresh < len(mirrors) {
+			infoColor.Println("Run 'archmaint mirrors --rank' to put the fastest up to date mirrors first.")
+		}
+		a.waitForContinue()
+		return
+	}
+
+	ranked := rankMirrors(mirrors)
+	fmt.Println("\nRanked order:")
+	unchanged := true
+	for i, mirror := range ranked {
+		fmt.Printf("  %d. %s\n", i+1, mirror.URL)
+		unchanged = unchanged && mirror.URL == mirrors[i].URL
+	}
+	if unchanged {
+		successColor.Println("The mirrorlist is already in this order.")
+		a.waitForContinue()
+		return
+	}
+
+	if a.config.DryRun {
+		fmt.Printf("  Would back up and rewrite %s\n", a.mirrorlistPath())
+		a.waitForContinue()
+		return
+	}
+	if !a.proceed(fmt.Sprintf("Write the ranked mirrorlist to %s?", a.mirrorlistPath()), false) {
+		return
+	}
+	if a.replaceConfigFile(a.mirrorlistPath(), []byte(rankedMirrorlist(string(data), ranked, time.Now()))) {
+		successColor.Println("Mirrorlist updated!")
+	}
+	a.waitForContinue()
+}
+
+func (a *ArchMaintenance) mirrorCachePath() string {
+	return filepath.Join(a.config.StatePath, "mirrors.json")
+}
+
+// cachedMirrorStatus checks servers, reusing the result of a check of the
+// same servers within mirrorCacheTTL. Dry runs do not update the cache.
+func (a *ArchMaintenance) cachedMirrorStatus(servers []string) []MirrorStatus {
+	var cache mirrorCache
+	if data, err := os.ReadFile(a.mirrorCachePath()); err == nil && json.Unmarshal(data, &cache) == nil &&
+		time.Since(cache.Checked) < mirrorCacheTTL && len(cache.Mirrors) == len(servers) {
+		same := true
+		for i, mirror := range cache.Mirrors {
+			same = same && mirror.URL == servers[i]
+		}
+		if same {
+			return cache.Mirrors
+		}
+	}
+
+	mirrors := a.checkMirrors(servers)
+	if !a.config.DryRun {
+		data, err := json.Marshal(mirrorCache{Checked: time.Now(), Mirrors: mirrors})
+		if err == nil {
+			if err = os.MkdirAll(a.config.StatePath, 0755); err == nil {
+				err = writeFileAtomic(a.mirrorCachePath(), append(data, '\n'), 0644)
+			}
+		}
+		if err != nil && a.config.VerboseMode {
+			warningColor.Printf("Could not cache the mirror check: %v\n", err)
+		}
+	}
+	return mirrors
+}
+
+// checkMirrorHealth probes the first mirrorHealthProbes enabled mirrors,
+// at most once per mirrorCacheTTL
+func (a *ArchMaintenance) checkMirrorHealth() HealthCheckResult {
+	threshold := fmt.Sprintf("the first %d enabled mirrors reachable and synced within %dh", mirrorHealthProbes, a.config.MirrorMaxAgeHours)
+
+	data, err := os.ReadFile(a.mirrorlistPath())
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+	enabled, _ := parseMirrorlist(string(data))
+	total := len(enabled)
+	if total == 0 {
+		return HealthCheckResult{
+			Status:    HealthCritical,
+			Value:     "no enabled mirrors",
+			Threshold: threshold,
+			Hint:      "Enable servers in " + a.mirrorlistPath(),
+		}
+	}
+	if total > mirrorHealthProbes {
+		total = mirrorHealthProbes
+	}
+	mirrors := a.cachedMirrorStatus(enabled[:total])
+
+	stale, unreachable := 0, 0
+	for _, mirror := range mirrors {
+		switch mirror.Status {
+		case mirrorOutdated:
+			stale++
+		case mirrorUnreachable:
+			stale++
+			unreachable++
+		}
+	}
+	// Without a single answer the network is the more likely culprit
+	if unreachable == total {
+		return unknownResult(threshold, errors.New("no mirror could be reached"))
+	}
+
+	result := HealthCheckResult{
+		Value:     fmt.Sprintf("%d of %d stale", stale, total),
+		Threshold: threshold,
+		Hint:      "Rank them with 'archmaint mirrors --rank'",
+	}
+	if stale > 0 {
+		result.Message = fmt.Sprintf("%d mirrors are out of date or unreachable", stale)
+	}
+	gradeMetric(&result, "stale_mirrors", float64(stale), 1, float64(total), "mirrors")
+	return result
+}
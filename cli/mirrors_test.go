@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMirrorlist = `##
+## Arch Linux repository mirrorlist
+## Generated on 2024-05-01
+##
+
+## Germany
+Server = https://de.example.org/archlinux/$repo/os/$arch
+#Server = https://old.example.org/archlinux/$repo/os/$arch
+
+## Sweden
+Server = https://se.example.org/archlinux/$repo/os/$arch # fast
+`
+
+func TestRankedMirrorlist(t *testing.T) {
+	now := time.Date(2024, 5, 2, 10, 30, 0, 0, time.UTC)
+	ranked := []MirrorStatus{
+		{URL: "https://se.example.org/archlinux/$repo/os/$arch", Status: mirrorOK},
+		{URL: "https://de.example.org/archlinux/$repo/os/$arch", Status: mirrorOutdated},
+	}
+	want := `##
+## Arch Linux repository mirrorlist
+## Generated on 2024-05-01
+##
+
+## Ranked by archmaint on 2024-05-02 10:30
+## Up to date mirrors first, fastest first
+Server = https://se.example.org/archlinux/$repo/os/$arch
+# outdated
+Server = https://de.example.org/archlinux/$repo/os/$arch
+
+## Germany
+#Server = https://old.example.org/archlinux/$repo/os/$arch
+
+## Sweden
+`
+
+	tests := []struct {
+		name, data, want string
+	}{
+		// The country heading above the first server goes after the ranked
+		// block with the rest of its servers instead of heading it
+		{"country headings", testMirrorlist, want},
+		{"re-rank", want, want},
+		{"no header", "Server = https://de.example.org/archlinux/$repo/os/$arch\n",
+			"## Ranked by archmaint on 2024-05-02 10:30\n## Up to date mirrors first, fastest first\n" +
+				"Server = https://se.example.org/archlinux/$repo/os/$arch\n# outdated\nServer = https://de.example.org/archlinux/$repo/os/$arch\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rankedMirrorlist(tt.data, ranked, now)
+			if got != tt.want {
+				t.Errorf("rankedMirrorlist():\n%s\nwant\n%s", got, tt.want)
+			}
+			if again := rankedMirrorlist(got, ranked, now); again != got {
+				t.Errorf("ranking again changed the mirrorlist:\n%s", again)
+			}
+			_, disabled := parseMirrorlist(got)
+			_, wantDisabled := parseMirrorlist(tt.data)
+			if len(disabled) != len(wantDisabled) {
+				t.Errorf("commented servers %v, want %v", disabled, wantDisabled)
+			}
+		})
+	}
+}
+
+func TestLastsyncURL(t *testing.T) {
+	tests := []struct {
+		server, want string
+	}{
+		{"https://mirror.example.org/archlinux/$repo/os/$arch", "https://mirror.example.org/archlinux/lastsync"},
+		{"https://mirror.example.org/$repo/os/$arch", "https://mirror.example.org/lastsync"},
+		{"https://mirror.example.org/archlinux/", "https://mirror.example.org/archlinux/lastsync"},
+		{"https://mirror.example.org/archlinux", "https://mirror.example.org/archlinux/lastsync"},
+	}
+	for _, tt := range tests {
+		if got := lastsyncURL(tt.server); got != tt.want {
+			t.Errorf("lastsyncURL(%q) = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMirror(t *testing.T) {
+	now := time.Now()
+	lastsync := map[string]string{
+		"/fresh/lastsync":    fmt.Sprint(now.Add(-time.Hour).Unix()),
+		"/slow/lastsync":     fmt.Sprint(now.Add(-time.Hour).Unix()),
+		"/outdated/lastsync": fmt.Sprint(now.Add(-72 * time.Hour).Unix()),
+		"/invalid/lastsync":  "<html>not found</html>",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := lastsync[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/slow/") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintln(w, data)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path       string
+		status     string
+		minLatency int64
+		err        string
+	}{
+		{"/fresh/$repo/os/$arch", mirrorOK, 0, ""},
+		{"/slow/$repo/os/$arch", mirrorOK, 50, ""},
+		{"/outdated/$repo/os/$arch", mirrorOutdated, 0, ""},
+		{"/invalid/$repo/os/$arch", mirrorUnreachable, -1, "invalid lastsync"},
+		{"/gone/$repo/os/$arch", mirrorUnreachable, -1, "404"},
+	}
+	a := newTestApp(t, NewFakeRunner())
+	a.config.MirrorMaxAgeHours = 24
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			status := a.checkMirror(server.URL + tt.path)
+			if status.Status != tt.status {
+				t.Errorf("status = %s, want %s (%s)", status.Status, tt.status, status.Error)
+			}
+			if tt.minLatency < 0 && status.LatencyMS != -1 {
+				t.Errorf("latency = %d ms for a failed check", status.LatencyMS)
+			}
+			if status.LatencyMS < tt.minLatency {
+				t.Errorf("latency = %d ms, want at least %d", status.LatencyMS, tt.minLatency)
+			}
+			if !strings.Contains(status.Error, tt.err) {
+				t.Errorf("error = %q, want %q", status.Error, tt.err)
+			}
+			if tt.err == "" && status.LastSync.IsZero() {
+				t.Error("no last sync time")
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"archmaint/internal/pacmanlog"
+)
+
+// defaultNewsURL is the Arch Linux news feed
+const defaultNewsURL = "https://archlinux.org/feeds/news/"
+
+// maxReadNews bounds the acknowledged items kept in the news state
+const maxReadNews = 100
+
+// NewsItem is one entry of the news feed
+type NewsItem struct {
+	Title       string
+	Link        string
+	GUID        string
+	Published   time.Time
+	Description string
+}
+
+// id identifies an item across feed fetches
+func (item NewsItem) id() string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	return item.Link
+}
+
+// newsState remembers the last upgrade and the items already acknowledged
+type newsState struct {
+	LastUpgrade time.Time `json:"last_upgrade"`
+	Read        []string  `json:"read"`
+}
+
+// fetchURL reads an http(s) or file:// URL, or a plain local path
+func (a *ArchMaintenance) fetchURL(url string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		resp, err := a.httpClient.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	case strings.HasPrefix(url, "file://"):
+		return os.ReadFile(strings.TrimPrefix(url, "file://"))
+	}
+	return os.ReadFile(url)
+}
+
+// parseNewsFeed reads an RSS 2.0 document
+func parseNewsFeed(data []byte) ([]NewsItem, error) {
+	var feed struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			GUID        string `xml:"guid"`
+			PubDate     string `xml:"pubDate"`
+			Description string `xml:"description"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		return nil, err
+	}
+
+	items := make([]NewsItem, 0, len(feed.Items))
+	for _, raw := range feed.Items {
+		item := NewsItem{
+			Title:       strings.TrimSpace(raw.Title),
+			Link:        strings.TrimSpace(raw.Link),
+			GUID:        strings.TrimSpace(raw.GUID),
+			Description: raw.Description,
+		}
+		for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+			if t, err := time.Parse(layout, strings.TrimSpace(raw.PubDate)); err == nil {
+				item.Published = t
+				break
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+var (
+	htmlBreak = regexp.MustCompile(`(?i)<(br|/p|/li|/h\d|/pre)\s*/?>`)
+	htmlTag   = regexp.MustCompile(`<[^>]*>`)
+	blankRuns = regexp.MustCompile(`\n{3,}`)
+)
+
+// newsText turns an item description into plain text
+func newsText(description string) string {
+	text := htmlBreak.ReplaceAllString(description, "\n")
+	text = html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+	return strings.TrimSpace(blankRuns.ReplaceAllString(text, "\n\n"))
+}
+
+func (a *ArchMaintenance) newsStatePath() string {
+	return filepath.Join(a.config.StatePath, "news.json")
+}
+
+func (a *ArchMaintenance) loadNewsState() newsState {
+	var state newsState
+	if data, err := os.ReadFile(a.newsStatePath()); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+// saveNewsState writes state. Dry runs leave no trace.
+func (a *ArchMaintenance) saveNewsState(state newsState) {
+	if a.config.DryRun {
+		return
+	}
+	if len(state.Read) > maxReadNews {
+		state.Read = state.Read[len(state.Read)-maxReadNews:]
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(a.config.StatePath, 0755); err == nil {
+			err = writeFileAtomic(a.newsStatePath(), append(data, '\n'), 0644)
+		}
+	}
+	if err != nil {
+		warningColor.Printf("Could not save news state: %v\n", err)
+	}
+}
+
+// lastUpgrade is when the system was last upgraded: the time archmaint
+// recorded, or else the last full upgrade in pacman.log
+func (a *ArchMaintenance) lastUpgrade(state newsState) time.Time {
+	if !state.LastUpgrade.IsZero() {
+		return state.LastUpgrade
+	}
+
+	txs, _ := a.transactions()
+	for i := len(txs) - 1; i >= 0; i-- {
+		if txs[i].SystemUpgrade && txs[i].Status == pacmanlog.Completed {
+			return txs[i].Started
+		}
+	}
+	return time.Time{}
+}
+
+// recordUpgrade notes a successful upgrade so older news stays quiet
+func (a *ArchMaintenance) recordUpgrade() {
+	state := a.loadNewsState()
+	state.LastUpgrade = time.Now().UTC().Truncate(time.Second)
+	a.saveNewsState(state)
+}
+
+// unreadNews returns the items published since the last upgrade that have
+// not been acknowledged, oldest first
+func (a *ArchMaintenance) unreadNews() ([]NewsItem, error) {
+	data, err := a.fetchURL(a.config.NewsURL)
+	if err != nil {
+		return nil, err
+	}
+	items, err := parseNewsFeed(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a.config.NewsURL, err)
+	}
+
+	state := a.loadNewsState()
+	since := a.lastUpgrade(state)
+
+	var unread []NewsItem
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if item.Published.After(since) && !contains(state.Read, item.id()) {
+			unread = append(unread, item)
+		}
+	}
+	return unread, nil
+}
+
+// checkNews shows unread Arch news and asks for acknowledgement. It returns
+// false when the operation should not go ahead. A feed that cannot be
+// fetched only warns, so upgrades still work offline.
+func (a *ArchMaintenance) checkNews() bool {
+	if a.config.NewsURL == "" {
+		return true
+	}
+
+	infoColor.Println("Checking Arch Linux news...")
+	unread, err := a.unreadNews()
+	if err != nil {
+		warningColor.Printf("Could not fetch the news: %v\n", err)
+		return true
+	}
+	if len(unread) == 0 {
+		successColor.Println("No unread news since the last upgrade.")
+		return true
+	}
+
+	warningColor.Printf("\n%d news items since the last upgrade:\n", len(unread))
+	for _, item := range unread {
+		headerColor.Printf("\n%s - %s\n", item.Published.Local().Format("2006-01-02"), item.Title)
+		fmt.Println(newsText(item.Description))
+		if item.Link != "" {
+			infoColor.Println(item.Link)
+		}
+	}
+	fmt.Println()
+
+	if a.config.DryRun {
+		fmt.Println("  Would ask to acknowledge these news items")
+		return true
+	}
+
+	if !a.proceed("Have you read the news and done any manual intervention it requires?", true) {
+		warningColor.Println("News not acknowledged; upgrades will ask again.")
+		return false
+	}
+
+	state := a.loadNewsState()
+	for _, item := range unread {
+		state.Read = append(state.Read, item.id())
+	}
+	a.saveNewsState(state)
+	return true
+}
+
+func (a *ArchMaintenance) showNews() {
+	headerColor.Println("\n=== ARCH LINUX NEWS ===")
+	if a.config.NewsURL == "" {
+		infoColor.Println("The news check is disabled (NEWS_URL is empty).")
+		return
+	}
+	if a.checkNews() {
+		a.waitForContinue()
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"archmaint/internal/pacmandb"
+)
+
+// orphanChoice is one line of the orphan checklist
+type orphanChoice struct {
+	name     string
+	note     string
+	selected bool
+}
+
+func (a *ArchMaintenance) removeOrphans(exclude ...string) {
+	headerColor.Println("\n=== REMOVE ORPHANED PACKAGES ===")
+
+	// Removing orphans can orphan their own dependencies, so look again
+	// after every removal until nothing new turns up
+	offered := make(map[string]bool)
+	for round := 1; ; round++ {
+		report, err := a.findOrphans(exclude)
+		if err != nil {
+			errorColor.Printf("Failed to list orphaned packages: %v\n", err)
+			a.status.failures++
+			return
+		}
+
+		var choices []orphanChoice
+		for _, pkg := range report.Orphans {
+			if !offered[pkg] {
+				choices = append(choices, orphanChoice{name: pkg, selected: true})
+			}
+		}
+		for _, pkg := range report.Optional {
+			if !offered[pkg.Name] {
+				note := "optional dependency"
+				if len(pkg.OptionalFor) > 0 {
+					note = "optional for " + strings.Join(pkg.OptionalFor, ", ")
+				}
+				choices = append(choices, orphanChoice{name: pkg.Name, note: note})
+			}
+		}
+
+		if round == 1 {
+			for _, pkg := range report.Excluded {
+				infoColor.Printf("  Keeping ignored package: %s\n", pkg)
+			}
+			if len(choices) == 0 {
+				successColor.Println("No orphaned packages found!")
+				return
+			}
+		} else if len(choices) == 0 {
+			successColor.Println("No further orphaned packages.")
+			return
+		} else {
+			infoColor.Println("\nThe removal left more orphaned packages.")
+		}
+
+		for _, choice := range choices {
+			offered[choice.name] = true
+		}
+
+		a.printOrphans(report)
+		selected := a.selectOrphans(choices)
+		if len(selected) == 0 {
+			infoColor.Println("No packages selected.")
+			a.status.aborted = true
+			return
+		}
+
+		if more := a.orphanCascade(selected); len(more) > 0 {
+			infoColor.Printf("Removing them leaves %d more orphans: %s\n", len(more), strings.Join(more, " "))
+		}
+
+		if !a.proceed(fmt.Sprintf("Remove these %d packages?", len(selected)), true) {
+			return
+		}
+		if a.config.DryRun {
+			fmt.Println("  Would run: sudo pacman -Rns " + strings.Join(selected, " "))
+			return
+		}
+
+		failures := a.status.failures
+		args := append([]string{"pacman", "-Rns", "--noconfirm"}, selected...)
+		a.runCommandWithProgress("sudo", args...)
+		if a.status.failures != failures {
+			return
+		}
+		successColor.Println("Orphaned packages removed!")
+	}
+}
+
+// printOrphans lists the orphans, with the optionally required ones apart
+func (a *ArchMaintenance) printOrphans(report OrphansReport) {
+	if len(report.Orphans) > 0 {
+		fmt.Printf("Found %d orphaned packages:\n", len(report.Orphans))
+		for _, pkg := range report.Orphans {
+			fmt.Printf("  • %s\n", pkg)
+		}
+	}
+	if len(report.Optional) > 0 {
+		fmt.Printf("\n%d packages are only optional dependencies (kept unless selected):\n", len(report.Optional))
+		for _, pkg := range report.Optional {
+			if len(pkg.OptionalFor) > 0 {
+				fmt.Printf("  • %s (optional for %s)\n", pkg.Name, strings.Join(pkg.OptionalFor, ", "))
+			} else {
+				fmt.Printf("  • %s\n", pkg.Name)
+			}
+		}
+	}
+}
+
+// selectOrphans shows a checklist and returns the chosen package names.
+// Orphans start selected and optional dependencies do not; without a
+// terminal that preselection is used as is.
+func (a *ArchMaintenance) selectOrphans(choices []orphanChoice) []string {
+	if a.config.NonInteractive || a.config.AutoConfirm {
+		fmt.Println("Selecting orphans only [auto]")
+		return selectedOrphans(choices)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Println("\nSelect packages to remove:")
+		for i, choice := range choices {
+			mark := " "
+			if choice.selected {
+				mark = "x"
+			}
+			if choice.note != "" {
+				fmt.Printf("  %2d. [%s] %s (%s)\n", i+1, mark, choice.name, choice.note)
+			} else {
+				fmt.Printf("  %2d. [%s] %s\n", i+1, mark, choice.name)
+			}
+		}
+
+		fmt.Print("\nToggle numbers or ranges (e.g. 1 3-5), a = all, n = none, Enter to continue: ")
+		input, err := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" || err != nil {
+			return selectedOrphans(choices)
+		}
+
+		switch input {
+		case "a":
+			for i := range choices {
+				choices[i].selected = true
+			}
+		case "n":
+			for i := range choices {
+				choices[i].selected = false
+			}
+		default:
+			for _, field := range strings.Fields(strings.ReplaceAll(input, ",", " ")) {
+				first, last, ok := parseRange(field, len(choices))
+				if !ok {
+					warningColor.Printf("Ignoring %q\n", field)
+					continue
+				}
+				for i := first; i <= last; i++ {
+					choices[i-1].selected = !choices[i-1].selected
+				}
+			}
+		}
+	}
+}
+
+func selectedOrphans(choices []orphanChoice) []string {
+	var names []string
+	for _, choice := range choices {
+		if choice.selected {
+			names = append(names, choice.name)
+		}
+	}
+	return names
+}
+
+// parseRange reads "N" or "N-M" within 1..max
+func parseRange(field string, max int) (first, last int, ok bool) {
+	from, to, isRange := strings.Cut(field, "-")
+	first, err := strconv.Atoi(from)
+	if err != nil {
+		return 0, 0, false
+	}
+	last = first
+	if isRange {
+		if last, err = strconv.Atoi(to); err != nil {
+			return 0, 0, false
+		}
+	}
+	if first < 1 || last > max || first > last {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// orphanCascade works out which further packages become orphans once
+// remove is gone. pacman -Rns takes most of them along; the rest are offered
+// in the next round.
+func (a *ArchMaintenance) orphanCascade(remove []string) []string {
+	local, err := a.packageDB().Local()
+	if err != nil {
+		return nil
+	}
+
+	// Orphans left in place on purpose are not news
+	gone := make(map[string]bool)
+	kept := make(map[string]bool)
+	for _, pkg := range pacmandb.Orphans(local, false) {
+		kept[pkg.Name] = true
+	}
+	for _, name := range remove {
+		gone[name] = true
+	}
+
+	var cascade []string
+	for {
+		var remaining []*pacmandb.Package
+		for _, pkg := range local {
+			if !gone[pkg.Name] {
+				remaining = append(remaining, pkg)
+			}
+		}
+
+		found := false
+		for _, pkg := range pacmandb.Orphans(remaining, false) {
+			if !kept[pkg.Name] && !contains(a.config.OrphansIgnore, pkg.Name) {
+				gone[pkg.Name] = true
+				cascade = append(cascade, pkg.Name)
+				found = true
+			}
+		}
+		if !found {
+			return cascade
+		}
+		local = remaining
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import "testing"
+
+// orphanRunner scripts pacman's orphan queries: one -Qtdq answer per
+// round, then none left
+func orphanRunner(rounds ...string) *FakeRunner {
+	fake := NewFakeRunner()
+	for _, orphans := range rounds {
+		fake.On("pacman -Qtdq", FakeResponse{Stdout: orphans})
+		fake.On("pacman -Qttdq", FakeResponse{Stdout: orphans})
+	}
+	fake.On("pacman -Qtdq", FakeResponse{ExitCode: 1})
+	fake.On("pacman -Qttdq", FakeResponse{ExitCode: 1})
+	return fake
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	fake := orphanRunner("pyfoo\nlibbar\n").
+		On("sudo pacman -Rns --noconfirm pyfoo libbar", FakeResponse{})
+	a := newTestApp(t, fake)
+	a.config.AllowDangerous = true
+
+	a.removeOrphans()
+
+	assertCommands(t, fake,
+		"pacman -Qtdq", "pacman -Qttdq",
+		"sudo pacman -Rns --noconfirm pyfoo libbar",
+		"pacman -Qtdq", "pacman -Qttdq",
+	)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestRemoveOrphansCascade(t *testing.T) {
+	fake := orphanRunner("pyfoo\n", "libfoo\n").
+		On("sudo pacman -Rns --noconfirm pyfoo", FakeResponse{}).
+		On("sudo pacman -Rns --noconfirm libfoo", FakeResponse{})
+	a := newTestApp(t, fake)
+	a.config.AllowDangerous = true
+
+	a.removeOrphans()
+
+	assertCommands(t, fake,
+		"pacman -Qtdq", "pacman -Qttdq",
+		"sudo pacman -Rns --noconfirm pyfoo",
+		"pacman -Qtdq", "pacman -Qttdq",
+		"sudo pacman -Rns --noconfirm libfoo",
+		"pacman -Qtdq", "pacman -Qttdq",
+	)
+}
+
+func TestRemoveOrphansExcluded(t *testing.T) {
+	fake := orphanRunner("pyfoo\nlibbar\n").
+		On("sudo pacman -Rns --noconfirm libbar", FakeResponse{})
+	a := newTestApp(t, fake)
+	a.config.AllowDangerous = true
+	a.config.OrphansIgnore = []string{"pyfoo"}
+
+	a.removeOrphans()
+
+	assertCommands(t, fake,
+		"pacman -Qtdq", "pacman -Qttdq",
+		"sudo pacman -Rns --noconfirm libbar",
+		"pacman -Qtdq", "pacman -Qttdq",
+	)
+}
+
+func TestRemoveOrphansNeedsAllowDangerous(t *testing.T) {
+	fake := orphanRunner("pyfoo\n")
+	a := newTestApp(t, fake)
+
+	a.removeOrphans()
+
+	assertCommands(t, fake, "pacman -Qtdq", "pacman -Qttdq")
+	if code := a.status.exitCode(); code != exitAborted {
+		t.Errorf("exit code = %d, want %d", code, exitAborted)
+	}
+}
+
+func TestRemoveOrphansFailure(t *testing.T) {
+	fake := orphanRunner("pyfoo\n").
+		On("sudo pacman -Rns --noconfirm pyfoo", FakeResponse{ExitCode: 1})
+	a := newTestApp(t, fake)
+	a.config.AllowDangerous = true
+
+	a.removeOrphans()
+
+	// A failed removal ends the run instead of looking for more orphans
+	assertCommands(t, fake, "pacman -Qtdq", "pacman -Qttdq", "sudo pacman -Rns --noconfirm pyfoo")
+	if code := a.status.exitCode(); code != exitFailure {
+		t.Errorf("exit code = %d, want %d", code, exitFailure)
+	}
+}
+
+func TestRemoveOrphansNone(t *testing.T) {
+	fake := orphanRunner()
+	a := newTestApp(t, fake)
+
+	a.removeOrphans()
+
+	assertCommands(t, fake, "pacman -Qtdq", "pacman -Qttdq")
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"archmaint/internal/vercmp"
+)
+
+// cachedPackage is one package file in a pacman cache directory. Size
+// includes the detached signature when there is one.
+type cachedPackage struct {
+	Path    string
+	SigPath string
+	Name    string
+	Version string
+	Arch    string
+	Size    int64
+	ModTime time.Time
+}
+
+// parsePackageFilename splits name-pkgver-pkgrel-arch.pkg.tar[.ext]
+func parsePackageFilename(file string) (name, version, arch string, ok bool) {
+	i := strings.Index(file, ".pkg.tar")
+	if i < 0 || strings.HasSuffix(file, ".sig") || strings.HasSuffix(file, ".part") {
+		return "", "", "", false
+	}
+
+	parts := strings.Split(file[:i], "-")
+	if len(parts) < 4 {
+		return "", "", "", false
+	}
+	n := len(parts)
+	name = strings.Join(parts[:n-3], "-")
+	version = parts[n-3] + "-" + parts[n-2]
+	arch = parts[n-1]
+	return name, version, arch, name != ""
+}
+
+// packageCacheDirs returns the CacheDir entries of pacman.conf
+func (a *ArchMaintenance) packageCacheDirs() []string {
+	return a.packageDB().CacheDirs()
+}
+
+// scanPackageCache lists the package files in dirs. Directories that do not
+// exist are skipped.
+func scanPackageCache(dirs []string) ([]cachedPackage, error) {
+	var pkgs []cachedPackage
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		present := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			present[entry.Name()] = true
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			name, version, arch, ok := parsePackageFilename(entry.Name())
+			if !ok {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			pkg := cachedPackage{
+				Path:    filepath.Join(dir, entry.Name()),
+				Name:    name,
+				Version: version,
+				Arch:    arch,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}
+			if sig := entry.Name() + ".sig"; present[sig] {
+				pkg.SigPath = filepath.Join(dir, sig)
+				if sigInfo, err := os.Stat(pkg.SigPath); err == nil {
+					pkg.Size += sigInfo.Size()
+				}
+			}
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
+
+// groupCachedPackages groups cache entries by name and architecture, newest
+// version first within each group
+func groupCachedPackages(pkgs []cachedPackage) map[string][]cachedPackage {
+	groups := make(map[string][]cachedPackage)
+	for _, pkg := range pkgs {
+		key := pkg.Name + " " + pkg.Arch
+		groups[key] = append(groups[key], pkg)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return vercmp.Compare(group[i].Version, group[j].Version) > 0
+		})
+	}
+	return groups
+}
+
+// cacheBeyondRetention returns the entries the retention policy lets go:
+// older than the newest keep versions of their package, last written more
+// than days ago, and not the installed version
+func cacheBeyondRetention(pkgs []cachedPackage, installed map[string]string, keep, days int) []cachedPackage {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	var remove []cachedPackage
+	for _, group := range groupCachedPackages(pkgs) {
+		for i, pkg := range group {
+			if i < keep || !pkg.ModTime.Before(cutoff) || installed[pkg.Name] == pkg.Version {
+				continue
+			}
+			remove = append(remove, pkg)
+		}
+	}
+	return remove
+}
+
+// cacheOfUninstalled returns the entries of packages that are not
+// installed, like paccache -ruk0
+func cacheOfUninstalled(pkgs []cachedPackage, installed map[string]string) []cachedPackage {
+	var remove []cachedPackage
+	for _, pkg := range pkgs {
+		if _, ok := installed[pkg.Name]; !ok {
+			remove = append(remove, pkg)
+		}
+	}
+	return remove
+}
+
+func cacheSize(pkgs []cachedPackage) int64 {
+	var total int64
+	for _, pkg := range pkgs {
+		total += pkg.Size
+	}
+	return total
+}
+
+// cacheRetentionPlan lists what the Package Cache task would remove
+func (a *ArchMaintenance) cacheRetentionPlan() ([]cachedPackage, error) {
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		return nil, err
+	}
+	// Without the installed versions nothing can be removed safely
+	installed, err := a.installedVersions()
+	if err != nil {
+		return nil, err
+	}
+	return cacheBeyondRetention(cache, installed, a.config.CacheKeepVersions, a.config.CacheRetentionDays), nil
+}
+
+// uninstalledCachePlan lists what the Uninstalled Package Cache task would
+// remove
+func (a *ArchMaintenance) uninstalledCachePlan() ([]cachedPackage, error) {
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		return nil, err
+	}
+	installed, err := a.installedVersions()
+	if err != nil {
+		return nil, err
+	}
+	return cacheOfUninstalled(cache, installed), nil
+}
+
+// pruneCache removes the planned package files and their signatures, or
+// lists them in dry-run
+func (a *ArchMaintenance) pruneCache(plan func() ([]cachedPackage, error)) {
+	remove, err := plan()
+	if err != nil {
+		errorColor.Printf("  Failed to read the package cache: %v\n", err)
+		a.status.failures++
+		return
+	}
+	if len(remove) == 0 {
+		fmt.Println("  Nothing to remove")
+		return
+	}
+
+	sort.SliceStable(remove, func(i, j int) bool {
+		if remove[i].Name != remove[j].Name {
+			return remove[i].Name < remove[j].Name
+		}
+		return vercmp.Compare(remove[i].Version, remove[j].Version) > 0
+	})
+	freed := formatSize(cacheSize(remove))
+
+	if a.config.DryRun {
+		for _, pkg := range remove {
+			fmt.Printf("  Would remove: %s %s (%s)\n", pkg.Name, pkg.Version, formatSize(pkg.Size))
+		}
+		fmt.Printf("  Would free %s in %d packages\n", freed, len(remove))
+		return
+	}
+
+	var paths []string
+	for _, pkg := range remove {
+		paths = append(paths, pkg.Path)
+		if pkg.SigPath != "" {
+			paths = append(paths, pkg.SigPath)
+		}
+	}
+
+	// Batches keep the command line well below ARG_MAX
+	failures := a.status.failures
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > 100 {
+			n = 100
+		}
+		a.runCommand("sudo", append([]string{"rm", "-f", "--"}, paths[:n]...)...)
+		paths = paths[n:]
+	}
+	if a.status.failures == failures {
+		successColor.Printf("  Freed %s in %d packages\n", freed, len(remove))
+	}
+}
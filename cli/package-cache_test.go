@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCache creates package files in dir, each last written the given
+// number of days ago
+func writeCache(t *testing.T, dir string, files map[string]int) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, age := range files {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stamp := time.Now().AddDate(0, 0, -age)
+		if err := os.Chtimes(path, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSystemClean(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	a.config.CacheKeepVersions = 1
+	a.config.CacheRetentionDays = 30
+	a.config.LogRetentionDays = 7
+
+	cache := filepath.Join(a.config.PacmanRoot, "var/cache/pacman/pkg")
+	writeCache(t, cache, map[string]int{
+		"vim-9.1.0-2-x86_64.pkg.tar.zst":     1,
+		"vim-9.1.0-1-x86_64.pkg.tar.zst":     60,
+		"vim-9.1.0-1-x86_64.pkg.tar.zst.sig": 60,
+		"vim-9.0.0-1-x86_64.pkg.tar.zst":     90,
+		"glibc-2.38-7-x86_64.pkg.tar.zst":    90,
+		"htop-3.3.0-1-x86_64.pkg.tar.zst":    1,
+	})
+	oldVim := []string{
+		filepath.Join(cache, "vim-9.1.0-1-x86_64.pkg.tar.zst"),
+		filepath.Join(cache, "vim-9.1.0-1-x86_64.pkg.tar.zst.sig"),
+		filepath.Join(cache, "vim-9.0.0-1-x86_64.pkg.tar.zst"),
+	}
+	htop := filepath.Join(cache, "htop-3.3.0-1-x86_64.pkg.tar.zst")
+	userCache := []string{"bash", "-c", "find ~/.cache -type f -atime +30 -delete 2>/dev/null || true"}
+
+	// There is no local database under the test root, so the installed
+	// versions come from pacman -Q
+	fake.
+		On("pacman -Q", FakeResponse{Stdout: "glibc 2.38-7\nvim 9.1.0-2\n"}).
+		On(joinCommandLine(append([]string{"sudo", "rm", "-f", "--"}, oldVim...)), FakeResponse{}).
+		On("sudo rm -f -- "+htop, FakeResponse{}).
+		On("sudo journalctl --vacuum-time=7d", FakeResponse{}).
+		On("sudo find /tmp /var/tmp -type f -atime +7 -delete", FakeResponse{}).
+		On(joinCommandLine(userCache), FakeResponse{})
+
+	a.systemClean()
+
+	// The installed glibc stays however old it is; the rm commands are
+	// faked, so the second plan still sees the vim files but keeps them
+	assertCommands(t, fake,
+		"pacman -Q",
+		joinCommandLine(append([]string{"sudo", "rm", "-f", "--"}, oldVim...)),
+		"pacman -Q",
+		"sudo rm -f -- "+htop,
+		"sudo journalctl --vacuum-time=7d",
+		"sudo find /tmp /var/tmp -type f -atime +7 -delete",
+		joinCommandLine(userCache),
+	)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestSystemCleanDryRun(t *testing.T) {
+	fake := NewFakeRunner().On("pacman -Q", FakeResponse{Stdout: "vim 9.1.0-2\n"})
+	a := newTestApp(t, &DryRunRunner{Next: fake})
+	a.config.DryRun = true
+
+	writeCache(t, filepath.Join(a.config.PacmanRoot, "var/cache/pacman/pkg"), map[string]int{
+		"vim-9.1.0-2-x86_64.pkg.tar.zst":  1,
+		"htop-3.3.0-1-x86_64.pkg.tar.zst": 1,
+	})
+
+	a.systemClean()
+
+	// Only the read-only queries reach the system
+	assertCommands(t, fake, "pacman -Q", "pacman -Q")
+	if _, err := os.Stat(filepath.Join(a.config.PacmanRoot, "var/cache/pacman/pkg/htop-3.3.0-1-x86_64.pkg.tar.zst")); err != nil {
+		t.Errorf("dry run removed a package: %v", err)
+	}
+}
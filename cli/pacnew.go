@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"archmaint/internal/vercmp"
+)
+
+// PacnewFile is a .pacnew or .pacsave file waiting to be dealt with
+type PacnewFile struct {
+	// Path is the .pacnew or .pacsave file, Target the live file it
+	// belongs to
+	Path   string
+	Target string
+	// Kind is "pacnew" or "pacsave"
+	Kind string
+}
+
+var (
+	pacnewSuffix = regexp.MustCompile(`\.(pacnew|pacsave)(\.\d+)?$`)
+	pacnewLog    = regexp.MustCompile(`warning: (\S+) (?:installed|saved) as (\S+)$`)
+)
+
+// parsePacnewPath splits a .pacnew or .pacsave[.N] path into its target
+// and kind
+func parsePacnewPath(path string) (PacnewFile, bool) {
+	m := pacnewSuffix.FindStringSubmatchIndex(path)
+	if m == nil || (m[4] >= 0 && path[m[2]:m[3]] == "pacnew") {
+		return PacnewFile{}, false
+	}
+	return PacnewFile{Path: path, Target: path[:m[0]], Kind: path[m[2]:m[3]]}, true
+}
+
+func (a *ArchMaintenance) pacmanLogPath() string {
+	return filepath.Join(a.config.PacmanRoot, "var/log/pacman.log")
+}
+
+// findPacnewFiles gathers the .pacnew and .pacsave files pacman.log
+// mentions and those found under /etc that still exist
+func (a *ArchMaintenance) findPacnewFiles() ([]PacnewFile, error) {
+	found := make(map[string]PacnewFile)
+	add := func(path string) {
+		if f, ok := parsePacnewPath(path); ok {
+			if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+				found[path] = f
+			}
+		}
+	}
+
+	if log, err := os.Open(a.pacmanLogPath()); err == nil {
+		scanner := bufio.NewScanner(log)
+		for scanner.Scan() {
+			if m := pacnewLog.FindStringSubmatch(scanner.Text()); m != nil {
+				add(filepath.Join(a.config.PacmanRoot, m[2]))
+			}
+		}
+		log.Close()
+	}
+
+	etc := filepath.Join(a.config.PacmanRoot, "etc")
+	err := filepath.WalkDir(etc, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped, not fatal
+			if d != nil && d.IsDir() && path != etc {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			add(path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	files := make([]PacnewFile, 0, len(found))
+	for _, f := range found {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// fileDiff returns diff -u from one file to another; identical files give
+// an empty diff
+func (a *ArchMaintenance) fileDiff(from, to string) (string, error) {
+	output, err := a.query("diff", "-u", from, to)
+	if exitErr, ok := err.(*ExitError); ok && exitErr.Code == 1 {
+		err = nil
+	}
+	return string(output), err
+}
+
+func printDiff(diff string) {
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			headerColor.Println(line)
+		case strings.HasPrefix(line, "@@"):
+			infoColor.Println(line)
+		case strings.HasPrefix(line, "+"):
+			successColor.Println(line)
+		case strings.HasPrefix(line, "-"):
+			errorColor.Println(line)
+		default:
+			fmt.Println(line)
+		}
+	}
+}
+
+// pacnewBase extracts the file as the previous version of its package
+// shipped it, from the package cache. That is the common ancestor of the
+// live file and the .pacnew for a three-way merge.
+func (a *ArchMaintenance) pacnewBase(f PacnewFile) ([]byte, error) {
+	owner, err := a.query("pacman", "-Qoq", f.Target)
+	if err != nil {
+		return nil, fmt.Errorf("no package owns %s", f.Target)
+	}
+	name := strings.TrimSpace(string(owner))
+
+	installed, err := a.installedVersions()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := scanPackageCache(a.packageCacheDirs())
+	if err != nil {
+		return nil, err
+	}
+
+	// Groups are sorted newest first, so the first older version is the
+	// one that was upgraded from
+	for _, group := range groupCachedPackages(cache) {
+		for _, pkg := range group {
+			if pkg.Name != name || vercmp.Compare(pkg.Version, installed[name]) >= 0 {
+				continue
+			}
+			member := strings.TrimPrefix(strings.TrimPrefix(f.Target, a.config.PacmanRoot), "/")
+			return a.query("bsdtar", "-xOf", pkg.Path, member)
+		}
+	}
+	return nil, fmt.Errorf("no cached package of %s older than %s", name, installed[name])
+}
+
+// mergePacnew merges the .pacnew changes into the live file with diff3.
+// conflicts reports whether the result holds conflict markers.
+func (a *ArchMaintenance) mergePacnew(f PacnewFile, dir string) (merged string, conflicts bool, err error) {
+	base, err := a.pacnewBase(f)
+	if err != nil {
+		return "", false, err
+	}
+	basePath := filepath.Join(dir, "base")
+	if err := os.WriteFile(basePath, base, 0600); err != nil {
+		return "", false, err
+	}
+
+	output, err := a.query("diff3", "-m", "-L", "current", "-L", "original", "-L", "new", f.Target, basePath, f.Path)
+	if exitErr, ok := err.(*ExitError); ok && exitErr.Code == 1 {
+		conflicts, err = true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	merged = filepath.Join(dir, "merged")
+	return merged, conflicts, os.WriteFile(merged, output, 0600)
+}
+
+// backupConfigFile copies path into the files/ tree of this session's
+// backup directory
+func (a *ArchMaintenance) backupConfigFile(backupDir, path string) error {
+	dest := filepath.Join(backupDir, "files", strings.TrimPrefix(path, a.config.PacmanRoot))
+	if a.config.DryRun {
+		fmt.Printf("  Would back up %s to %s\n", path, dest)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(path, dest); err != nil {
+		return err
+	}
+	infoColor.Printf("  Backed up %s to %s\n", path, dest)
+	return nil
+}
+
+// replaceConfigFile installs content as the new version of a root-owned
+// file, after a copy of the old one went to a fresh backup directory. It
+// reports whether the file was replaced.
+func (a *ArchMaintenance) replaceConfigFile(path string, content []byte) bool {
+	tmp, err := os.CreateTemp("", "archmaint-"+filepath.Base(path)+"-")
+	if err != nil {
+		errorColor.Printf("Could not write %s: %v\n", path, err)
+		a.status.failures++
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		errorColor.Printf("Could not write %s: %v\n", path, err)
+		a.status.failures++
+		return false
+	}
+
+	backupDir := filepath.Join(a.config.BackupPath, time.Now().Format("2006-01-02_15-04-05"))
+	if err := a.backupConfigFile(backupDir, path); err != nil {
+		errorColor.Printf("Backup failed, leaving %s alone: %v\n", path, err)
+		a.status.failures++
+		return false
+	}
+
+	failures := a.status.failures
+	// cp onto the existing file keeps its owner and mode
+	a.runCommand("sudo", "cp", "--", tmp.Name(), path)
+	return a.status.failures == failures
+}
+
+// resolvePacnew applies one choice. Files under /etc belong to root, so
+// changes go through sudo.
+func (a *ArchMaintenance) resolvePacnew(f PacnewFile, choice, backupDir string) {
+	failures := a.status.failures
+	switch choice {
+	case "k":
+		a.runCommand("sudo", "rm", "-f", "--", f.Path)
+	case "r":
+		if _, err := os.Stat(f.Target); err == nil {
+			if err := a.backupConfigFile(backupDir, f.Target); err != nil {
+				errorColor.Printf("  Backup failed, leaving %s alone: %v\n", f.Target, err)
+				a.status.failures++
+				return
+			}
+		}
+		a.runCommand("sudo", "mv", "-f", "--", f.Path, f.Target)
+	case "m":
+		dir, err := os.MkdirTemp("", "archmaint-merge-")
+		if err != nil {
+			errorColor.Printf("  Merge failed: %v\n", err)
+			a.status.failures++
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		merged, conflicts, err := a.mergePacnew(f, dir)
+		if err != nil {
+			errorColor.Printf("  Merge failed: %v\n", err)
+			a.status.failures++
+			return
+		}
+		if conflicts {
+			warningColor.Println("  The merge has conflicts; resolve the marked sections in the editor.")
+			editor := os.Getenv("EDITOR")
+			if editor == "" {
+				editor = "vi"
+			}
+			a.viewCommand(editor, merged)
+		}
+
+		diff, err := a.fileDiff(f.Target, merged)
+		if err != nil {
+			errorColor.Printf("  Merge failed: %v\n", err)
+			a.status.failures++
+			return
+		}
+		printDiff(diff)
+		if data, _ := os.ReadFile(merged); bytes.Contains(data, []byte("<<<<<<<")) {
+			errorColor.Println("  Conflict markers remain; not installing the merge.")
+			return
+		}
+		if !a.confirmAction("Install the merged file?", false) {
+			return
+		}
+		if err := a.backupConfigFile(backupDir, f.Target); err != nil {
+			errorColor.Printf("  Backup failed, leaving %s alone: %v\n", f.Target, err)
+			a.status.failures++
+			return
+		}
+		// cp onto the existing file keeps its owner and mode
+		a.runCommand("sudo", "cp", "--", merged, f.Target)
+		if a.status.failures != failures {
+			// Keep the .pacnew so the merge can be redone
+			return
+		}
+		a.runCommand("sudo", "rm", "-f", "--", f.Path)
+	default:
+		return
+	}
+	if a.status.failures == failures && !a.config.DryRun {
+		successColor.Printf("  Resolved %s\n", f.Path)
+	}
+}
+
+func (a *ArchMaintenance) managePacnew() {
+	headerColor.Println("\n=== PACNEW / PACSAVE FILES ===")
+
+	files, err := a.findPacnewFiles()
+	if err != nil {
+		errorColor.Printf("Failed to look for .pacnew files: %v\n", err)
+		a.status.failures++
+		return
+	}
+	if len(files) == 0 {
+		successColor.Println("No .pacnew or .pacsave files found!")
+		return
+	}
+
+	fmt.Printf("Found %d files:\n", len(files))
+	for _, f := range files {
+		fmt.Printf("  • %s\n", f.Path)
+	}
+
+	// Every file replaced in this session is backed up into one directory
+	backupDir := filepath.Join(a.config.BackupPath, time.Now().Format("2006-01-02_15-04-05"))
+
+	for _, f := range files {
+		headerColor.Printf("\n%s\n", f.Path)
+
+		if _, err := os.Stat(f.Target); err != nil {
+			infoColor.Printf("%s does not exist\n", f.Target)
+		} else if diff, err := a.fileDiff(f.Target, f.Path); err != nil {
+			warningColor.Printf("Could not compare with %s: %v\n", f.Target, err)
+		} else if diff == "" {
+			infoColor.Printf("Identical to %s\n", f.Target)
+		} else {
+			printDiff(diff)
+		}
+
+		if a.config.NonInteractive {
+			continue
+		}
+
+		var prompt string
+		if f.Kind == "pacnew" {
+			prompt = "[k]eep current, [r]eplace with .pacnew, [m]erge, [s]kip: "
+		} else {
+			prompt = "[k]eep current, [r]estore .pacsave, [s]kip: "
+		}
+		fmt.Print(prompt)
+		input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		choice := strings.ToLower(strings.TrimSpace(input))
+		if choice == "m" && f.Kind != "pacnew" {
+			choice = ""
+		}
+		a.resolvePacnew(f, choice, backupDir)
+	}
+
+	if a.config.NonInteractive {
+		infoColor.Println("\nRun 'archmaint pacnew' interactively to resolve them.")
+	}
+	a.waitForContinue()
+}
+
+func (a *ArchMaintenance) checkPacnewFiles() HealthCheckResult {
+	threshold := "no unresolved .pacnew or .pacsave files"
+
+	files, err := a.findPacnewFiles()
+	if err != nil {
+		return unknownResult(threshold, err)
+	}
+
+	result := HealthCheckResult{Status: HealthOK, Value: "none", Threshold: threshold}
+	if len(files) > 0 {
+		result.Status = HealthWarn
+		result.Value = fmt.Sprintf("%d unresolved", len(files))
+		result.Message = fmt.Sprintf("%d .pacnew or .pacsave files need attention", len(files))
+		result.Hint = "Resolve them with 'archmaint pacnew'"
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fixture is one recorded command invocation, stored as a JSON file. A
+// LookPath fixture records an executable lookup instead: Stdout holds the
+// path found, empty when there was none.
+type Fixture struct {
+	Seq      int      `json:"seq"`
+	Name     string   `json:"name"`
+	Args     []string `json:"args"`
+	ReadOnly bool     `json:"read_only"`
+	LookPath bool     `json:"look_path,omitempty"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	ExitCode int      `json:"exit_code"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (f *Fixture) commandLine() string {
+	return joinCommandLine(append([]string{f.Name}, f.Args...))
+}
+
+// fixturePaths are machine-specific paths that fixtures store as
+// placeholders, so that a recording replays for another user or TMPDIR
+func fixturePaths() [][2]string {
+	return [][2]string{{syncDBDir(), "$SYNC_DB"}}
+}
+
+// normalizeArgs replaces machine-specific paths in args by placeholders
+func normalizeArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		for _, p := range fixturePaths() {
+			arg = strings.ReplaceAll(arg, p[0], p[1])
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+// expandArgs is the inverse of normalizeArgs for the current machine
+func expandArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		for _, p := range fixturePaths() {
+			arg = strings.ReplaceAll(arg, p[1], p[0])
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+// RecordingRunner runs commands through Next and writes every invocation
+// with its output and exit code into Dir as NNNN-name.json
+type RecordingRunner struct {
+	Next CommandRunner
+	Dir  string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func NewRecordingRunner(next CommandRunner, dir string) (*RecordingRunner, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &RecordingRunner{Next: next, Dir: dir}, nil
+}
+
+func (r *RecordingRunner) Run(cmd *Cmd) (*Result, error) {
+	// Tee streamed output so the fixture sees what the terminal saw
+	var stdout, stderr bytes.Buffer
+	recorded := *cmd
+	if cmd.Stdout != nil {
+		recorded.Stdout = io.MultiWriter(cmd.Stdout, &stdout)
+	}
+	if cmd.Stderr != nil {
+		recorded.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	}
+
+	result, err := r.Next.Run(&recorded)
+
+	fixture := Fixture{
+		Name:     cmd.Name,
+		Args:     normalizeArgs(cmd.Args),
+		ReadOnly: cmd.ReadOnly,
+	}
+	if result != nil {
+		fixture.ExitCode = result.ExitCode
+		stdout.Write(result.Stdout)
+		stderr.Write(result.Stderr)
+	}
+	fixture.Stdout = stdout.String()
+	fixture.Stderr = stderr.String()
+	if err != nil && fixture.ExitCode == 0 {
+		fixture.Error = err.Error()
+	}
+
+	if werr := r.write(&fixture); werr != nil {
+		errorColor.Printf("Failed to record %s: %v\n", cmd, werr)
+	}
+	return result, err
+}
+
+// LookPath looks name up through Next and records the result
+func (r *RecordingRunner) LookPath(name string) (string, error) {
+	path, err := r.Next.LookPath(name)
+
+	fixture := Fixture{Name: name, Args: []string{}, ReadOnly: true, LookPath: true, Stdout: path}
+	if err != nil {
+		fixture.Error = err.Error()
+	}
+	if werr := r.write(&fixture); werr != nil {
+		errorColor.Printf("Failed to record lookup of %s: %v\n", name, werr)
+	}
+	return path, err
+}
+
+func (r *RecordingRunner) write(fixture *Fixture) error {
+	r.mu.Lock()
+	r.seq++
+	fixture.Seq = r.seq
+	r.mu.Unlock()
+
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%04d-%s.json", fixture.Seq, filepath.Base(fixture.Name))
+	if fixture.LookPath {
+		name = fmt.Sprintf("%04d-lookpath-%s.json", fixture.Seq, filepath.Base(fixture.Name))
+	}
+	return os.WriteFile(filepath.Join(r.Dir, name), append(data, '\n'), 0644)
+}
+
+// LoadFixtures reads every fixture in dir ordered by sequence number
+func LoadFixtures(dir string) ([]Fixture, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures []Fixture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fixture Fixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+
+	sort.Slice(fixtures, func(i, j int) bool { return fixtures[i].Seq < fixtures[j].Seq })
+	return fixtures, nil
+}
+
+// NewReplayRunner serves recorded fixtures back. Repeated invocations of
+// the same command line get their recorded responses in order, so a
+// session replays exactly as it was captured.
+func NewReplayRunner(fixtures []Fixture) *FakeRunner {
+	fake := NewFakeRunner()
+	for _, fixture := range fixtures {
+		if fixture.LookPath {
+			fake.OnLookPath(fixture.Name, fixture.Stdout)
+			continue
+		}
+		resp := FakeResponse{
+			Stdout:   fixture.Stdout,
+			Stderr:   fixture.Stderr,
+			ExitCode: fixture.ExitCode,
+		}
+		if fixture.Error != "" {
+			resp.Err = fmt.Errorf("%s", fixture.Error)
+		}
+		fixture.Args = expandArgs(fixture.Args)
+		fake.On(fixture.commandLine(), resp)
+	}
+	return fake
+}
+
+// ReplayRunnerFromDir loads fixtures from dir into a replay runner
+func ReplayRunnerFromDir(dir string) (*FakeRunner, error) {
+	fixtures, err := LoadFixtures(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(fixtures) == 0 {
+		return nil, fmt.Errorf("no fixtures in %s", dir)
+	}
+	return NewReplayRunner(fixtures), nil
+}
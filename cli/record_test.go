@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// captureOutput returns what fn prints to stdout, without colors
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, output, noColor := os.Stdout, color.Output, color.NoColor
+	os.Stdout, color.Output, color.NoColor = w, w, true
+	defer func() {
+		os.Stdout, color.Output, color.NoColor = stdout, output, noColor
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// replayApp replays the session recorded in testdata/fixtures/<name>
+// against the system in testdata/root. The servers in its mirrorlist are
+// relative file://testdata/mirrors URLs, which only resolve while the
+// tests run in this directory, as go test does.
+func replayApp(t *testing.T, name string) *ArchMaintenance {
+	t.Helper()
+	a := newTestApp(t, NewFakeRunner())
+	root, err := filepath.Abs(filepath.Join("testdata", "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.config.PacmanRoot = root
+	captureOutput(t, func() {
+		if err := a.useFixtures("replay", filepath.Join("testdata", "fixtures", name)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return a
+}
+
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".txt")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n%s", path, got)
+	}
+}
+
+func TestReplayStatus(t *testing.T) {
+	a := replayApp(t, "status")
+	assertGolden(t, "status", captureOutput(t, a.showSystemStatus))
+}
+
+func TestReplayHealth(t *testing.T) {
+	a := replayApp(t, "health")
+	assertGolden(t, "health", captureOutput(t, a.systemHealthCheck))
+	if code := a.status.exitCode(); code != exitHealth {
+		t.Errorf("exit code = %d, want %d", code, exitHealth)
+	}
+}
+
+func TestReplayUpdate(t *testing.T) {
+	a := replayApp(t, "update")
+	assertGolden(t, "update", captureOutput(t, a.systemUpdate))
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestRecordingReplaysElsewhere(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", t.TempDir())
+	recorded := syncDBDir()
+
+	fake := NewFakeRunner().On("pacman -Qu --dbpath "+recorded, FakeResponse{Stdout: "vim 9.1.0-1 -> 9.1.0-2\n"})
+	recorder, err := NewRecordingRunner(fake, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recorder.Run(&Cmd{Name: "pacman", Args: []string{"-Qu", "--dbpath", recorded}, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "0001-pacman.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(recorded)) {
+		t.Errorf("fixture contains the machine-specific path %s:\n%s", recorded, data)
+	}
+
+	// Another user or TMPDIR gets the same answer for its own copy
+	t.Setenv("TMPDIR", t.TempDir())
+	replay, err := ReplayRunnerFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := replay.Run(&Cmd{Name: "pacman", Args: []string{"-Qu", "--dbpath", syncDBDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "vim 9.1.0-1 -> 9.1.0-2\n" {
+		t.Errorf("replayed stdout = %q", result.Stdout)
+	}
+}
+
+func TestRecordAndReplayExclusive(t *testing.T) {
+	_, err := parseArgs([]string{"--record", t.TempDir(), "--replay", "testdata/fixtures/status", "status"})
+	if _, ok := err.(*usageError); !ok {
+		t.Errorf("parseArgs() error = %v, want a usage error", err)
+	}
+}
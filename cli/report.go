@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"archmaint/internal/pacmandb"
+	"archmaint/internal/pacmanlog"
+)
+
+// Machine-readable output
+//
+// With --output json or --output yaml the status, health, orphans, update
+// and backups commands print exactly one Report document on stdout instead
+// of colored text, and every human-oriented message goes to stderr. Nothing
+// is changed on the system in this mode: orphans and update only list what
+// they would act on. health still appends the run to the health history,
+// as it does in text mode.
+//
+// Schema version 1. The envelope is
+//
+//	schema_version  int     ReportSchemaVersion
+//	kind            string  status | health | health_history | orphans |
+//	                        updates | backups | history | mirrors
+//	generated_at    string  RFC 3339 timestamp
+//	data            object  StatusReport, HealthReport, HealthHistoryReport,
+//	                        OrphansReport, UpdatesReport, BackupsReport,
+//	                        HistoryReport or MirrorsReport, matching kind
+//
+// Within a schema version fields are only ever added. Renaming or removing
+// a field, or changing its type or meaning, bumps ReportSchemaVersion.
+const ReportSchemaVersion = 1
+
+// Report is the envelope around every machine-readable document
+type Report struct {
+	SchemaVersion int         `json:"schema_version" yaml:"schema_version"`
+	Kind          string      `json:"kind" yaml:"kind"`
+	GeneratedAt   time.Time   `json:"generated_at" yaml:"generated_at"`
+	Data          interface{} `json:"data" yaml:"data"`
+}
+
+// StatusReport is the data of kind "status"
+type StatusReport struct {
+	System   SystemInfo    `json:"system" yaml:"system"`
+	Packages PackageCounts `json:"packages" yaml:"packages"`
+	Disks    []DiskUsage   `json:"disks" yaml:"disks"`
+}
+
+// PackageCounts summarises the local package database. A count is -1 when
+// it could not be determined.
+type PackageCounts struct {
+	Installed int `json:"installed" yaml:"installed"`
+	Explicit  int `json:"explicit" yaml:"explicit"`
+	Orphans   int `json:"orphans" yaml:"orphans"`
+	Updates   int `json:"updates" yaml:"updates"`
+}
+
+// DiskUsage is one mounted filesystem as reported by df. Status is "ok",
+// "warning" or "critical" against the HEALTH_DISK_* thresholds.
+type DiskUsage struct {
+	Filesystem  string `json:"filesystem" yaml:"filesystem"`
+	Mount       string `json:"mount" yaml:"mount"`
+	Size        string `json:"size" yaml:"size"`
+	Used        string `json:"used" yaml:"used"`
+	Available   string `json:"available" yaml:"available"`
+	UsedPercent int    `json:"used_percent" yaml:"used_percent"`
+	Status      string `json:"status" yaml:"status"`
+}
+
+// HealthReport is the data of kind "health". Passed counts ok and warn
+// results. Score is weighted: ok earns a check its full weight, warn half
+// and critical nothing, out of the total weight of the checks that were
+// not unknown.
+type HealthReport struct {
+	Score    int                 `json:"score" yaml:"score"`
+	Passed   int                 `json:"passed" yaml:"passed"`
+	Total    int                 `json:"total" yaml:"total"`
+	Warnings int                 `json:"warnings" yaml:"warnings"`
+	Critical int                 `json:"critical" yaml:"critical"`
+	Unknown  int                 `json:"unknown" yaml:"unknown"`
+	Checks   []HealthCheckResult `json:"checks" yaml:"checks"`
+}
+
+// HealthCheckResult is the outcome of one health check, with the value it
+// measured and the threshold that value was held against. Passed is true
+// for status ok and warn.
+type HealthCheckResult struct {
+	Name        string        `json:"name" yaml:"name"`
+	Description string        `json:"description" yaml:"description"`
+	Status      HealthStatus  `json:"status" yaml:"status"`
+	Weight      int           `json:"weight" yaml:"weight"`
+	Passed      bool          `json:"passed" yaml:"passed"`
+	Value       string        `json:"value" yaml:"value"`
+	Threshold   string        `json:"threshold" yaml:"threshold"`
+	Message     string        `json:"message,omitempty" yaml:"message,omitempty"`
+	Hint        string        `json:"hint,omitempty" yaml:"hint,omitempty"`
+	Metric      *HealthMetric `json:"metric,omitempty" yaml:"metric,omitempty"`
+}
+
+// HealthMetric is the number behind a result and the levels at which it
+// becomes warn and critical
+type HealthMetric struct {
+	Label    string  `json:"label" yaml:"label"`
+	Value    float64 `json:"value" yaml:"value"`
+	Unit     string  `json:"unit" yaml:"unit"`
+	Warn     float64 `json:"warn" yaml:"warn"`
+	Critical float64 `json:"critical" yaml:"critical"`
+}
+
+// HealthHistoryReport is the data of kind "health_history", oldest run
+// first
+type HealthHistoryReport struct {
+	Runs        []HealthRun        `json:"runs" yaml:"runs"`
+	Regressions []HealthRegression `json:"regressions" yaml:"regressions"`
+}
+
+// HealthRun is one recorded health check run
+type HealthRun struct {
+	Time   time.Time        `json:"time" yaml:"time"`
+	Score  int              `json:"score" yaml:"score"`
+	Checks []HealthRunCheck `json:"checks" yaml:"checks"`
+}
+
+// HealthRunCheck is the part of a check result kept in the history
+type HealthRunCheck struct {
+	Name   string       `json:"name" yaml:"name"`
+	Status HealthStatus `json:"status" yaml:"status"`
+	Value  string       `json:"value" yaml:"value"`
+}
+
+// HealthRegression is a check whose status got worse between the last two
+// runs
+type HealthRegression struct {
+	Name     string       `json:"name" yaml:"name"`
+	Previous HealthStatus `json:"previous" yaml:"previous"`
+	Current  HealthStatus `json:"current" yaml:"current"`
+	Value    string       `json:"value" yaml:"value"`
+}
+
+// OrphansReport is the data of kind "orphans". Excluded holds orphans
+// kept by ORPHANS_IGNORE or --exclude.
+type OrphansReport struct {
+	Orphans  []string         `json:"orphans" yaml:"orphans"`
+	Excluded []string         `json:"excluded" yaml:"excluded"`
+	Optional []OptionalOrphan `json:"optional" yaml:"optional"`
+}
+
+// OptionalOrphan is a dependency that only optdepends of installed packages
+// still refer to. OptionalFor is empty when the databases were not readable.
+type OptionalOrphan struct {
+	Name        string   `json:"name" yaml:"name"`
+	OptionalFor []string `json:"optional_for" yaml:"optional_for"`
+}
+
+// HistoryReport is the data of kind "history", oldest transaction first
+type HistoryReport struct {
+	Log          string                  `json:"log" yaml:"log"`
+	Transactions []pacmanlog.Transaction `json:"transactions" yaml:"transactions"`
+}
+
+// MirrorsReport is the data of kind "mirrors", in mirrorlist order
+type MirrorsReport struct {
+	Path        string         `json:"path" yaml:"path"`
+	MaxAgeHours int            `json:"max_age_hours" yaml:"max_age_hours"`
+	Mirrors     []MirrorStatus `json:"mirrors" yaml:"mirrors"`
+}
+
+// MirrorStatus is one enabled server of the mirrorlist. Status is ok,
+// outdated or unreachable; LastSync is zero and LatencyMS -1 when the
+// mirror gave no usable answer.
+type MirrorStatus struct {
+	URL       string    `json:"url" yaml:"url"`
+	Status    string    `json:"status" yaml:"status"`
+	LastSync  time.Time `json:"last_sync" yaml:"last_sync"`
+	LatencyMS int64     `json:"latency_ms" yaml:"latency_ms"`
+	Error     string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// UpdatesReport is the data of kind "updates"
+type UpdatesReport struct {
+	Updates []PendingUpdate `json:"updates" yaml:"updates"`
+	// AUR lists foreign packages with a newer version in the AUR
+	AUR []PendingUpdate `json:"aur" yaml:"aur"`
+}
+
+// PendingUpdate is one line of pacman -Qu, completed from the sync
+// database. Sizes are in bytes and -1 when unknown. Bump is one of epoch,
+// major, minor, pkgrel or downgrade, or empty when the versions could not
+// be compared.
+type PendingUpdate struct {
+	Name          string `json:"name" yaml:"name"`
+	OldVersion    string `json:"old_version" yaml:"old_version"`
+	NewVersion    string `json:"new_version" yaml:"new_version"`
+	Repo          string `json:"repo" yaml:"repo"`
+	DownloadSize  int64  `json:"download_size" yaml:"download_size"`
+	InstalledSize int64  `json:"installed_size" yaml:"installed_size"`
+	Bump          string `json:"bump" yaml:"bump"`
+	Ignored       bool   `json:"ignored" yaml:"ignored"`
+}
+
+// BackupsReport is the data of kind "backups"
+type BackupsReport struct {
+	Path    string       `json:"path" yaml:"path"`
+	Backups []BackupInfo `json:"backups" yaml:"backups"`
+}
+
+// BackupInfo describes one backup directory, newest first in reports
+type BackupInfo struct {
+	Name    string    `json:"name" yaml:"name"`
+	Path    string    `json:"path" yaml:"path"`
+	Created time.Time `json:"created" yaml:"created"`
+	Files   []string  `json:"files" yaml:"files"`
+}
+
+// writeReport encodes data as a Report in format (json or yaml)
+func writeReport(w io.Writer, format, kind string, data interface{}) error {
+	report := Report{
+		SchemaVersion: ReportSchemaVersion,
+		Kind:          kind,
+		GeneratedAt:   time.Now().UTC().Truncate(time.Second),
+		Data:          data,
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// structuredOutput reports whether a machine-readable format was requested
+func structuredOutput(format string) bool {
+	return format != "" && format != "text"
+}
+
+// queryList runs a read-only query that prints one item per line. pacman
+// exits 1 when a query matches nothing, which is reported as an empty list.
+func (a *ArchMaintenance) queryList(name string, args ...string) ([]string, error) {
+	output, err := a.query(name, args...)
+	if exitErr, ok := err.(*ExitError); ok && exitErr.Code == 1 && len(strings.TrimSpace(string(output))) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
+
+// packageDB opens pacman's databases under the configured root
+func (a *ArchMaintenance) packageDB() *pacmandb.DB {
+	return pacmandb.New(a.config.PacmanRoot, a.config.PacmanDBPath)
+}
+
+// packageCounts reads the pacman databases directly and falls back to
+// querying pacman when they cannot be read. Updates are counted against the
+// private sync database copy, since the system one is only refreshed by
+// the upgrade itself.
+func (a *ArchMaintenance) packageCounts() PackageCounts {
+	db := a.packageDB()
+	if local, err := db.Local(); err == nil {
+		counts := PackageCounts{Installed: len(local), Orphans: len(pacmandb.Orphans(local, false))}
+		for _, pkg := range local {
+			if pkg.Reason == pacmandb.Explicit {
+				counts.Explicit++
+			}
+		}
+		counts.Updates = a.pendingUpdateCount()
+		return counts
+	}
+
+	count := func(args ...string) int {
+		items, err := a.queryList("pacman", args...)
+		if err != nil {
+			return -1
+		}
+		return len(items)
+	}
+
+	return PackageCounts{
+		Installed: count("-Q"),
+		Explicit:  count("-Qe"),
+		Orphans:   count("-Qtdq"),
+		Updates:   a.pendingUpdateCount(),
+	}
+}
+
+func (a *ArchMaintenance) diskUsage() []DiskUsage {
+	output, err := a.query("df", "-h", "-x", "tmpfs", "-x", "devtmpfs")
+	if err != nil {
+		return nil
+	}
+
+	var disks []DiskUsage
+	for i, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 6 {
+			continue
+		}
+		disk := DiskUsage{
+			Filesystem:  fields[0],
+			Size:        fields[1],
+			Used:        fields[2],
+			Available:   fields[3],
+			UsedPercent: parseInt(strings.TrimSuffix(fields[4], "%")),
+			Mount:       fields[5],
+			Status:      "ok",
+		}
+		if disk.UsedPercent >= a.config.DiskCriticalPercent {
+			disk.Status = "critical"
+		} else if disk.UsedPercent >= a.config.DiskWarnPercent {
+			disk.Status = "warning"
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+func (a *ArchMaintenance) statusReport() StatusReport {
+	return StatusReport{
+		System:   a.getSystemInfo(),
+		Packages: a.packageCounts(),
+		Disks:    a.diskUsage(),
+	}
+}
+
+// findOrphans lists orphaned packages and those only optionally required,
+// setting aside ORPHANS_IGNORE and exclude
+func (a *ArchMaintenance) findOrphans(exclude []string) (OrphansReport, error) {
+	report := OrphansReport{Orphans: []string{}, Excluded: []string{}, Optional: []OptionalOrphan{}}
+	exclude = append(append([]string{}, a.config.OrphansIgnore...), exclude...)
+
+	var orphans []string
+	var optional []OptionalOrphan
+	if local, err := a.packageDB().Local(); err == nil {
+		for _, pkg := range pacmandb.Orphans(local, false) {
+			orphans = append(orphans, pkg.Name)
+		}
+		optionalFor := pacmandb.RequiredBy(local, true)
+		for _, pkg := range pacmandb.Orphans(local, true) {
+			if !contains(orphans, pkg.Name) {
+				optional = append(optional, OptionalOrphan{Name: pkg.Name, OptionalFor: optionalFor[pkg.Name]})
+			}
+		}
+	} else {
+		if orphans, err = a.queryList("pacman", "-Qtdq"); err != nil {
+			return report, err
+		}
+		all, err := a.queryList("pacman", "-Qttdq")
+		if err != nil {
+			return report, err
+		}
+		for _, name := range all {
+			if !contains(orphans, name) {
+				optional = append(optional, OptionalOrphan{Name: name, OptionalFor: []string{}})
+			}
+		}
+	}
+
+	for _, pkg := range orphans {
+		if contains(exclude, pkg) {
+			report.Excluded = append(report.Excluded, pkg)
+		} else {
+			report.Orphans = append(report.Orphans, pkg)
+		}
+	}
+	for _, pkg := range optional {
+		if contains(exclude, pkg.Name) {
+			report.Excluded = append(report.Excluded, pkg.Name)
+		} else {
+			report.Optional = append(report.Optional, pkg)
+		}
+	}
+	return report, nil
+}
+
+// backups lists backup directories under BackupPath, newest first
+func (a *ArchMaintenance) backups() (BackupsReport, error) {
+	report := BackupsReport{Path: a.config.BackupPath, Backups: []BackupInfo{}}
+
+	entries, err := os.ReadDir(a.config.BackupPath)
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backup := BackupInfo{
+			Name:    entry.Name(),
+			Path:    filepath.Join(a.config.BackupPath, entry.Name()),
+			Created: info.ModTime(),
+			Files:   []string{},
+		}
+		if files, err := os.ReadDir(backup.Path); err == nil {
+			for _, f := range files {
+				backup.Files = append(backup.Files, f.Name())
+			}
+		}
+		report.Backups = append(report.Backups, backup)
+	}
+
+	sort.SliceStable(report.Backups, func(i, j int) bool {
+		return report.Backups[i].Name > report.Backups[j].Name
+	})
+	return report, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Cmd describes one external command invocation
+type Cmd struct {
+	Name string
+	Args []string
+	// ReadOnly marks commands that only inspect the system and may
+	// therefore run in dry-run mode
+	ReadOnly bool
+	Stdin    io.Reader
+	// Stdout and Stderr receive output as it is produced. When nil the
+	// output is captured into the Result instead.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (c *Cmd) String() string {
+	return joinCommandLine(append([]string{c.Name}, c.Args...))
+}
+
+// Result holds captured output and the exit code of a finished command
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// ExitError is returned when a command ran but exited non-zero
+type ExitError struct {
+	Cmd  string
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: exit status %d", e.Cmd, e.Code)
+}
+
+// CommandRunner executes external commands. Every operation goes through
+// one so that tests can script the system and dry-run can intercept it.
+type CommandRunner interface {
+	Run(cmd *Cmd) (*Result, error)
+	// LookPath finds an executable in PATH the way exec.LookPath does
+	LookPath(name string) (string, error)
+}
+
+// ExecRunner runs commands on the real system
+type ExecRunner struct{}
+
+func (ExecRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+func (ExecRunner) Run(cmd *Cmd) (*Result, error) {
+	c := exec.Command(cmd.Name, cmd.Args...)
+	c.Stdin = cmd.Stdin
+
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	if cmd.Stdout != nil {
+		c.Stdout = cmd.Stdout
+	}
+	c.Stderr = &stderr
+	if cmd.Stderr != nil {
+		c.Stderr = cmd.Stderr
+	}
+
+	err := c.Run()
+	result := &Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return result, &ExitError{Cmd: cmd.String(), Code: result.ExitCode}
+	}
+	return result, err
+}
+
+// DryRunRunner passes read-only commands through to Next and records every
+// other command instead of executing it, so nothing that changes the system
+// can run while dry-run is active.
+type DryRunRunner struct {
+	Next     CommandRunner
+	Out      io.Writer
+	Recorded []Cmd
+}
+
+// LookPath only inspects the system and always passes through
+func (d *DryRunRunner) LookPath(name string) (string, error) {
+	return d.Next.LookPath(name)
+}
+
+func (d *DryRunRunner) Run(cmd *Cmd) (*Result, error) {
+	if cmd.ReadOnly {
+		return d.Next.Run(cmd)
+	}
+
+	d.Recorded = append(d.Recorded, *cmd)
+	if d.Out != nil {
+		fmt.Fprintf(d.Out, "  Would run: %s\n", cmd)
+	}
+	return &Result{}, nil
+}
+
+// FakeResponse is the canned outcome of one scripted command
+type FakeResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+// FakeRunner serves scripted responses keyed by the full command line, for
+// running operations off a real Arch system
+type FakeRunner struct {
+	mu        sync.Mutex
+	responses map[string][]FakeResponse
+	paths     map[string]string
+	Calls     []Cmd
+	// Fallback answers commands that have no script; nil makes them fail
+	Fallback *FakeResponse
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{responses: make(map[string][]FakeResponse), paths: make(map[string]string)}
+}
+
+// OnLookPath scripts where LookPath finds name. An empty path, like a name
+// that was never scripted, is not found.
+func (f *FakeRunner) OnLookPath(name, path string) *FakeRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths[name] = path
+	return f
+}
+
+func (f *FakeRunner) LookPath(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if path := f.paths[name]; path != "" {
+		return path, nil
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// On scripts the response for a command line such as "pacman -Qu". Calling
+// it repeatedly for the same line queues responses that are served in
+// order; the last one repeats.
+func (f *FakeRunner) On(cmdline string, resp FakeResponse) *FakeRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[cmdline] = append(f.responses[cmdline], resp)
+	return f
+}
+
+func (f *FakeRunner) Run(cmd *Cmd) (*Result, error) {
+	f.mu.Lock()
+	f.Calls = append(f.Calls, *cmd)
+	key := cmd.String()
+	queue := f.responses[key]
+	var resp FakeResponse
+	switch {
+	case len(queue) > 0:
+		resp = queue[0]
+		if len(queue) > 1 {
+			f.responses[key] = queue[1:]
+		}
+	case f.Fallback != nil:
+		resp = *f.Fallback
+	default:
+		f.mu.Unlock()
+		return nil, fmt.Errorf("fake runner: unexpected command: %s", key)
+	}
+	f.mu.Unlock()
+
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+
+	result := &Result{ExitCode: resp.ExitCode}
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, resp.Stdout)
+	} else {
+		result.Stdout = []byte(resp.Stdout)
+	}
+	if cmd.Stderr != nil {
+		io.WriteString(cmd.Stderr, resp.Stderr)
+	} else {
+		result.Stderr = []byte(resp.Stderr)
+	}
+
+	if resp.ExitCode != 0 {
+		return result, &ExitError{Cmd: key, Code: resp.ExitCode}
+	}
+	return result, nil
+}
+
+// Commands returns the command lines the fake has been asked to run
+func (f *FakeRunner) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lines := make([]string, len(f.Calls))
+	for i := range f.Calls {
+		lines[i] = f.Calls[i].String()
+	}
+	return lines
+}
+
+// lineWriter calls fn for every complete line written to it
+type lineWriter struct {
+	fn  func(line string)
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits a trailing line that had no newline
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
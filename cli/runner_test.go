@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestApp returns an application that runs every command through runner
+// against an empty pacman root. It never prompts: safe confirmations are
+// answered yes and dangerous ones no, unless the test allows them.
+func newTestApp(t *testing.T, runner CommandRunner) *ArchMaintenance {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	a := newArchMaintenance(runner)
+	root := t.TempDir()
+	a.config.PacmanRoot = root
+	a.config.StatePath = filepath.Join(root, "state")
+	a.config.BackupPath = filepath.Join(root, "backups")
+	a.config.BackupEnabled = false
+	a.config.NonInteractive = true
+	a.config.NewsURL = ""
+	a.config.AURURL = ""
+	a.config.AURHelper = "none"
+	a.euid = 1000
+	return a
+}
+
+// assertCommands compares the command lines a fake runner was asked to run
+func assertCommands(t *testing.T, fake *FakeRunner, want ...string) {
+	t.Helper()
+	if got := fake.Commands(); len(got)+len(want) > 0 && !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestFakeRunnerQueuesResponses(t *testing.T) {
+	fake := NewFakeRunner().
+		On("pacman -Qu", FakeResponse{Stdout: "first\n"}).
+		On("pacman -Qu", FakeResponse{Stdout: "second\n"})
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		result, err := fake.Run(&Cmd{Name: "pacman", Args: []string{"-Qu"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(result.Stdout))
+	}
+	if want := []string{"first\n", "second\n", "second\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+}
+
+func TestFakeRunnerExitCodes(t *testing.T) {
+	fake := NewFakeRunner().On("pacman -Dk", FakeResponse{Stderr: "error: missing\n", ExitCode: 1})
+
+	result, err := fake.Run(&Cmd{Name: "pacman", Args: []string{"-Dk"}})
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Fatalf("err = %v, want exit status 1", err)
+	}
+	if string(result.Stderr) != "error: missing\n" {
+		t.Errorf("stderr = %q", result.Stderr)
+	}
+
+	if _, err := fake.Run(&Cmd{Name: "pacman", Args: []string{"-Syu"}}); err == nil {
+		t.Error("unscripted command succeeded")
+	}
+}
+
+func TestFakeRunnerLookPath(t *testing.T) {
+	fake := NewFakeRunner().OnLookPath("paru", "/usr/bin/paru").OnLookPath("yay", "")
+
+	if path, err := fake.LookPath("paru"); err != nil || path != "/usr/bin/paru" {
+		t.Errorf("LookPath(paru) = %q, %v", path, err)
+	}
+	for _, name := range []string{"yay", "fakeroot"} {
+		if _, err := fake.LookPath(name); !errors.Is(err, exec.ErrNotFound) {
+			t.Errorf("LookPath(%s) err = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestDryRunRunnerOnlyRunsReadOnly(t *testing.T) {
+	fake := NewFakeRunner().On("pacman -Qu", FakeResponse{Stdout: "vim 9.1-1 -> 9.1-2\n"})
+	dry := &DryRunRunner{Next: fake}
+
+	if result, err := dry.Run(&Cmd{Name: "pacman", Args: []string{"-Qu"}, ReadOnly: true}); err != nil || len(result.Stdout) == 0 {
+		t.Errorf("read-only command: %v", err)
+	}
+	if _, err := dry.Run(&Cmd{Name: "sudo", Args: []string{"pacman", "-Syu"}}); err != nil {
+		t.Errorf("recorded command: %v", err)
+	}
+
+	assertCommands(t, fake, "pacman -Qu")
+	if len(dry.Recorded) != 1 || dry.Recorded[0].String() != "sudo pacman -Syu" {
+		t.Errorf("recorded = %v", dry.Recorded)
+	}
+}
+
+func TestAURHelperDetection(t *testing.T) {
+	tests := []struct {
+		setting string
+		paths   map[string]string
+		want    string
+	}{
+		{"auto", map[string]string{"paru": "/usr/bin/paru", "yay": "/usr/bin/yay"}, "paru"},
+		{"auto", map[string]string{"yay": "/usr/bin/yay"}, "yay"},
+		{"auto", nil, ""},
+		{"yay", map[string]string{"paru": "/usr/bin/paru", "yay": "/usr/bin/yay"}, "yay"},
+		{"yay", map[string]string{"paru": "/usr/bin/paru"}, ""},
+		{"none", map[string]string{"paru": "/usr/bin/paru"}, ""},
+	}
+	for _, tt := range tests {
+		fake := NewFakeRunner()
+		for name, path := range tt.paths {
+			fake.OnLookPath(name, path)
+		}
+		a := newTestApp(t, fake)
+		a.config.AURHelper = tt.setting
+		if got := a.aurHelper(); got != tt.want {
+			t.Errorf("AUR_HELPER=%s with %v: aurHelper() = %q, want %q", tt.setting, tt.paths, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"archmaint/internal/vercmp"
+)
+
+// criticalPackages are the packages whose pending updates fail the
+// security updates health check. Names are matched exactly.
+var criticalPackages = []string{"linux", "systemd", "glibc", "openssl"}
+
+// Kinds of version change between an installed and a pending package
+const (
+	bumpEpoch     = "epoch"
+	bumpMajor     = "major"
+	bumpMinor     = "minor"
+	bumpPkgrel    = "pkgrel"
+	bumpDowngrade = "downgrade"
+)
+
+// parsePendingUpdate parses one line of pacman -Qu, "name old -> new" with
+// an optional trailing "[ignored]"
+func parsePendingUpdate(line string) (PendingUpdate, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return PendingUpdate{}, false
+	}
+
+	update := PendingUpdate{Name: fields[0], DownloadSize: -1, InstalledSize: -1}
+	if len(fields) >= 4 && fields[2] == "->" {
+		update.OldVersion = fields[1]
+		update.NewVersion = fields[3]
+		update.Bump = classifyBump(update.OldVersion, update.NewVersion)
+		update.Ignored = len(fields) >= 5 && fields[4] == "[ignored]"
+	}
+	return update, true
+}
+
+// pendingUpdates lists the packages pacman -Qu reports as upgradable. An
+// empty dbPath queries the system databases.
+func (a *ArchMaintenance) pendingUpdates(dbPath string) ([]PendingUpdate, error) {
+	lines, err := a.queryList("pacman", append([]string{"-Qu"}, dbPathArgs(dbPath)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := []PendingUpdate{}
+	for _, line := range lines {
+		if update, ok := parsePendingUpdate(line); ok {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+// completeUpdates fills in repository and sizes from the sync databases in
+// dbPath, or the system ones when it is empty. Missing details are left
+// unknown.
+func (a *ArchMaintenance) completeUpdates(updates []PendingUpdate, dbPath string) {
+	if len(updates) == 0 {
+		return
+	}
+
+	names := make([]string, len(updates))
+	for i := range updates {
+		names[i] = updates[i].Name
+	}
+
+	args := append(append([]string{"LC_ALL=C", "pacman", "-Si"}, dbPathArgs(dbPath)...), names...)
+	output, _ := a.query("env", args...)
+	info := parsePackageInfo(string(output))
+
+	for i := range updates {
+		u := &updates[i]
+		if fields, ok := info[u.Name]; ok {
+			u.Repo = fields["Repository"]
+			if size, err := parseSize(fields["Download Size"]); err == nil {
+				u.DownloadSize = size
+			}
+			if size, err := parseSize(fields["Installed Size"]); err == nil {
+				u.InstalledSize = size
+			}
+		}
+	}
+}
+
+func dbPathArgs(dbPath string) []string {
+	if dbPath == "" {
+		return nil
+	}
+	return []string{"--dbpath", dbPath}
+}
+
+// parsePackageInfo splits pacman -Si/-Qi output into one field map per
+// package name. Continuation lines of multi-line values are dropped.
+func parsePackageInfo(output string) map[string]map[string]string {
+	packages := make(map[string]map[string]string)
+	current := make(map[string]string)
+
+	flush := func() {
+		if name := current["Name"]; name != "" {
+			packages[name] = current
+		}
+		current = make(map[string]string)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, " ") {
+			continue
+		}
+		current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	flush()
+	return packages
+}
+
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// parseSize reads a pacman size such as "1.50 MiB" into bytes
+func parseSize(s string) (int64, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(fields[0], 64)
+	unit, ok := sizeUnits[fields[1]]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * unit), nil
+}
+
+// formatSize renders bytes the way pacman does
+func formatSize(bytes int64) string {
+	if bytes < 0 {
+		return "?"
+	}
+	value := float64(bytes)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", bytes)
+			}
+			return fmt.Sprintf("%.2f %s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.2f TiB", value)
+}
+
+// classifyBump names the part of the version that changed: an epoch, the
+// leading pkgver component (major), any later pkgver component (minor) or
+// only the pkgrel. A new version that sorts before the old one is a
+// downgrade.
+func classifyBump(oldVersion, newVersion string) string {
+	oldEpoch, oldVer, oldRel := vercmp.Parse(oldVersion)
+	newEpoch, newVer, newRel := vercmp.Parse(newVersion)
+
+	switch {
+	case vercmp.Compare(oldVersion, newVersion) > 0:
+		return bumpDowngrade
+	case oldEpoch != newEpoch:
+		return bumpEpoch
+	case vercmp.Compare(oldVer, newVer) != 0:
+		separators := func(r rune) bool { return r == '.' || r == '_' || r == '+' || r == '~' }
+		oldParts := strings.FieldsFunc(oldVer, separators)
+		newParts := strings.FieldsFunc(newVer, separators)
+		if len(oldParts) == 0 || len(newParts) == 0 || oldParts[0] != newParts[0] {
+			return bumpMajor
+		}
+		return bumpMinor
+	case oldRel != "" && newRel != "" && vercmp.Compare(oldRel, newRel) != 0:
+		return bumpPkgrel
+	}
+	return ""
+}
+
+// criticalUpdates returns the pending updates to packages in
+// criticalPackages
+func criticalUpdates(updates []PendingUpdate) []PendingUpdate {
+	var critical []PendingUpdate
+	for _, update := range updates {
+		if contains(criticalPackages, update.Name) {
+			critical = append(critical, update)
+		}
+	}
+	return critical
+}
+
+// printUpdatePreview lists pending updates with their bump kind, repository
+// and download size, followed by totals
+func printUpdatePreview(updates []PendingUpdate, limit int) {
+	fmt.Printf("\nAvailable updates (%d packages):\n", len(updates))
+
+	bumps := make(map[string]int)
+	var download int64
+	for i, update := range updates {
+		bumps[update.Bump]++
+		if update.DownloadSize > 0 {
+			download += update.DownloadSize
+		}
+		if i >= limit {
+			continue
+		}
+
+		line := fmt.Sprintf("  • %s %s -> %s", update.Name, update.OldVersion, update.NewVersion)
+		if update.Bump != "" {
+			line += fmt.Sprintf(" [%s]", update.Bump)
+		}
+		var details []string
+		if update.Repo != "" {
+			details = append(details, update.Repo)
+		}
+		if update.DownloadSize >= 0 {
+			details = append(details, formatSize(update.DownloadSize))
+		}
+		if update.Ignored {
+			details = append(details, "ignored")
+		}
+		if len(details) > 0 {
+			line += " (" + strings.Join(details, ", ") + ")"
+		}
+
+		switch update.Bump {
+		case bumpEpoch, bumpMajor, bumpDowngrade:
+			warningColor.Println(line)
+		default:
+			fmt.Println(line)
+		}
+	}
+	if len(updates) > limit {
+		infoColor.Printf("... and %d more packages\n", len(updates)-limit)
+	}
+
+	var summary []string
+	for _, bump := range []string{bumpEpoch, bumpMajor, bumpMinor, bumpPkgrel, bumpDowngrade} {
+		if bumps[bump] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", bumps[bump], bump))
+		}
+	}
+	if len(summary) > 0 {
+		fmt.Printf("\nChanges: %s\n", strings.Join(summary, ", "))
+	}
+	if download > 0 {
+		fmt.Printf("Total download size: %s\n", formatSize(download))
+	}
+	if critical := criticalUpdates(updates); len(critical) > 0 {
+		names := make([]string, len(critical))
+		for i, update := range critical {
+			names[i] = update.Name
+		}
+		warningColor.Printf("Critical packages: %s\n", strings.Join(names, ", "))
+	}
+}
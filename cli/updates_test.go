@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const pacmanSi = `Repository      : core
+Name            : glibc
+Version         : 2.39-1
+Download Size   : 9.50 MiB
+Installed Size  : 47.00 MiB
+
+Repository      : extra
+Name            : vim
+Version         : 9.1.0-2
+Download Size   : 1.50 MiB
+Installed Size  : 4.00 MiB
+`
+
+// scriptUpdate scripts the queries around an update of glibc and vim
+// listed from dbPath, or the system databases when it is empty. The
+// upgrade itself is left to each test.
+func scriptUpdate(fake *FakeRunner, dbPath string) *FakeRunner {
+	suffix := ""
+	if dbPath != "" {
+		suffix = " --dbpath " + dbPath
+	}
+	return fake.
+		On("pacman -Qu"+suffix, FakeResponse{Stdout: "glibc 2.38-7 -> 2.39-1\nvim 9.1.0-1 -> 9.1.0-2\n"}).
+		On("env LC_ALL=C pacman -Si"+suffix+" glibc vim", FakeResponse{Stdout: pacmanSi}).
+		On("uname -r", FakeResponse{Stdout: "6.11.1-arch1-1\n"}).
+		On("pacman -Q linux", FakeResponse{Stdout: "linux 6.11.1.arch1-1\n"})
+}
+
+func TestSystemUpdate(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	dbPath := syncDBDir()
+	scriptUpdate(fake, dbPath).
+		OnLookPath("fakeroot", "/usr/bin/fakeroot").
+		On("fakeroot -- pacman -Sy --dbpath "+dbPath+" --logfile /dev/null", FakeResponse{}).
+		On("sudo pacman -Syu --noconfirm", FakeResponse{})
+
+	a.systemUpdate()
+
+	// The system databases are only refreshed by the -Syu itself
+	assertCommands(t, fake,
+		"fakeroot -- pacman -Sy --dbpath "+dbPath+" --logfile /dev/null",
+		"pacman -Qu --dbpath "+dbPath,
+		"env LC_ALL=C pacman -Si --dbpath "+dbPath+" glibc vim",
+		"sudo pacman -Syu --noconfirm",
+		"uptime -s",
+		"uname -r",
+		"pacman -Q linux",
+	)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+	if _, err := os.Stat(filepath.Join(a.config.StatePath, "news.json")); err != nil {
+		t.Errorf("upgrade not recorded: %v", err)
+	}
+}
+
+func TestSystemUpdateAsRoot(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	dbPath := syncDBDir()
+	scriptUpdate(fake, dbPath).
+		On("pacman -Sy --dbpath "+dbPath+" --logfile /dev/null", FakeResponse{}).
+		On("sudo pacman -Syu --noconfirm", FakeResponse{})
+	a.euid = 0
+
+	a.systemUpdate()
+
+	if got := fake.Commands()[0]; got != "pacman -Sy --dbpath "+dbPath+" --logfile /dev/null" {
+		t.Errorf("first command = %q, want a plain pacman -Sy of the copy", got)
+	}
+}
+
+func TestSystemUpdateWithoutFakeroot(t *testing.T) {
+	fake := scriptUpdate(NewFakeRunner(), "").
+		On("sudo pacman -Syu --noconfirm", FakeResponse{})
+	a := newTestApp(t, fake)
+
+	a.systemUpdate()
+
+	// Without fakeroot the copy cannot be refreshed, so the system
+	// databases are listed as they are
+	assertCommands(t, fake,
+		"pacman -Qu",
+		"env LC_ALL=C pacman -Si glibc vim",
+		"sudo pacman -Syu --noconfirm",
+		"uptime -s",
+		"uname -r",
+		"pacman -Q linux",
+	)
+	if code := a.status.exitCode(); code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+}
+
+func TestSystemUpdateFailure(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	dbPath := syncDBDir()
+	scriptUpdate(fake, dbPath).
+		OnLookPath("fakeroot", "/usr/bin/fakeroot").
+		On("fakeroot -- pacman -Sy --dbpath "+dbPath+" --logfile /dev/null", FakeResponse{}).
+		On("sudo pacman -Syu --noconfirm", FakeResponse{ExitCode: 1})
+
+	a.systemUpdate()
+
+	if code := a.status.exitCode(); code != exitFailure {
+		t.Errorf("exit code = %d, want %d", code, exitFailure)
+	}
+	if _, err := os.Stat(filepath.Join(a.config.StatePath, "news.json")); !os.IsNotExist(err) {
+		t.Errorf("failed upgrade recorded: %v", err)
+	}
+}
+
+func TestSystemUpdateUpToDate(t *testing.T) {
+	fake := NewFakeRunner()
+	a := newTestApp(t, fake)
+	dbPath := syncDBDir()
+	fake.
+		OnLookPath("fakeroot", "/usr/bin/fakeroot").
+		On("fakeroot -- pacman -Sy --dbpath "+dbPath+" --logfile /dev/null", FakeResponse{}).
+		On("pacman -Qu --dbpath "+dbPath, FakeResponse{ExitCode: 1})
+
+	a.systemUpdate()
+
+	assertCommands(t, fake,
+		"fakeroot -- pacman -Sy --dbpath "+dbPath+" --logfile /dev/null",
+		"pacman -Qu --dbpath "+dbPath,
+	)
+}